@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
 )
 
@@ -37,3 +38,706 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrCorruptRecord struct {
+	Offset   uint64
+	Segment  uint64
+	Position uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DataLoss,
+		fmt.Sprintf("corrupt record at offset: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record at offset %d (segment %d, position %d) failed its checksum",
+		e.Offset,
+		e.Segment,
+		e.Position,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOffsetCompacted struct {
+	Offset uint64
+}
+
+func (e ErrOffsetCompacted) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("offset compacted: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record at offset %d was superseded by a newer record with the same key and compacted away",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOffsetCompacted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownProducer struct {
+	ProducerID uint64
+}
+
+func (e ErrUnknownProducer) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("unknown producer: %d", e.ProducerID),
+	)
+	msg := fmt.Sprintf(
+		"Producer %d wasn't initialized or has expired, call InitProducer for a new ID",
+		e.ProducerID,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownProducer) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOutOfOrderSequence struct {
+	ProducerID uint64
+	Sequence   uint64
+	Expected   uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("out of order sequence: %d", e.Sequence),
+	)
+	msg := fmt.Sprintf(
+		"Producer %d sent sequence %d when %d was expected, and it isn't a retry of a recent request",
+		e.ProducerID,
+		e.Sequence,
+		e.Expected,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidTxnState struct {
+	ProducerID uint64
+	// Open is whether the producer has an open transaction
+	Open bool
+}
+
+func (e ErrInvalidTxnState) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("invalid transaction state: %d", e.ProducerID),
+	)
+	msg := fmt.Sprintf(
+		"Producer %d has no open transaction",
+		e.ProducerID,
+	)
+	if e.Open {
+		msg = fmt.Sprintf(
+			"Producer %d already has an open transaction",
+			e.ProducerID,
+		)
+	}
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidTxnState) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOffsetNotCommitted struct {
+	Offset uint64
+}
+
+func (e ErrOffsetNotCommitted) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("offset not committed: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record at offset %d was written by an aborted transaction or is a control record",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOffsetNotCommitted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownTopic struct {
+	Topic string
+}
+
+func (e ErrUnknownTopic) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("unknown topic: %q", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"Topic %q doesn't exist, create it with CreateTopic",
+		e.Topic,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("topic exists: %q", e.Topic),
+	)
+	msg := fmt.Sprintf("Topic %q already exists", e.Topic)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid topic name: %q", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"Topic names are 1 to 249 letters, digits, '.', '_' or '-', and can't be '.' or '..': %q",
+		e.Topic,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownPartition struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrUnknownPartition) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("unknown partition: %q/%d", e.Topic, e.Partition),
+	)
+	msg := fmt.Sprintf(
+		"Topic %q has no partition %d",
+		e.Topic,
+		e.Partition,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownPartition) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrBatchPartitions struct {
+	Topic string
+	// Partitions are two of the partitions the batch's keys map to
+	Partitions [2]uint32
+}
+
+func (e ErrBatchPartitions) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("batch spans partitions: %q", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"The batch's keys map to partitions %d and %d of topic %q, a batch has to go to one",
+		e.Partitions[0],
+		e.Partitions[1],
+		e.Topic,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrBatchPartitions) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTxnPartitioned struct {
+	ProducerID uint64
+	Topic      string
+}
+
+func (e ErrTxnPartitioned) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("transaction writes to partitioned topic: %q", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"Producer %d has an open transaction, and transactions can't write to partitioned topic %q",
+		e.ProducerID,
+		e.Topic,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTxnPartitioned) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNoCommittedOffset struct {
+	Group     string
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrNoCommittedOffset) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("no committed offset: %q", e.Group),
+	)
+	msg := fmt.Sprintf(
+		"Group %q hasn't committed an offset in partition %d of topic %q",
+		e.Group,
+		e.Partition,
+		e.Topic,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNoCommittedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidGroup struct {
+	Group string
+}
+
+func (e ErrInvalidGroup) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid group name: %q", e.Group),
+	)
+	msg := "Consumer groups need a name"
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidGroup) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownMember struct {
+	Group    string
+	MemberID string
+}
+
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("unknown group member: %q", e.MemberID),
+	)
+	msg := fmt.Sprintf(
+		"%q isn't a member of group %q or its session expired, join the group again",
+		e.MemberID,
+		e.Group,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrIllegalGeneration struct {
+	Group      string
+	Generation uint64
+	Current    uint64
+}
+
+func (e ErrIllegalGeneration) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("illegal generation: %d", e.Generation),
+	)
+	msg := fmt.Sprintf(
+		"Group %q rebalanced from generation %d to %d, join it again for the new assignment",
+		e.Group,
+		e.Generation,
+		e.Current,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrIllegalGeneration) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNotAssigned struct {
+	Group     string
+	MemberID  string
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrNotAssigned) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("partition not assigned: %q/%d", e.Topic, e.Partition),
+	)
+	msg := fmt.Sprintf(
+		"Partition %d of topic %q isn't assigned to %q in group %q",
+		e.Partition,
+		e.Topic,
+		e.MemberID,
+		e.Group,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotAssigned) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidStrategy struct {
+	Strategy string
+	// Group is set when the group already uses another strategy
+	Group string
+}
+
+func (e ErrInvalidStrategy) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid assignment strategy: %q", e.Strategy),
+	)
+	msg := fmt.Sprintf("No assignment strategy is called %q", e.Strategy)
+	if e.Group != "" {
+		msg = fmt.Sprintf(
+			"Group %q assigns its partitions with another strategy than %q",
+			e.Group,
+			e.Strategy,
+		)
+	}
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidStrategy) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNoSchema struct {
+	Topic string
+	// ID is set when the schema was looked up by ID, Version when by the
+	// topic's version, neither for the topic's latest
+	ID      uint64
+	Version uint32
+}
+
+func (e ErrNoSchema) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, "schema not found")
+	var msg string
+	switch {
+	case e.ID != 0:
+		msg = fmt.Sprintf("No schema has ID %d", e.ID)
+		if e.Topic != "" {
+			msg = fmt.Sprintf("Topic %q has no schema with ID %d", e.Topic, e.ID)
+		}
+	case e.Version != 0:
+		msg = fmt.Sprintf("Topic %q has no schema version %d", e.Topic, e.Version)
+	default:
+		msg = fmt.Sprintf("Topic %q has no schema", e.Topic)
+	}
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNoSchema) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidSchema struct {
+	Topic  string
+	Reason string
+}
+
+func (e ErrInvalidSchema) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid schema: %s", e.Reason),
+	)
+	msg := fmt.Sprintf(
+		"The schema registered for topic %q is invalid: %s",
+		e.Topic,
+		e.Reason,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidSchema) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrIncompatibleSchema struct {
+	Topic string
+	// Version is the topic's latest version, the new one was checked
+	// against
+	Version uint32
+	Reason  string
+}
+
+func (e ErrIncompatibleSchema) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("incompatible schema: %s", e.Reason),
+	)
+	msg := fmt.Sprintf(
+		"The schema isn't compatible with version %d of topic %q's: %s",
+		e.Version,
+		e.Topic,
+		e.Reason,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrIncompatibleSchema) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrSchemaViolation struct {
+	Topic    string
+	SchemaID uint64
+	Reason   string
+}
+
+func (e ErrSchemaViolation) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("record doesn't match schema %d: %s", e.SchemaID, e.Reason),
+	)
+	msg := fmt.Sprintf(
+		"The record doesn't match schema %d of topic %q: %s",
+		e.SchemaID,
+		e.Topic,
+		e.Reason,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrSchemaViolation) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNotLeader struct {
+	// Leader is the leader's RPC address, empty if no leader is known
+	Leader string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, "not the leader")
+	msg := "No leader is elected, retry once one is"
+	if e.Leader != "" {
+		msg = fmt.Sprintf("This server isn't the leader, %s is", e.Leader)
+	}
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,369 @@
+// Command dis-log-tool inspects and repairs the segments in a log directory
+// offline: a DistributedLog's log directory, or the raft/log directory its
+// raft log is kept in. The log mustn't be open while it runs.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"github.com/halladj/dis-log/internal/log"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const usage = `usage: dis-log-tool <command> [flags] <dir>
+
+commands:
+  list      list the segments and their offset ranges
+  dump      print the records in the segments as JSON or hex
+  verify    check the stores and indexes agree
+  rebuild   rebuild the indexes from the stores
+  truncate  drop a segment's corrupted tail
+
+Run dis-log-tool <command> -h for the command's flags.
+`
+
+// errProblems is returned by verify when it finds damage, so the tool exits
+// with a failure without printing another message.
+var errProblems = errors.New("problems found")
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	commands := map[string]func(*cli) error{
+		"list":     (*cli).list,
+		"dump":     (*cli).dump,
+		"verify":   (*cli).verify,
+		"rebuild":  (*cli).rebuild,
+		"truncate": (*cli).truncate,
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	c := &cli{}
+	if err := c.setup(os.Args[1], os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "dis-log-tool: %v\n", err)
+		os.Exit(2)
+	}
+	err := run(c)
+	if cerr := c.inspector.Close(); err == nil {
+		err = cerr
+	}
+	if err == errProblems {
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dis-log-tool: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+type cli struct {
+	inspector *log.Inspector
+	// raft is set when the directory is a raft log, whose records are
+	// raft entries
+	raft     bool
+	segments []uint64
+	format   string
+}
+
+func (c *cli) setup(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	keyring := fs.String("keyring", "", "keyring file of an encrypted log")
+	maxIndexBytes := fs.Uint64("max-index-bytes", 1024, "the log's Segment.MaxIndexBytes")
+	indexInterval := fs.Uint64("index-interval-bytes", 0, "the log's Segment.IndexIntervalBytes")
+	isRaft := fs.String("raft", "auto", "whether the directory is a raft log: true, false or auto to tell from its path")
+	segment := fs.String("segment", "", "base offset of the segment to use, every segment if unset")
+	if command == "truncate" {
+		fs.Lookup("segment").Usage = "base offset of the segment to truncate, the last if unset"
+	}
+	if command == "dump" {
+		fs.StringVar(&c.format, "format", "json", "output format: json or hex")
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dis-log-tool %s [flags] <dir>\n", command)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dir := fs.Arg(0)
+
+	config := log.Config{}
+	config.Segment.MaxIndexBytes = *maxIndexBytes
+	config.Segment.IndexIntervalBytes = *indexInterval
+	if *keyring != "" {
+		keys, err := log.NewFileKeyring(*keyring)
+		if err != nil {
+			return err
+		}
+		config.Encryption.Keys = keys
+	}
+	switch *isRaft {
+	case "auto":
+		c.raft = filepath.Base(dir) == "log" &&
+			filepath.Base(filepath.Dir(filepath.Clean(dir))) == "raft"
+	case "true", "false":
+		c.raft = *isRaft == "true"
+	default:
+		return fmt.Errorf("-raft must be true, false or auto, not %q", *isRaft)
+	}
+	if c.format != "" && c.format != "json" && c.format != "hex" {
+		return fmt.Errorf("-format must be json or hex, not %q", c.format)
+	}
+
+	var err error
+	if c.inspector, err = log.NewInspector(dir, config); err != nil {
+		return err
+	}
+	c.segments = c.inspector.BaseOffsets
+	switch {
+	case *segment != "":
+		off, err := strconv.ParseUint(*segment, 10, 64)
+		if err != nil {
+			c.inspector.Close()
+			return fmt.Errorf("-segment: %v", err)
+		}
+		found := false
+		for _, base := range c.segments {
+			found = found || base == off
+		}
+		if !found {
+			c.inspector.Close()
+			return fmt.Errorf("-segment: no segment with base offset %d in %s", off, dir)
+		}
+		c.segments = []uint64{off}
+	case command == "truncate" && len(c.segments) > 0:
+		c.segments = c.segments[len(c.segments)-1:]
+	}
+	return nil
+}
+
+func (c *cli) list() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tOFFSETS\tRECORDS\tSTORE BYTES\tINDEX ENTRIES\tKEY\tSTATUS")
+	for _, base := range c.segments {
+		r, err := c.inspector.Inspect(base)
+		if err != nil {
+			return err
+		}
+		offsets := "empty"
+		if r.NextOffset > r.BaseOffset {
+			offsets = fmt.Sprintf("%d-%d", r.BaseOffset, r.NextOffset-1)
+		}
+		key := r.KeyID
+		if key == "" {
+			key = "-"
+		}
+		status := "ok"
+		if !r.OK() {
+			status = "damaged"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%s\t%s\n",
+			r.BaseOffset, offsets, r.Records, r.StoreBytes,
+			r.IndexEntries, key, status,
+		)
+	}
+	return w.Flush()
+}
+
+// dumped is a record printed by dump in JSON.
+type dumped struct {
+	Segment  uint64          `json:"segment"`
+	Position uint64          `json:"position"`
+	Record   json.RawMessage `json:"record,omitempty"`
+	// a raft log's records are raft entries, and commands are the
+	// requests the log applies
+	RaftType    string          `json:"raft_type,omitempty"`
+	RequestType string          `json:"request_type,omitempty"`
+	Request     json.RawMessage `json:"request,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+func (c *cli) dump() error {
+	enc := json.NewEncoder(os.Stdout)
+	for _, base := range c.segments {
+		err := c.inspector.Frames(base, func(f log.Frame) error {
+			if c.format == "hex" {
+				return dumpHex(base, f)
+			}
+			if f.Err != nil {
+				return enc.Encode(dumped{
+					Segment:  base,
+					Position: f.Position,
+					Error:    f.Err.Error(),
+				})
+			}
+			for _, record := range f.Records {
+				d, err := c.decode(record)
+				if err != nil {
+					return err
+				}
+				d.Segment, d.Position = base, f.Position
+				if err = enc.Encode(d); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dumpHex(base uint64, f log.Frame) error {
+	fmt.Printf("segment %d, frame at %d, %d bytes", base, f.Position, len(f.Bytes))
+	if n := len(f.Records); n > 0 {
+		fmt.Printf(", offsets %d-%d", f.Records[0].Offset, f.Records[n-1].Offset)
+	}
+	if f.Err != nil {
+		fmt.Printf(", %v", f.Err)
+	}
+	fmt.Printf("\n%s\n", hex.Dump(f.Bytes))
+	return nil
+}
+
+var raftTypes = map[raft.LogType]string{
+	raft.LogCommand:              "command",
+	raft.LogNoop:                 "noop",
+	raft.LogAddPeerDeprecated:    "add_peer",
+	raft.LogRemovePeerDeprecated: "remove_peer",
+	raft.LogBarrier:              "barrier",
+	raft.LogConfiguration:        "configuration",
+}
+
+func (c *cli) decode(record *api.Record) (dumped, error) {
+	d := dumped{}
+	var err error
+	if d.Record, err = protojson.Marshal(record); err != nil {
+		return d, err
+	}
+	if !c.raft {
+		return d, nil
+	}
+	t := raft.LogType(record.Type)
+	if d.RaftType = raftTypes[t]; d.RaftType == "" {
+		d.RaftType = fmt.Sprintf("unknown(%d)", t)
+	}
+	if t != raft.LogCommand || len(record.Value) == 0 {
+		return d, nil
+	}
+	var req proto.Message
+	switch log.RequestType(record.Value[0]) {
+	case log.AppendRequestType:
+		d.RequestType, req = "append", &api.ProduceRequest{}
+	case log.RetentionRequestType:
+		d.RequestType, req = "retention", &api.RetentionRequest{}
+	case log.AppendBatchRequestType:
+		d.RequestType, req = "append_batch", &api.ProduceBatchRequest{}
+	case log.InitProducerRequestType:
+		d.RequestType, req = "init_producer", &api.InitProducerRequest{}
+	case log.BeginTxnRequestType:
+		d.RequestType, req = "begin_txn", &api.TxnRequest{}
+	case log.CommitTxnRequestType:
+		d.RequestType, req = "commit_txn", &api.TxnRequest{}
+	case log.AbortTxnRequestType:
+		d.RequestType, req = "abort_txn", &api.TxnRequest{}
+	case log.CreateTopicRequestType:
+		d.RequestType, req = "create_topic", &api.CreateTopicRequest{}
+	case log.DeleteTopicRequestType:
+		d.RequestType, req = "delete_topic", &api.DeleteTopicRequest{}
+	case log.CommitOffsetRequestType:
+		d.RequestType, req = "commit_offset", &api.CommitOffsetRequest{}
+	case log.JoinGroupRequestType:
+		d.RequestType, req = "join_group", &api.JoinGroupRequest{}
+	case log.HeartbeatRequestType:
+		d.RequestType, req = "heartbeat", &api.HeartbeatRequest{}
+	case log.LeaveGroupRequestType:
+		d.RequestType, req = "leave_group", &api.LeaveGroupRequest{}
+	case log.RegisterSchemaRequestType:
+		d.RequestType, req = "register_schema", &api.RegisterSchemaRequest{}
+	default:
+		d.RequestType = fmt.Sprintf("unknown(%d)", record.Value[0])
+		return d, nil
+	}
+	if err = proto.Unmarshal(record.Value[1:], req); err != nil {
+		d.Error = err.Error()
+		return d, nil
+	}
+	d.Request, err = protojson.Marshal(req)
+	return d, err
+}
+
+func (c *cli) verify() error {
+	var problems int
+	for _, name := range c.inspector.Orphans {
+		fmt.Printf("%s: index without a store\n", name)
+		problems++
+	}
+	for _, base := range c.segments {
+		r, err := c.inspector.Inspect(base)
+		if err != nil {
+			return err
+		}
+		if r.OK() {
+			fmt.Printf("segment %d: ok\n", base)
+			continue
+		}
+		problems++
+		if n := r.Repairs.TruncatedBytes; n > 0 {
+			fmt.Printf("segment %d: %d byte partly written tail\n", base, n)
+		}
+		for _, pos := range r.CorruptFrames {
+			fmt.Printf("segment %d: frame at %d is corrupt\n", base, pos)
+		}
+		if r.Repairs.RebuiltIndex {
+			fmt.Printf("segment %d: index doesn't match the store\n", base)
+		}
+		if r.Repairs.RebuiltTimeIndex {
+			fmt.Printf("segment %d: time index doesn't match the store\n", base)
+		}
+	}
+	if problems > 0 {
+		return errProblems
+	}
+	return nil
+}
+
+func (c *cli) rebuild() error {
+	for _, base := range c.segments {
+		if err := c.inspector.RebuildIndexes(base); err != nil {
+			return err
+		}
+		fmt.Printf("segment %d: rebuilt indexes\n", base)
+	}
+	return nil
+}
+
+func (c *cli) truncate() error {
+	for _, base := range c.segments {
+		n, err := c.inspector.TruncateTail(base)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Printf("segment %d: no corrupted tail\n", base)
+			continue
+		}
+		fmt.Printf("segment %d: truncated %d bytes\n", base, n)
+	}
+	return nil
+}
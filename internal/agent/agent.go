@@ -14,6 +14,7 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 
 	"github.com/halladj/dis-log/internal/auth"
 	"github.com/halladj/dis-log/internal/discovery"
@@ -53,6 +54,7 @@ type Agent struct {
 	mux        cmux.CMux
 	log        *log.DistributedLog
 	server     *grpc.Server
+	forwarder  *server.LeaderClients
 	membership *discovery.Membership
 
 	shutdown     bool
@@ -96,10 +98,13 @@ func (a *Agent) setupLogger() error {
 }
 
 func (a *Agent) setupMux() error {
-	rpcAddr := fmt.Sprintf(
-		":%d",
-		a.Config.RPCPort,
-	)
+	// listen on the address the other servers know this one by, raft
+	// names leaders by their listeners' addresses and requests are
+	// forwarded to them there
+	rpcAddr, err := a.Config.RPCAddr()
+	if err != nil {
+		return err
+	}
 	ln, err := net.Listen("tcp", rpcAddr)
 	if err != nil {
 		return err
@@ -143,10 +148,27 @@ func (a *Agent) setupServer() error {
 		a.Config.ACLModelFile,
 		a.Config.ACLPolicyFile,
 	)
+	// the requests only a leader can serve are forwarded to it, with this
+	// server as the peer
+	peerCreds := insecure.NewCredentials()
+	if a.Config.PeerTLSConfig != nil {
+		peerCreds = credentials.NewTLS(a.Config.PeerTLSConfig)
+	}
+	a.forwarder = &server.LeaderClients{
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(peerCreds)},
+	}
 	serverConfig := &server.Config{
-		CommitLog:   a.log,
-		Authorizer:  authorizer,
-		GetServerer: a.log,
+		CommitLog:        a.log,
+		Authorizer:       authorizer,
+		GetServerer:      a.log,
+		IdempotentLog:    a.log,
+		TransactionalLog: a.log,
+		Topics:           a.log,
+		GroupOffsets:     a.log,
+		GroupCoordinator: a.log,
+		SchemaRegistry:   a.log,
+		ConsistentReader: a.log,
+		Forwarder:        a.forwarder,
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -206,6 +228,7 @@ func (a *Agent) Shutdown() error {
 			a.server.GracefulStop()
 			return nil
 		},
+		a.forwarder.Close,
 		a.log.Close,
 	}
 	for _, fn := range shutdown {
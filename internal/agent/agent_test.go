@@ -12,11 +12,14 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	api "github.com/halladj/dis-log/api/v1"
 	"github.com/halladj/dis-log/internal/agent"
 	"github.com/halladj/dis-log/internal/config"
+	"github.com/halladj/dis-log/internal/log"
 )
 
 func TestAgent(t *testing.T) {
@@ -127,6 +130,287 @@ func TestAgent(t *testing.T) {
 	got := grpc.Code(err)
 	want := grpc.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
 	require.Equal(t, got, want)
+
+	// a topic has its own offsets and is replicated like the default one
+	_, err = leaderClient.CreateTopic(
+		context.Background(),
+		&api.CreateTopicRequest{Name: "orders"},
+	)
+	require.NoError(t, err)
+	produceResponse, err = leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("bar"),
+			},
+			Topic: "orders",
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produceResponse.Offset)
+	require.Eventually(t, func() bool {
+		consumeResponse, err := followerClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{
+				Offset: produceResponse.Offset,
+				Topic:  "orders",
+			},
+		)
+		return err == nil && string(consumeResponse.Record.Value) == "bar"
+	}, 3*time.Second, 50*time.Millisecond)
+	topics, err := followerClient.ListTopics(
+		context.Background(),
+		&api.ListTopicsRequest{},
+	)
+	require.NoError(t, err)
+	require.Len(t, topics.Topics, 1)
+	require.Equal(t, "orders", topics.Topics[0].Name)
+
+	// a consumer group picks up from the offset it committed, on any
+	// server
+	_, err = leaderClient.CommitOffset(
+		context.Background(),
+		&api.CommitOffsetRequest{Group: "workers", Topic: "orders", Offset: 1},
+	)
+	require.NoError(t, err)
+	_, err = leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{Value: []byte("baz")},
+			Topic:  "orders",
+		},
+	)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		res, err := followerClient.FetchOffset(
+			context.Background(),
+			&api.FetchOffsetRequest{Group: "workers", Topic: "orders"},
+		)
+		return err == nil && res.Offset == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := followerClient.ConsumeStream(
+		ctx,
+		&api.ConsumeRequest{Group: "workers", Topic: "orders"},
+	)
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Record.Offset)
+	require.Equal(t, "baz", string(res.Record.Value))
+
+	// a partitioned topic's partitions are replicated by raft groups of
+	// their own, sharing the servers' raft listeners
+	_, err = leaderClient.CreateTopic(
+		context.Background(),
+		&api.CreateTopicRequest{
+			Name:   "clicks",
+			Config: &api.TopicConfig{Partitions: 2},
+		},
+	)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		produceResponse, err = leaderClient.Produce(
+			context.Background(),
+			&api.ProduceRequest{
+				Record:      &api.Record{Value: []byte("click")},
+				Topic:       "clicks",
+				Partitioner: api.Partitioner_PARTITIONER_EXPLICIT,
+				Partition:   1,
+			},
+		)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, uint32(1), produceResponse.Partition)
+	require.Equal(t, uint64(0), produceResponse.Offset)
+	require.Eventually(t, func() bool {
+		consumeResponse, err := followerClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{
+				Topic:     "clicks",
+				Partition: 1,
+			},
+		)
+		return err == nil && string(consumeResponse.Record.Value) == "click"
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the partitions' leaders are spread over the servers, and a produce
+	// sent to any server is forwarded to its partition's leader
+	topics, err = leaderClient.ListTopics(
+		context.Background(),
+		&api.ListTopicsRequest{},
+	)
+	require.NoError(t, err)
+	require.Equal(t, "clicks", topics.Topics[0].Name)
+	require.Eventually(t, func() bool {
+		topics, err := leaderClient.ListTopics(
+			context.Background(),
+			&api.ListTopicsRequest{},
+		)
+		if err != nil {
+			return false
+		}
+		leaders := make(map[string]bool)
+		for _, part := range topics.Topics[0].Partitions {
+			for _, r := range part.Replicas {
+				if r.IsLeader {
+					leaders[r.Id] = true
+				}
+			}
+		}
+		return len(leaders) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	for _, c := range []api.LogClient{leaderClient, followerClient} {
+		for partition := uint32(0); partition < 2; partition++ {
+			res, err := c.Produce(
+				context.Background(),
+				&api.ProduceRequest{
+					Record:      &api.Record{Value: []byte("click")},
+					Topic:       "clicks",
+					Partitioner: api.Partitioner_PARTITIONER_EXPLICIT,
+					Partition:   partition,
+				},
+			)
+			require.NoError(t, err)
+			require.Equal(t, partition, res.Partition)
+		}
+	}
+	batch, err := followerClient.ProduceBatch(
+		context.Background(),
+		&api.ProduceBatchRequest{
+			Records: []*api.Record{{Value: []byte("forwarded")}},
+		},
+	)
+	require.NoError(t, err)
+
+	// a follower serves leader and linearizable reads from the leader, so
+	// they see what the leader acknowledged straight away
+	for _, consistency := range []api.Consistency{
+		api.Consistency_CONSISTENCY_LEADER,
+		api.Consistency_CONSISTENCY_LINEARIZABLE,
+	} {
+		consumeResponse, err := followerClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{
+				Offset:      batch.Offsets[0],
+				Consistency: consistency,
+			},
+		)
+		require.NoError(t, err)
+		require.Equal(t, "forwarded", string(consumeResponse.Record.Value))
+		for partition := uint32(0); partition < 2; partition++ {
+			consumeResponse, err = followerClient.Consume(
+				context.Background(),
+				&api.ConsumeRequest{
+					Topic:       "clicks",
+					Partition:   partition,
+					Consistency: consistency,
+				},
+			)
+			require.NoError(t, err)
+			require.Equal(t, "click", string(consumeResponse.Record.Value))
+		}
+	}
+	stream, err = followerClient.ConsumeStream(
+		ctx,
+		&api.ConsumeRequest{
+			Offset:      batch.Offsets[0],
+			Consistency: api.Consistency_CONSISTENCY_LINEARIZABLE,
+		},
+	)
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "forwarded", string(res.Record.Value))
+
+	// the group's members share the topic's partitions, a rebalance
+	// fencing off the members of the generation before
+	first, err := leaderClient.JoinGroup(
+		context.Background(),
+		&api.JoinGroupRequest{Group: "clickers", Topics: []string{"clicks"}},
+	)
+	require.NoError(t, err)
+	require.Len(t, first.Assignment, 2)
+	second, err := leaderClient.JoinGroup(
+		context.Background(),
+		&api.JoinGroupRequest{Group: "clickers", Topics: []string{"clicks"}},
+	)
+	require.NoError(t, err)
+	require.Equal(t, first.Generation+1, second.Generation)
+	_, err = leaderClient.Heartbeat(
+		context.Background(),
+		&api.HeartbeatRequest{
+			Group:      "clickers",
+			MemberId:   first.MemberId,
+			Generation: first.Generation,
+		},
+	)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	first, err = leaderClient.JoinGroup(
+		context.Background(),
+		&api.JoinGroupRequest{
+			Group:    "clickers",
+			MemberId: first.MemberId,
+			Topics:   []string{"clicks"},
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, second.Generation, first.Generation)
+	require.Len(t, first.Assignment, 1)
+	require.Len(t, second.Assignment, 1)
+	require.NotEqual(t,
+		first.Assignment[0].Partition,
+		second.Assignment[0].Partition,
+	)
+	_, err = leaderClient.LeaveGroup(
+		context.Background(),
+		&api.LeaveGroupRequest{Group: "clickers", MemberId: second.MemberId},
+	)
+	require.NoError(t, err)
+
+	// once a topic has a schema the records produced to it have to match,
+	// and are consumed with the ID of the schema they matched
+	registered, err := leaderClient.RegisterSchema(
+		context.Background(),
+		&api.RegisterSchemaRequest{
+			Topic:      "orders",
+			Definition: []byte(`{"type": "object", "required": ["id"]}`),
+		},
+	)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		res, err := followerClient.GetSchema(
+			context.Background(),
+			&api.GetSchemaRequest{Topic: "orders"},
+		)
+		return err == nil && res.Schema.Id == registered.Schema.Id
+	}, 3*time.Second, 50*time.Millisecond)
+	_, err = leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{Value: []byte(`{"item": "book"}`)},
+			Topic:  "orders",
+		},
+	)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	produceResponse, err = leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{Value: []byte(`{"id": 1}`)},
+			Topic:  "orders",
+		},
+	)
+	require.NoError(t, err)
+	consumeResponse, err = leaderClient.Consume(
+		context.Background(),
+		&api.ConsumeRequest{Topic: "orders", Offset: produceResponse.Offset},
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		fmt.Sprint(registered.Schema.Id),
+		consumeResponse.Record.Headers[log.SchemaIDHeader],
+	)
 }
 
 func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClient {
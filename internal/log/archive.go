@@ -0,0 +1,367 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"go.uber.org/zap"
+)
+
+// SegmentArchive is a blob store closed segments are offloaded to so they
+// don't have to stay on local disk. Blobs are named after the segment files
+// they hold, like "16.store", so an implementation backed by an object
+// store can use the names as keys.
+type SegmentArchive interface {
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	List() ([]string, error)
+	Delete(name string) error
+}
+
+// LocalArchive is a SegmentArchive kept in a directory, for example on a
+// larger and slower disk than the log's.
+type LocalArchive struct {
+	Dir string
+}
+
+func NewLocalArchive(dir string) (*LocalArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalArchive{Dir: dir}, nil
+}
+
+func (a *LocalArchive) Put(name string, r io.Reader) error {
+	// write to a hidden temporary file and rename it into place so a
+	// blob is never listed half written
+	f, err := ioutil.TempFile(a.Dir, "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(a.Dir, name))
+}
+
+func (a *LocalArchive) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(a.Dir, name))
+}
+
+func (a *LocalArchive) List() ([]string, error) {
+	files, err := ioutil.ReadDir(a.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		names = append(names, file.Name())
+	}
+	return names, nil
+}
+
+func (a *LocalArchive) Delete(name string) error {
+	err := os.Remove(filepath.Join(a.Dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// archiveExts are the segment files put in an archive. The store goes last,
+// so a segment whose store is listed is complete.
+var archiveExts = []string{".index", ".timeindex", ".store"}
+
+const (
+	// fetchDir is where archived segments are fetched back to be read.
+	fetchDir = ".archive"
+	// maxFetched is how many fetched segments are kept for reading.
+	maxFetched = 4
+)
+
+// archivedSegment is a segment that's only in the archive.
+type archivedSegment struct {
+	baseOffset, nextOffset uint64
+}
+
+// setupArchive lists the segments in the archive that are older than the
+// local ones. A segment both in the archive and on disk is read locally.
+func (l *Log) setupArchive() error {
+	l.archived = nil
+	l.fetched = nil
+	if err := os.RemoveAll(filepath.Join(l.Dir, fetchDir)); err != nil {
+		return err
+	}
+	archive := l.Config.Tiering.Archive
+	if archive == nil {
+		return nil
+	}
+	names, err := archive.List()
+	if err != nil {
+		return err
+	}
+	local := make(map[uint64]*segment)
+	for _, s := range l.segments {
+		local[s.baseOffset] = s
+	}
+	var baseOffsets []uint64
+	for _, name := range names {
+		if path.Ext(name) != ".store" {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(name, ".store"), 10, 0)
+		if err != nil {
+			continue
+		}
+		if s, ok := local[off]; ok {
+			s.uploaded = true
+			continue
+		}
+		if len(l.segments) == 0 || off < l.segments[0].baseOffset {
+			baseOffsets = append(baseOffsets, off)
+		}
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	for i, off := range baseOffsets {
+		a := archivedSegment{baseOffset: off}
+		if i+1 < len(baseOffsets) {
+			a.nextOffset = baseOffsets[i+1]
+		} else if len(l.segments) > 0 {
+			a.nextOffset = l.segments[0].baseOffset
+		}
+		l.archived = append(l.archived, a)
+	}
+	if n := len(l.archived); n > 0 && len(l.segments) == 0 {
+		// only the last archived segment knows where the log ends
+		s, err := l.fetch(l.archived[n-1])
+		if err != nil {
+			return err
+		}
+		l.archived[n-1].nextOffset = s.nextOffset
+		l.fetched = append(l.fetched, s)
+	}
+	return nil
+}
+
+// Offload puts the closed segments that aren't archived yet in the archive
+// and removes the local copies of those outside the hot retention. The
+// segments are uploaded without the lock, pinned so retention and
+// compaction don't close them meanwhile, and the lock is only taken again
+// to swap the evicted ones out.
+func (l *Log) Offload() error {
+	archive := l.Config.Tiering.Archive
+	if archive == nil {
+		return nil
+	}
+	lowest, evict := l.RetentionOffset(l.Config.Tiering.HotRetention, time.Now())
+	l.mu.Lock()
+	var pending []*segment
+	for _, s := range l.segments {
+		if s != l.activeSegment && !s.uploaded {
+			s.readers++
+			pending = append(pending, s)
+		}
+	}
+	l.mu.Unlock()
+	var uploaded int
+	var err error
+	for _, s := range pending {
+		if err = l.upload(s); err != nil {
+			break
+		}
+		uploaded++
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, s := range pending {
+		if i < uploaded {
+			s.uploaded = true
+		}
+		if uerr := s.unpin(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	if err != nil || !evict {
+		return err
+	}
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+	for len(l.segments) > 0 {
+		// only the oldest segments are evicted, the archived ones have
+		// to stay older than those on local disk
+		s := l.segments[0]
+		if s == l.activeSegment || !s.uploaded || s.nextOffset > lowest+1 {
+			break
+		}
+		l.archived = append(l.archived, archivedSegment{
+			baseOffset: s.baseOffset,
+			nextOffset: s.nextOffset,
+		})
+		l.segments = l.segments[1:]
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.logger.Info(
+			"offloaded segment",
+			zap.String("dir", l.Dir),
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Uint64("next_offset", s.nextOffset),
+		)
+	}
+	return nil
+}
+
+func (l *Log) upload(s *segment) error {
+	readers := []io.Reader{
+		// the indexes are mapped shared, so reading their files sees
+		// the entries written through the mapping
+		io.NewSectionReader(s.index.file, 0, int64(s.index.size)),
+		io.NewSectionReader(s.timeIndex.file, 0, int64(s.timeIndex.size)),
+		io.NewSectionReader(s.store, 0, int64(s.store.size)),
+	}
+	for i, ext := range archiveExts {
+		name := fmt.Sprintf("%d%s", s.baseOffset, ext)
+		if err := l.Config.Tiering.Archive.Put(name, readers[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetch copies an archived segment to the fetch directory and opens it.
+func (l *Log) fetch(a archivedSegment) (*segment, error) {
+	dir := filepath.Join(l.Dir, fetchDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, ext := range archiveExts {
+		name := fmt.Sprintf("%d%s", a.baseOffset, ext)
+		if err := l.fetchFile(name, filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	s, err := newSegment(dir, a.baseOffset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.recover(); err != nil {
+		return nil, err
+	}
+	// compaction may have removed the records at the end of the segment
+	if s.nextOffset < a.nextOffset {
+		s.nextOffset = a.nextOffset
+	}
+	return s, nil
+}
+
+func (l *Log) fetchFile(name, dst string) error {
+	r, err := l.Config.Tiering.Archive.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readArchived reads off from the archived segment holding it, fetching
+// the segment if it isn't already. It's called without the log's lock,
+// fetchMu guards the archived segments.
+func (l *Log) readArchived(off uint64) (*api.Record, error) {
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+	i := sort.Search(len(l.archived), func(i int) bool {
+		return off < l.archived[i].nextOffset
+	})
+	if i == len(l.archived) || off < l.archived[i].baseOffset {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	var s *segment
+	for _, f := range l.fetched {
+		if f.baseOffset == l.archived[i].baseOffset {
+			s = f
+			break
+		}
+	}
+	if s == nil {
+		var err error
+		if s, err = l.fetch(l.archived[i]); err != nil {
+			return nil, err
+		}
+		if len(l.fetched) == maxFetched {
+			if err = l.fetched[0].Remove(); err != nil {
+				return nil, err
+			}
+			l.fetched = l.fetched[1:]
+		}
+		l.fetched = append(l.fetched, s)
+	}
+	return s.Read(off)
+}
+
+// truncateArchived deletes the archived segments with no offsets after
+// lowest.
+func (l *Log) truncateArchived(lowest uint64) error {
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+	for len(l.archived) > 0 && l.archived[0].nextOffset <= lowest+1 {
+		a := l.archived[0]
+		// the store goes first so a partly deleted segment isn't listed
+		for i := len(archiveExts) - 1; i >= 0; i-- {
+			name := fmt.Sprintf("%d%s", a.baseOffset, archiveExts[i])
+			if err := l.Config.Tiering.Archive.Delete(name); err != nil {
+				return err
+			}
+		}
+		var fetched []*segment
+		for _, s := range l.fetched {
+			if s.baseOffset != a.baseOffset {
+				fetched = append(fetched, s)
+				continue
+			}
+			if err := s.Remove(); err != nil {
+				return err
+			}
+		}
+		l.fetched = fetched
+		l.archived = l.archived[1:]
+		l.logger.Info(
+			"removed archived segment",
+			zap.String("dir", l.Dir),
+			zap.Uint64("base_offset", a.baseOffset),
+			zap.Uint64("next_offset", a.nextOffset),
+		)
+	}
+	return nil
+}
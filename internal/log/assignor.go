@@ -0,0 +1,188 @@
+package log
+
+import (
+	"sort"
+
+	api "github.com/halladj/dis-log/api/v1"
+)
+
+// Assignor divides the partitions of the topics a consumer group's
+// members consume among them, each partition going to at most one member.
+// Every server runs it as it applies the group's rebalances, so it has to
+// reach the same assignment from the same input. The members come sorted
+// by ID with their previous assignments, and partitions is the partition
+// count of every topic they consume that exists. A partition is the unit
+// of assignment: an unpartitioned topic, the default topic among them,
+// counts as a single partition and goes whole to one member, the others
+// consuming it getting none of it. Spreading a topic over more members
+// takes more partitions.
+type Assignor interface {
+	Assign(
+		members []*api.GroupMember,
+		partitions map[string]uint32,
+	) map[string][]*api.TopicPartition
+}
+
+const defaultStrategy = "range"
+
+var defaultAssignors = map[string]Assignor{
+	"range":      RangeAssignor{},
+	"roundrobin": RoundRobinAssignor{},
+	"sticky":     StickyAssignor{},
+}
+
+// RangeAssignor gives each member of a topic's consumers a contiguous
+// range of its partitions, the first members one more when they don't
+// divide evenly.
+type RangeAssignor struct{}
+
+func (RangeAssignor) Assign(
+	members []*api.GroupMember,
+	partitions map[string]uint32,
+) map[string][]*api.TopicPartition {
+	assignment := make(map[string][]*api.TopicPartition)
+	for _, topic := range sortedTopics(partitions) {
+		consumers := consumersOf(members, topic)
+		if len(consumers) == 0 {
+			continue
+		}
+		n := partitions[topic]
+		per, extra := n/uint32(len(consumers)), n%uint32(len(consumers))
+		var next uint32
+		for i, id := range consumers {
+			count := per
+			if uint32(i) < extra {
+				count++
+			}
+			for p := next; p < next+count; p++ {
+				assignment[id] = append(assignment[id], &api.TopicPartition{
+					Topic:     topic,
+					Partition: p,
+				})
+			}
+			next += count
+		}
+	}
+	return assignment
+}
+
+// RoundRobinAssignor deals every topic's partitions out to the members in
+// turn, skipping those that don't consume the topic.
+type RoundRobinAssignor struct{}
+
+func (RoundRobinAssignor) Assign(
+	members []*api.GroupMember,
+	partitions map[string]uint32,
+) map[string][]*api.TopicPartition {
+	assignment := make(map[string][]*api.TopicPartition)
+	next := 0
+	for _, tp := range allPartitions(partitions) {
+		for i := 0; i < len(members); i++ {
+			m := members[(next+i)%len(members)]
+			if !consumes(m, tp.Topic) {
+				continue
+			}
+			assignment[m.Id] = append(assignment[m.Id], tp)
+			next = (next + i + 1) % len(members)
+			break
+		}
+	}
+	return assignment
+}
+
+// StickyAssignor keeps as much of the previous assignment as it can while
+// evening the members' shares out, so a rebalance moves few partitions and
+// the members keep what they've cached about theirs.
+type StickyAssignor struct{}
+
+func (StickyAssignor) Assign(
+	members []*api.GroupMember,
+	partitions map[string]uint32,
+) map[string][]*api.TopicPartition {
+	assignment := make(map[string][]*api.TopicPartition)
+	all := allPartitions(partitions)
+	if len(members) == 0 || len(all) == 0 {
+		return assignment
+	}
+	// no member keeps more than its even share
+	share := (len(all) + len(members) - 1) / len(members)
+	taken := make(map[topicPartition]bool)
+	for _, m := range members {
+		for _, tp := range m.Assignment {
+			key := topicPartition{tp.Topic, tp.Partition}
+			if len(assignment[m.Id]) == share || taken[key] ||
+				!consumes(m, tp.Topic) || tp.Partition >= partitions[tp.Topic] {
+				continue
+			}
+			taken[key] = true
+			assignment[m.Id] = append(assignment[m.Id], &api.TopicPartition{
+				Topic:     tp.Topic,
+				Partition: tp.Partition,
+			})
+		}
+	}
+	// the rest go to the consumers with the fewest
+	for _, tp := range all {
+		if taken[topicPartition{tp.Topic, tp.Partition}] {
+			continue
+		}
+		var least *api.GroupMember
+		for _, m := range members {
+			if !consumes(m, tp.Topic) {
+				continue
+			}
+			if least == nil || len(assignment[m.Id]) < len(assignment[least.Id]) {
+				least = m
+			}
+		}
+		if least != nil {
+			assignment[least.Id] = append(assignment[least.Id], tp)
+		}
+	}
+	return assignment
+}
+
+type topicPartition struct {
+	topic     string
+	partition uint32
+}
+
+func sortedTopics(partitions map[string]uint32) []string {
+	topics := make([]string, 0, len(partitions))
+	for topic := range partitions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// allPartitions returns every topic's partitions, by topic and partition.
+func allPartitions(partitions map[string]uint32) []*api.TopicPartition {
+	var all []*api.TopicPartition
+	for _, topic := range sortedTopics(partitions) {
+		for p := uint32(0); p < partitions[topic]; p++ {
+			all = append(all, &api.TopicPartition{Topic: topic, Partition: p})
+		}
+	}
+	return all
+}
+
+// consumersOf returns the IDs of the members consuming the topic.
+func consumersOf(members []*api.GroupMember, topic string) []string {
+	var ids []string
+	for _, m := range members {
+		if consumes(m, topic) {
+			ids = append(ids, m.Id)
+		}
+	}
+	return ids
+}
+
+func consumes(m *api.GroupMember, topic string) bool {
+	for _, t := range m.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression applied to record batches in the store.
+type Codec uint8
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecSnappy
+	CodecZstd
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+func (c Codec) compress(p []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecSnappy:
+		return snappy.Encode(nil, p), nil
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(p, nil), nil
+	}
+	return nil, fmt.Errorf("log: unknown codec: %s", c)
+}
+
+func (c Codec) decompress(p []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case CodecSnappy:
+		return snappy.Decode(nil, p)
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(p, nil)
+	}
+	return nil, fmt.Errorf("log: unknown codec: %s", c)
+}
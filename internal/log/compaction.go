@@ -0,0 +1,218 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"go.uber.org/zap"
+)
+
+// compactDir is where a segment is rewritten before it replaces the original.
+const compactDir = ".compact"
+
+// Compact rewrites the log's closed segments to keep only the newest record
+// for each key and drops tombstones older than the tombstone retention.
+// Offsets are preserved: reading an offset that was removed returns
+// api.ErrOffsetCompacted. The segments are read and rewritten under the
+// read lock, one at a time, so appends and reads carry on between them;
+// the write lock is only taken to swap a rewritten segment in.
+func (l *Log) Compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	l.mu.RLock()
+	segments := append([]*segment(nil), l.segments...)
+	l.mu.RUnlock()
+	// records appended after a segment is read only make the map stale
+	// towards keeping records, never towards dropping the newest one
+	latest := make(map[string]uint64)
+	for _, s := range segments {
+		if err := l.readKeys(s, latest); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for _, s := range segments[:len(segments)-1] {
+		if err := l.compactSegment(s, latest, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readKeys records the offset of the newest record for each key in the
+// segment, skipping it if it was removed since the log's segments were
+// listed.
+func (l *Log) readKeys(s *segment, latest map[string]uint64) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if s.closed {
+		return nil
+	}
+	for off := s.baseOffset; off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		switch err.(type) {
+		case api.ErrOffsetCompacted, api.ErrCorruptRecord:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(record.Key) != 0 {
+			latest[string(record.Key)] = off
+		}
+	}
+	return nil
+}
+
+// compactSegment rewrites the closed segment in the compaction directory
+// under the read lock, then takes the write lock to swap the rewrite in.
+func (l *Log) compactSegment(
+	s *segment,
+	latest map[string]uint64,
+	now time.Time,
+) error {
+	dir := filepath.Join(l.Dir, compactDir)
+	removed, err := l.rewriteSegment(s, dir, latest, now)
+	if err != nil || removed == 0 {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := -1
+	for j, seg := range l.segments {
+		if seg == s {
+			i = j
+		}
+	}
+	if i == -1 || s == l.activeSegment {
+		// retention or a truncation removed the segment meanwhile
+		return os.RemoveAll(dir)
+	}
+	if err = s.Close(); err != nil {
+		return err
+	}
+	// a crash between renames leaves the store and indexes disagreeing,
+	// which recovery repairs from the store when the log is reopened
+	for _, ext := range []string{".store", ".index", ".timeindex"} {
+		name := fmt.Sprintf("%d%s", s.baseOffset, ext)
+		if err = os.Rename(
+			filepath.Join(dir, name),
+			filepath.Join(l.Dir, name),
+		); err != nil {
+			return err
+		}
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if l.Config.Durability.Sync != SyncOS {
+		if err = syncDir(l.Dir); err != nil {
+			return err
+		}
+	}
+	n, err := newSegment(l.Dir, s.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	n.nextOffset = s.nextOffset
+	l.segments[i] = n
+	l.logger.Info(
+		"compacted segment",
+		zap.String("dir", l.Dir),
+		zap.Uint64("base_offset", s.baseOffset),
+		zap.Int("removed", removed),
+	)
+	return nil
+}
+
+// rewriteSegment writes the records of the segment compaction keeps to a
+// new segment in dir and returns how many it removed. Nothing is written
+// when it removes none, or when the segment is gone or damaged.
+func (l *Log) rewriteSegment(
+	s *segment,
+	dir string,
+	latest map[string]uint64,
+	now time.Time,
+) (int, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if s.closed || s == l.activeSegment {
+		return 0, nil
+	}
+	var keep []*api.Record
+	var removed int
+	for off := s.baseOffset; off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetCompacted:
+			continue
+		case api.ErrCorruptRecord:
+			// leave the segment as it is rather than lose track of
+			// the damaged record
+			return 0, nil
+		default:
+			return 0, err
+		}
+		if l.retainRecord(record, latest, now) {
+			keep = append(keep, record)
+		} else {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	c, err := newSegment(dir, s.baseOffset, l.Config)
+	if err != nil {
+		return 0, err
+	}
+	for _, record := range keep {
+		c.nextOffset = record.Offset
+		if _, err = c.Append(record); err != nil {
+			c.Close()
+			return 0, err
+		}
+	}
+	if l.Config.Durability.Sync != SyncOS {
+		// the rewrite replaces records that are already durable, so it
+		// has to be on disk before the renames
+		if err = c.Sync(); err != nil {
+			c.Close()
+			return 0, err
+		}
+	}
+	if err = c.Close(); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// retainRecord reports whether compaction keeps the record.
+func (l *Log) retainRecord(
+	record *api.Record,
+	latest map[string]uint64,
+	now time.Time,
+) bool {
+	if len(record.Key) == 0 {
+		return true
+	}
+	if latest[string(record.Key)] != record.Offset {
+		return false
+	}
+	if len(record.Value) == 0 {
+		return now.Sub(time.Unix(0, record.AppendTime)) <=
+			l.Config.Compaction.TombstoneRetention
+	}
+	return true
+}
@@ -1,6 +1,8 @@
 package log
 
 import (
+	"time"
+
 	"github.com/hashicorp/raft"
 )
 
@@ -14,5 +16,127 @@ type Config struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// IndexIntervalBytes makes the index sparse, with an entry for
+		// the first frame after every IndexIntervalBytes of store
+		// rather than one per record, so a segment's record count isn't
+		// capped by MaxIndexBytes. Reads scan forward from the nearest
+		// entry. Zero indexes every record. Dense indexes open in
+		// sparse mode as they are; a sparse index opened in dense mode
+		// is rebuilt, which needs MaxIndexBytes to fit every record.
+		IndexIntervalBytes uint64
+		// Compression is the codec for record batches written to the
+		// store. Segments written with another codec stay readable.
+		Compression Codec
+		// Repair has opening the log drop a damaged store from the
+		// first frame it can't walk past on. Without it only a torn
+		// last frame is dropped and a log with damage anywhere else
+		// fails to open, leaving it to be repaired with dis-log-tool.
+		Repair bool
 	}
+	Retention  Retention
+	Compaction Compaction
+	Durability Durability
+	Tiering    Tiering
+	Encryption Encryption
+	Producers  Producers
+	Groups     Groups
+}
+
+// Groups configures the consumer groups a DistributedLog coordinates.
+type Groups struct {
+	// Assignors are assignment strategies to add to range, roundrobin
+	// and sticky, by name. Every server applies the groups' rebalances,
+	// so they all need the same ones.
+	Assignors map[string]Assignor
+	// CheckInterval is how often the leader checks for members whose
+	// sessions have timed out, a second if unset
+	CheckInterval time.Duration
+}
+
+// Producers configures the deduplication and transaction state a
+// DistributedLog keeps for idempotent producers.
+type Producers struct {
+	// Expiry is how long a producer's state is kept after its last
+	// request, seven days if unset. It's measured against the append
+	// times of the records the log applies, so every server expires a
+	// producer at the same point in the log. An expired producer has to
+	// be initialized again.
+	Expiry time.Duration
+	// TxnTimeout is how long a transaction can stay open before it's
+	// aborted, a minute if unset. It's measured like Expiry, so a
+	// transaction only times out as the log is appended to.
+	TxnTimeout time.Duration
+}
+
+// Encryption seals the store frames of new segments with AES-GCM under the
+// Keys' current key. Segments created before it was enabled, or under an
+// older key, stay readable. A DistributedLog seals its raft snapshots with
+// the current key too, and sends them to other servers unsealed, so each
+// server can have keys of its own.
+type Encryption struct {
+	Keys KeyProvider
+}
+
+// Tiering offloads closed segments to an archive. Every closed segment is
+// put in the archive, and the local copies of those outside HotRetention
+// are removed and fetched back when read. Retention only weighs the
+// segments on local disk; an archived segment is deleted when the log is
+// truncated past it. A DistributedLog refuses it, since raft snapshots only
+// carry the segments on local disk.
+type Tiering struct {
+	Archive SegmentArchive
+	// HotRetention bounds the closed segments kept on local disk. Its
+	// CheckInterval is how often segments are offloaded, a minute if
+	// unset.
+	HotRetention Retention
+}
+
+// SyncPolicy decides when appended records are flushed to stable storage.
+type SyncPolicy uint8
+
+const (
+	// SyncOS leaves flushing to the operating system, so a power loss
+	// can drop acknowledged records.
+	SyncOS SyncPolicy = iota
+	// SyncEveryAppend syncs the store and indexes before an append
+	// returns.
+	SyncEveryAppend
+	// SyncInterval syncs on a timer, committing every append made since
+	// the last sync as a group.
+	SyncInterval
+)
+
+// Durability applies to every segment file, the store and both indexes.
+// A DistributedLog applies it to its raft log too, so under
+// SyncEveryAppend a record is on disk on a quorum before it's committed.
+type Durability struct {
+	Sync SyncPolicy
+	// Interval is how often SyncInterval syncs, 100ms if unset.
+	Interval time.Duration
+}
+
+// Retention bounds how much of the log is kept. Only whole closed segments
+// are ever removed, so the log can hold more than the limits allow by up to
+// a segment. A zero limit is not enforced.
+type Retention struct {
+	MaxBytes   uint64
+	MaxAge     time.Duration
+	MaxRecords uint64
+	// CheckInterval is how often the limits are checked, a minute if unset.
+	CheckInterval time.Duration
+}
+
+func (r Retention) enabled() bool {
+	return r.MaxBytes != 0 || r.MaxAge != 0 || r.MaxRecords != 0
+}
+
+// Compaction rewrites closed segments to keep only the newest record for
+// each key. Records without a key are always kept.
+type Compaction struct {
+	Enabled bool
+	// TombstoneRetention is how long a tombstone, a keyed record with no
+	// value, is kept so consumers see the delete before the key is gone.
+	TombstoneRetention time.Duration
+	// CheckInterval is how often segments are compacted, a minute if unset.
+	CheckInterval time.Duration
 }
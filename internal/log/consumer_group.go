@@ -0,0 +1,387 @@
+package log
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultSessionTimeout       = 10 * time.Second
+	defaultSessionCheckInterval = time.Second
+)
+
+// consumerGroups is the membership of consumer groups, whose members
+// share the partitions of the topics they consume. Every join, leave and
+// expired session rebalances the group: its generation is bumped and its
+// partitions assigned again, fencing off the members until they join again
+// for their new assignment. Like producers it's part of the replicated
+// state machine, so every server assigns alike and a new leader takes the
+// groups over as they were; the time a member's session is measured by
+// is the leader's, stamped on the requests. The applied entries move the
+// groups' clock on, reaping the expired sessions of every group.
+type consumerGroups struct {
+	mu        sync.RWMutex
+	assignors map[string]Assignor
+	groups    map[string]*api.GroupState
+	// next is a time no session times out before, so the groups needn't
+	// be checked until then
+	next int64
+}
+
+func newConsumerGroups(c Groups) *consumerGroups {
+	assignors := make(map[string]Assignor, len(defaultAssignors)+len(c.Assignors))
+	for name, a := range defaultAssignors {
+		assignors[name] = a
+	}
+	for name, a := range c.Assignors {
+		assignors[name] = a
+	}
+	return &consumerGroups{
+		assignors: assignors,
+		groups:    make(map[string]*api.GroupState),
+		next:      math.MaxInt64,
+	}
+}
+
+// join adds a member to the group, or has a member pick up its assignment
+// again. New members are named after the raft index of their join.
+// partitions returns how many partitions a topic has, 0 if it doesn't
+// exist.
+func (g *consumerGroups) join(
+	req *api.JoinGroupRequest,
+	index uint64,
+	partitions func(topic string) uint32,
+) (*api.JoinGroupResponse, error) {
+	if req.Group == "" {
+		return nil, api.ErrInvalidGroup{Group: req.Group}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	group, ok := g.groups[req.Group]
+	if !ok {
+		group = &api.GroupState{Name: req.Group}
+	}
+	strategy := group.Strategy
+	if live(group, req.Time) == 0 {
+		// the first member picks the strategy
+		strategy = req.Strategy
+		if strategy == "" {
+			strategy = defaultStrategy
+		}
+	} else if req.Strategy != "" && req.Strategy != strategy {
+		return nil, api.ErrInvalidStrategy{
+			Strategy: req.Strategy,
+			Group:    req.Group,
+		}
+	}
+	if _, ok := g.assignors[strategy]; !ok {
+		return nil, api.ErrInvalidStrategy{Strategy: strategy}
+	}
+	group.Strategy = strategy
+	rebalance := expire(group, req.Time)
+	timeout := req.SessionTimeout
+	if timeout == 0 {
+		timeout = int64(defaultSessionTimeout)
+	}
+	member := findMember(group, req.MemberId)
+	switch {
+	case req.MemberId == "":
+		member = &api.GroupMember{Id: fmt.Sprintf("member-%d", index)}
+		group.Members = append(group.Members, member)
+		sort.Slice(group.Members, func(i, j int) bool {
+			return group.Members[i].Id < group.Members[j].Id
+		})
+		rebalance = true
+	case member == nil:
+		if rebalance {
+			g.rebalance(group, partitions)
+		}
+		g.dropEmpty(group)
+		return nil, api.ErrUnknownMember{
+			Group:    req.Group,
+			MemberID: req.MemberId,
+		}
+	case !sameTopics(member.Topics, req.Topics):
+		rebalance = true
+	}
+	member.Topics = req.Topics
+	member.SessionTimeout = timeout
+	member.LastHeartbeat = req.Time
+	if deadline := req.Time + timeout; deadline < g.next {
+		g.next = deadline
+	}
+	g.groups[req.Group] = group
+	if rebalance {
+		g.rebalance(group, partitions)
+	}
+	return &api.JoinGroupResponse{
+		MemberId:   member.Id,
+		Generation: group.Generation,
+		Assignment: member.Assignment,
+	}, nil
+}
+
+// heartbeat keeps the member's session alive. It fails once the group has
+// rebalanced past the member's generation, and the member has to join
+// again.
+func (g *consumerGroups) heartbeat(
+	req *api.HeartbeatRequest,
+	partitions func(topic string) uint32,
+) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	group, ok := g.groups[req.Group]
+	if !ok {
+		return api.ErrUnknownMember{Group: req.Group, MemberID: req.MemberId}
+	}
+	if expire(group, req.Time) {
+		g.rebalance(group, partitions)
+	}
+	member := findMember(group, req.MemberId)
+	if member == nil {
+		g.dropEmpty(group)
+		return api.ErrUnknownMember{Group: req.Group, MemberID: req.MemberId}
+	}
+	member.LastHeartbeat = req.Time
+	if req.Generation != group.Generation {
+		return api.ErrIllegalGeneration{
+			Group:      req.Group,
+			Generation: req.Generation,
+			Current:    group.Generation,
+		}
+	}
+	return nil
+}
+
+// leave removes the member from the group, handing its partitions to the
+// others.
+func (g *consumerGroups) leave(
+	req *api.LeaveGroupRequest,
+	partitions func(topic string) uint32,
+) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	group, ok := g.groups[req.Group]
+	if !ok || findMember(group, req.MemberId) == nil {
+		return api.ErrUnknownMember{Group: req.Group, MemberID: req.MemberId}
+	}
+	members := group.Members[:0]
+	for _, m := range group.Members {
+		if m.Id != req.MemberId {
+			members = append(members, m)
+		}
+	}
+	group.Members = members
+	expire(group, req.Time)
+	g.rebalance(group, partitions)
+	g.dropEmpty(group)
+	return nil
+}
+
+// checkCommit fences off offset commits from members of an older
+// generation, or for partitions they aren't assigned. Commits made
+// outside the group's membership, with no member or generation, are only
+// taken while the group has no members, which would otherwise be fenced
+// off by them.
+func (g *consumerGroups) checkCommit(req *api.CommitOffsetRequest) error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var member *api.GroupMember
+	group, ok := g.groups[req.Group]
+	if req.MemberId == "" && req.Generation == 0 {
+		// groups are dropped once they have no members
+		if ok {
+			return api.ErrUnknownMember{Group: req.Group}
+		}
+		return nil
+	}
+	if ok {
+		member = findMember(group, req.MemberId)
+	}
+	if member == nil {
+		return api.ErrUnknownMember{Group: req.Group, MemberID: req.MemberId}
+	}
+	if req.Generation != group.Generation {
+		return api.ErrIllegalGeneration{
+			Group:      req.Group,
+			Generation: req.Generation,
+			Current:    group.Generation,
+		}
+	}
+	for _, tp := range member.Assignment {
+		if tp.Topic == req.Topic && tp.Partition == req.Partition {
+			return nil
+		}
+	}
+	return api.ErrNotAssigned{
+		Group:     req.Group,
+		MemberID:  req.MemberId,
+		Topic:     req.Topic,
+		Partition: req.Partition,
+	}
+}
+
+// tick moves the groups' clock on to an applied entry's time, dropping
+// the members of every group whose sessions have timed out by now and
+// rebalancing the groups they leave.
+func (g *consumerGroups) tick(now int64, partitions func(topic string) uint32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now <= g.next {
+		return
+	}
+	next := int64(math.MaxInt64)
+	for _, group := range g.groups {
+		if expire(group, now) {
+			g.rebalance(group, partitions)
+			g.dropEmpty(group)
+		}
+		for _, m := range group.Members {
+			if deadline := m.LastHeartbeat + m.SessionTimeout; deadline < next {
+				next = deadline
+			}
+		}
+	}
+	g.next = next
+}
+
+// expiring returns whether any member's session has timed out by now.
+func (g *consumerGroups) expiring(now int64) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, group := range g.groups {
+		if live(group, now) != len(group.Members) {
+			return true
+		}
+	}
+	return false
+}
+
+// topicChanged rebalances the groups consuming a topic that was created
+// or deleted.
+func (g *consumerGroups) topicChanged(
+	topic string,
+	partitions func(topic string) uint32,
+) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, group := range g.groups {
+		for _, m := range group.Members {
+			if consumes(m, topic) {
+				g.rebalance(group, partitions)
+				break
+			}
+		}
+	}
+}
+
+// rebalance starts the group's next generation, assigning its partitions
+// with the group's strategy. g.mu must be held.
+func (g *consumerGroups) rebalance(
+	group *api.GroupState,
+	partitions func(topic string) uint32,
+) {
+	group.Generation++
+	counts := make(map[string]uint32)
+	for _, m := range group.Members {
+		for _, topic := range m.Topics {
+			if n := partitions(topic); n > 0 {
+				counts[topic] = n
+			}
+		}
+	}
+	assignment := g.assignors[group.Strategy].Assign(group.Members, counts)
+	for _, m := range group.Members {
+		m.Assignment = assignment[m.Id]
+	}
+}
+
+// dropEmpty forgets the group once it has no members. g.mu must be held.
+func (g *consumerGroups) dropEmpty(group *api.GroupState) {
+	if len(group.Members) == 0 {
+		delete(g.groups, group.Name)
+	}
+}
+
+// snapshot returns the groups in name order.
+func (g *consumerGroups) snapshot() []*api.GroupState {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	list := make([]*api.GroupState, 0, len(g.groups))
+	for _, group := range g.groups {
+		// groups change in place as entries are applied
+		list = append(list, proto.Clone(group).(*api.GroupState))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (g *consumerGroups) restore(list []*api.GroupState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.groups = make(map[string]*api.GroupState, len(list))
+	g.next = math.MaxInt64
+	for _, group := range list {
+		g.groups[group.Name] = group
+		for _, m := range group.Members {
+			if deadline := m.LastHeartbeat + m.SessionTimeout; deadline < g.next {
+				g.next = deadline
+			}
+		}
+	}
+}
+
+// live returns how many of the group's members' sessions haven't timed out
+// by now.
+func live(group *api.GroupState, now int64) int {
+	var n int
+	for _, m := range group.Members {
+		if now-m.LastHeartbeat <= m.SessionTimeout {
+			n++
+		}
+	}
+	return n
+}
+
+// expire drops the members whose sessions have timed out by now and
+// returns whether any were.
+func expire(group *api.GroupState, now int64) bool {
+	members := group.Members[:0]
+	for _, m := range group.Members {
+		if now-m.LastHeartbeat <= m.SessionTimeout {
+			members = append(members, m)
+		}
+	}
+	expired := len(members) != len(group.Members)
+	group.Members = members
+	return expired
+}
+
+func findMember(group *api.GroupState, id string) *api.GroupMember {
+	for _, m := range group.Members {
+		if m.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func sameTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
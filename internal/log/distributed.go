@@ -1,35 +1,63 @@
 package log
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
 
 	api "github.com/halladj/dis-log/api/v1"
 )
 
 type DistributedLog struct {
-	config Config
-	log    *Log
-	raft   *raft.Raft
+	config  Config
+	log     *Log
+	raftLog *logStore
+	raft    *raft.Raft
+	// topics and producers are the state machine's topics and producer
+	// state, read to serve the topics and read_committed consumers
+	topics    *topics
+	producers *producers
+	// offsets are the consumer groups' committed offsets
+	offsets *offsets
+	groups  *consumerGroups
+	schemas *schemas
+	// topic is the default topic
+	topic *Topic
+	// mux shares the stream layer with the partitions' raft groups
+	mux    *raftMux
+	reaper *reaper
+	// sessions runs the leader's checks for timed out group sessions
+	sessions *reaper
+	logger   *zap.Logger
 }
 
 func NewDistributedLog(dataDir string, config Config) (
 	*DistributedLog,
 	error,
 ) {
+	if config.Tiering.Archive != nil {
+		// snapshots only carry the segments on local disk, a node
+		// restored from one would be missing the archived records
+		return nil, fmt.Errorf("log: the distributed log doesn't support tiering")
+	}
 	l := &DistributedLog{
 		config: config,
+		logger: zap.L().Named("distributed-log"),
+		mux:    newRaftMux(config.Raft.StreamLayer),
 	}
 	if err := l.setupLog(dataDir); err != nil {
 		return nil, err
@@ -37,6 +65,14 @@ func NewDistributedLog(dataDir string, config Config) (
 	if err := l.setupRaft(dataDir); err != nil {
 		return nil, err
 	}
+	l.topic = &Topic{
+		dl:        l,
+		raft:      l.raft,
+		producers: l.producers,
+		log:       l.log,
+	}
+	l.setupRetention()
+	l.setupSessions()
 	return l, nil
 }
 
@@ -45,67 +81,235 @@ func (l *DistributedLog) setupLog(dataDir string) error {
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return err
 	}
+	// retention is decided by the leader and replicated through raft, so
+	// the local log must not remove segments on its own
+	logConfig := l.config
+	logConfig.Retention = Retention{}
 	var err error
-	l.log, err = NewLog(logDir, l.config)
-	return err
+	if l.log, err = NewLog(logDir, logConfig); err != nil {
+		return err
+	}
+	l.topics = newTopics(filepath.Join(dataDir, "topics"), l.config, l.log)
+	l.topics.partitions = &partitions{
+		dir:    filepath.Join(dataDir, "partitions"),
+		config: l.config,
+		mux:    l.mux,
+	}
+	return nil
+}
+
+// setupRetention runs the leaders' retention checks, the topic
+// registry's and the partitions'. They run whether or not the server's
+// config has retention, a topic can be created with it. The partitions
+// the server leads take in the servers that joined the registry then too.
+func (l *DistributedLog) setupRetention() {
+	l.reaper = newReaper(l.config.Retention.CheckInterval, func() {
+		if err := retain(l.raft, l.topics); err != nil {
+			l.logger.Error(
+				"failed to enforce retention",
+				zap.Error(err),
+			)
+		}
+		err := l.topics.eachPartition(func(topic string, p *partition) error {
+			return retain(p.raft, p.topics)
+		})
+		if err != nil {
+			l.logger.Error(
+				"failed to enforce partition retention",
+				zap.Error(err),
+			)
+		}
+		if err = l.reconcilePartitions(); err != nil {
+			l.logger.Error(
+				"failed to reconcile partition servers",
+				zap.Error(err),
+			)
+		}
+	})
+}
+
+// retain enforces the retention of the topics replicated by the raft
+// group, if this server leads it.
+func retain(r *raft.Raft, t *topics) error {
+	if r.State() != raft.Leader {
+		return nil
+	}
+	now := time.Now()
+	for name, policy := range t.retention() {
+		if !policy.enabled() {
+			continue
+		}
+		log, err := t.log(name)
+		if err != nil {
+			// deleted since
+			continue
+		}
+		lowest, ok := log.RetentionOffset(policy, now)
+		if !ok {
+			continue
+		}
+		_, err = apply(
+			r,
+			RetentionRequestType,
+			&api.RetentionRequest{Lowest: lowest, Topic: name},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupSessions runs the leader's checks for consumer group members whose
+// sessions have timed out. The groups reap them as the entries they apply
+// move their clock on, so when any have the leader applies an entry with
+// its time, a quiet log's groups being reaped too.
+func (l *DistributedLog) setupSessions() {
+	interval := l.config.Groups.CheckInterval
+	if interval == 0 {
+		interval = defaultSessionCheckInterval
+	}
+	l.sessions = newReaper(interval, func() {
+		if err := l.expireSessions(); err != nil {
+			l.logger.Error(
+				"failed to expire group sessions",
+				zap.Error(err),
+			)
+		}
+	})
+}
+
+func (l *DistributedLog) expireSessions() error {
+	if l.raft.State() != raft.Leader {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	if !l.groups.expiring(now) {
+		return nil
+	}
+	b := make([]byte, 1+8)
+	b[0] = byte(ExpireSessionsRequestType)
+	enc.PutUint64(b[1:], uint64(now))
+	return l.raft.Apply(b, 10*time.Second).Error()
+}
+
+// reconcilePartitions gives the partitions this server leads the topic
+// registry's servers.
+func (l *DistributedLog) reconcilePartitions() error {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	servers := future.Configuration().Servers
+	return l.topics.eachPartition(func(_ string, p *partition) error {
+		return p.reconcile(servers)
+	})
 }
 
 func (l *DistributedLog) setupRaft(dataDir string) error {
-	fsm := &fsm{log: l.log}
+	l.producers = newProducers(l.config.Producers)
+	l.offsets = newOffsets()
+	l.groups = newConsumerGroups(l.config.Groups)
+	l.schemas = newSchemas()
+	fsm := &fsm{
+		topics:    l.topics,
+		producers: l.producers,
+		offsets:   l.offsets,
+		groups:    l.groups,
+		schemas:   l.schemas,
+	}
+	var bootstrap []raft.Server
+	if l.config.Raft.Bootstrap {
+		bootstrap = []raft.Server{{
+			ID:      l.config.Raft.LocalID,
+			Address: raft.ServerAddress(l.config.Raft.StreamLayer.Addr().String()),
+		}}
+	}
+	var err error
+	l.raft, l.raftLog, err = openRaft(
+		dataDir,
+		l.config,
+		l.mux.group(""),
+		fsm,
+		bootstrap,
+	)
+	return err
+}
 
+// openRaft starts a raft group keeping its state in dataDir's raft
+// directory and applying its entries to fsm. A group with no state yet is
+// bootstrapped with the servers, if any.
+func openRaft(
+	dataDir string,
+	c Config,
+	layer raft.StreamLayer,
+	fsm raft.FSM,
+	bootstrap []raft.Server,
+) (*raft.Raft, *logStore, error) {
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
-		return err
+		return nil, nil, err
 	}
-	logConfig := l.config
+	logConfig := c
 	logConfig.Segment.InitialOffset = 1
+	// raft compacts its own log after snapshots
+	logConfig.Retention = Retention{}
+	logConfig.Compaction = Compaction{}
+	logConfig.Tiering = Tiering{}
 	logStore, err := newLogStore(logDir, logConfig)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	stableStore, err := raftboltdb.NewBoltStore(
 		filepath.Join(dataDir, "raft", "stable"),
 	)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	retain := 1
-	snapshotStore, err := raft.NewFileSnapshotStore(
+	fileSnapshots, err := raft.NewFileSnapshotStore(
 		filepath.Join(dataDir, "raft"),
 		retain,
 		os.Stderr,
 	)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	var snapshotStore raft.SnapshotStore = fileSnapshots
+	if c.Encryption.Keys != nil {
+		snapshotStore = &sealedSnapshots{
+			SnapshotStore: fileSnapshots,
+			keys:          c.Encryption.Keys,
+		}
 	}
 
 	maxPool := 5
 	timeout := 10 * time.Second
 	transport := raft.NewNetworkTransport(
-		l.config.Raft.StreamLayer,
+		layer,
 		maxPool,
 		timeout,
 		os.Stderr,
 	)
 
 	config := raft.DefaultConfig()
-	config.LocalID = l.config.Raft.LocalID
-	if l.config.Raft.HeartbeatTimeout != 0 {
-		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	config.LocalID = c.Raft.LocalID
+	if c.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = c.Raft.HeartbeatTimeout
 	}
-	if l.config.Raft.ElectionTimeout != 0 {
-		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	if c.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = c.Raft.ElectionTimeout
 	}
-	if l.config.Raft.LeaderLeaseTimeout != 0 {
-		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	if c.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = c.Raft.LeaderLeaseTimeout
 	}
-	if l.config.Raft.CommitTimeout != 0 {
-		config.CommitTimeout = l.config.Raft.CommitTimeout
+	if c.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = c.Raft.CommitTimeout
 	}
 
-	l.raft, err = raft.NewRaft(
+	r, err := raft.NewRaft(
 		config,
 		fsm,
 		logStore,
@@ -114,7 +318,7 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 		transport,
 	)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	hasState, err := raft.HasExistingState(
 		logStore,
@@ -122,34 +326,175 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 		snapshotStore,
 	)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if l.config.Raft.Bootstrap && !hasState {
-		config := raft.Configuration{
-			Servers: []raft.Server{{
-				ID:      config.LocalID,
-				Address: transport.LocalAddr(),
-			}},
-		}
-		err = l.raft.BootstrapCluster(config).Error()
+	if len(bootstrap) > 0 && !hasState {
+		err = r.BootstrapCluster(raft.Configuration{
+			Servers: bootstrap,
+		}).Error()
 	}
-	return err
+	return r, logStore, err
 }
 
 func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
-	res, err := l.apply(
-		AppendRequestType,
-		&api.ProduceRequest{Record: record},
-	)
+	return l.topic.Append(record)
+}
+
+// AppendIdempotent appends the record to the default topic as the
+// producer's request, see Topic.AppendIdempotent.
+func (l *DistributedLog) AppendIdempotent(
+	producerID, sequence uint64,
+	record *api.Record,
+) (uint64, error) {
+	return l.topic.AppendIdempotent(producerID, sequence, record)
+}
+
+// AppendBatch replicates the records as a single raft entry and returns
+// their offsets.
+func (l *DistributedLog) AppendBatch(records []*api.Record) ([]uint64, error) {
+	return l.topic.AppendBatch(records)
+}
+
+// AppendBatchIdempotent appends the records to the default topic as the
+// producer's request, see Topic.AppendBatchIdempotent.
+func (l *DistributedLog) AppendBatchIdempotent(
+	producerID, sequence uint64,
+	records []*api.Record,
+) ([]uint64, error) {
+	return l.topic.AppendBatchIdempotent(producerID, sequence, records)
+}
+
+// InitProducer registers a new idempotent producer and returns its ID.
+// IDs are the indexes of the raft entries registering them, so they're
+// unique across leaders and never zero.
+func (l *DistributedLog) InitProducer() (uint64, error) {
+	res, err := l.apply(InitProducerRequestType, &api.InitProducerRequest{})
 	if err != nil {
 		return 0, err
 	}
-	return res.(*api.ProduceResponse).Offset, nil
+	return res.(*api.InitProducerResponse).ProducerId, nil
+}
+
+// CreateTopic creates a topic on every server. Its config overrides the
+// servers' for the topic's log. A partitioned topic's partitions start
+// with the topic registry's servers and this server leading them.
+func (l *DistributedLog) CreateTopic(name string, config *api.TopicConfig) error {
+	req := &api.CreateTopicRequest{Name: name, Config: config}
+	if config.GetPartitions() > 0 {
+		future := l.raft.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return err
+		}
+		for _, srv := range future.Configuration().Servers {
+			req.Replicas = append(req.Replicas, &api.Server{
+				Id:       string(srv.ID),
+				RpcAddr:  string(srv.Address),
+				IsLeader: srv.ID == l.config.Raft.LocalID,
+			})
+		}
+	}
+	_, err := l.apply(CreateTopicRequestType, req)
+	return err
+}
+
+// DeleteTopic deletes a topic and its records on every server.
+func (l *DistributedLog) DeleteTopic(name string) error {
+	_, err := l.apply(DeleteTopicRequestType, &api.DeleteTopicRequest{
+		Name: name,
+	})
+	return err
+}
+
+// ListTopics returns the named topics on this server.
+func (l *DistributedLog) ListTopics() ([]*api.Topic, error) {
+	return l.topics.list()
+}
+
+// Topic returns the topic with the name, the default topic for "". A
+// partitioned topic's is its first partition, see Partition.
+func (l *DistributedLog) Topic(name string) (*Topic, error) {
+	return l.Partition(name, 0)
+}
+
+// Partition returns the topic's partition with the id. An unpartitioned
+// topic has the one partition, 0.
+func (l *DistributedLog) Partition(name string, id uint32) (*Topic, error) {
+	tl, p, err := l.topics.partition(name, id)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return &Topic{
+			name:      name,
+			key:       name,
+			dl:        l,
+			raft:      l.raft,
+			producers: l.producers,
+			log:       tl.log,
+		}, nil
+	}
+	return &Topic{
+		name:        name,
+		partition:   id,
+		partitioned: true,
+		dl:          l,
+		raft:        p.raft,
+		producers:   p.producers,
+		log:         p.log,
+	}, nil
+}
+
+// PartitionFor returns the partition of the topic records with the keys
+// are appended to, picked by the topic's partitioner of the kind. The
+// explicit partitioner picks partition. Unpartitioned topics, the default
+// topic among them, only have partition 0. A batch's records go to one
+// partition, so keys that map to different ones are an error.
+func (l *DistributedLog) PartitionFor(
+	name string,
+	kind api.Partitioner,
+	partition uint32,
+	keys ...[]byte,
+) (uint32, error) {
+	return l.topics.partitionFor(name, kind, partition, keys...)
+}
+
+// RotateKey moves the topics' logs and the raft logs to the key
+// provider's current key. Keys are local to each node, so it isn't
+// replicated.
+func (l *DistributedLog) RotateKey() error {
+	err := l.topics.each(func(_ string, tl *topicLog) error {
+		if tl.partitions == nil {
+			return tl.log.RotateKey()
+		}
+		for _, p := range tl.partitions {
+			if err := p.log.RotateKey(); err != nil {
+				return err
+			}
+			if err := p.raftLog.RotateKey(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return l.raftLog.RotateKey()
 }
 
 func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	interface{},
 	error,
+) {
+	return apply(l.raft, reqType, req)
+}
+
+// apply replicates the request through the raft group and returns its
+// state machine's response. On a server that doesn't lead the group it
+// fails with ErrNotLeader, naming the leader the request can be sent to.
+func apply(r *raft.Raft, reqType RequestType, req proto.Message) (
+	interface{},
+	error,
 ) {
 	var buf bytes.Buffer
 	_, err := buf.Write([]byte{byte(reqType)})
@@ -165,9 +510,11 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 		return nil, err
 	}
 	timeout := 10 * time.Second
-	future := l.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	future := r.Apply(buf.Bytes(), timeout)
+	if err := future.Error(); err == raft.ErrNotLeader {
+		return nil, api.ErrNotLeader{Leader: string(r.Leader())}
+	} else if err != nil {
+		return nil, err
 	}
 	res := future.Response()
 	if err, ok := res.(error); ok {
@@ -176,8 +523,217 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	return res, nil
 }
 
+// BeginTxn opens a transaction for the producer. The records it appends
+// until it commits or aborts are withheld from read_committed consumers
+// until it commits, and skipped by them if it aborts.
+func (l *DistributedLog) BeginTxn(producerID uint64) error {
+	_, err := l.apply(BeginTxnRequestType, &api.TxnRequest{
+		ProducerId: producerID,
+		Time:       time.Now().UnixNano(),
+	})
+	return err
+}
+
+// CommitTxn commits the producer's transaction and returns the offsets
+// of its commit control records, one in each topic it wrote to.
+func (l *DistributedLog) CommitTxn(producerID uint64) (map[string]uint64, error) {
+	res, err := l.apply(CommitTxnRequestType, &api.TxnRequest{
+		ProducerId: producerID,
+		Time:       time.Now().UnixNano(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.CommitTxnResponse).Offsets, nil
+}
+
+// AbortTxn aborts the producer's transaction and returns the offsets of
+// its abort control records, one in each topic it wrote to.
+func (l *DistributedLog) AbortTxn(producerID uint64) (map[string]uint64, error) {
+	res, err := l.apply(AbortTxnRequestType, &api.TxnRequest{
+		ProducerId: producerID,
+		Time:       time.Now().UnixNano(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.AbortTxnResponse).Offsets, nil
+}
+
+// CommitOffset commits the group's offset in the topic's partition, the
+// offset the group reads from next.
+func (l *DistributedLog) CommitOffset(
+	group, topic string,
+	partition uint32,
+	offset uint64,
+) error {
+	_, err := l.apply(CommitOffsetRequestType, &api.CommitOffsetRequest{
+		Group:     group,
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+		Time:      time.Now().UnixNano(),
+	})
+	return err
+}
+
+// CommitMemberOffset commits the offset as a member of the group, which
+// fails if the group has rebalanced since the member's generation or the
+// partition isn't the member's.
+func (l *DistributedLog) CommitMemberOffset(
+	group, memberID string,
+	generation uint64,
+	topic string,
+	partition uint32,
+	offset uint64,
+) error {
+	_, err := l.apply(CommitOffsetRequestType, &api.CommitOffsetRequest{
+		Group:      group,
+		Topic:      topic,
+		Partition:  partition,
+		Offset:     offset,
+		Time:       time.Now().UnixNano(),
+		MemberId:   memberID,
+		Generation: generation,
+	})
+	return err
+}
+
+// JoinGroup adds a member consuming the topics to the group, with an
+// empty member ID, or has a member join again for its assignment after
+// the group rebalanced. The member has to heartbeat within the session
+// timeout to stay in the group.
+func (l *DistributedLog) JoinGroup(
+	group, memberID string,
+	topics []string,
+	sessionTimeout time.Duration,
+	strategy string,
+) (*api.JoinGroupResponse, error) {
+	res, err := l.apply(JoinGroupRequestType, &api.JoinGroupRequest{
+		Group:          group,
+		MemberId:       memberID,
+		Topics:         topics,
+		SessionTimeout: int64(sessionTimeout),
+		Strategy:       strategy,
+		Time:           time.Now().UnixNano(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.JoinGroupResponse), nil
+}
+
+// Heartbeat keeps the member's session alive. It fails with
+// api.ErrIllegalGeneration once the group has rebalanced, and the member
+// has to join again.
+func (l *DistributedLog) Heartbeat(
+	group, memberID string,
+	generation uint64,
+) error {
+	_, err := l.apply(HeartbeatRequestType, &api.HeartbeatRequest{
+		Group:      group,
+		MemberId:   memberID,
+		Generation: generation,
+		Time:       time.Now().UnixNano(),
+	})
+	return err
+}
+
+// LeaveGroup removes the member from the group, rebalancing its
+// partitions onto the others.
+func (l *DistributedLog) LeaveGroup(group, memberID string) error {
+	_, err := l.apply(LeaveGroupRequestType, &api.LeaveGroupRequest{
+		Group:    group,
+		MemberId: memberID,
+		Time:     time.Now().UnixNano(),
+	})
+	return err
+}
+
+// RegisterSchema adds the next version of the topic's schema, checked for
+// the compatibility with the latest version. Registering a definition the
+// topic has a version of already returns that version.
+func (l *DistributedLog) RegisterSchema(
+	topic string,
+	kind api.SchemaType,
+	definition []byte,
+	messageName string,
+	compatibility api.Compatibility,
+) (*api.Schema, error) {
+	res, err := l.apply(RegisterSchemaRequestType, &api.RegisterSchemaRequest{
+		Topic:         topic,
+		Type:          kind,
+		Definition:    definition,
+		MessageName:   messageName,
+		Compatibility: compatibility,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.RegisterSchemaResponse).Schema, nil
+}
+
+// Schema returns the schema with the ID, as this server has applied it.
+func (l *DistributedLog) Schema(id uint64) (*api.Schema, error) {
+	return l.schemas.get(id)
+}
+
+// SchemaVersion returns the version of the topic's schema, the latest for
+// 0, as this server has applied it.
+func (l *DistributedLog) SchemaVersion(
+	topic string,
+	version uint32,
+) (*api.Schema, error) {
+	return l.schemas.version(topic, version)
+}
+
+// ValidateRecord checks the record produced to the topic against the
+// topic's schema, if it has one, and sets the record's SchemaIDHeader to
+// the ID of the schema it matched.
+func (l *DistributedLog) ValidateRecord(topic string, record *api.Record) error {
+	return l.schemas.validate(topic, record)
+}
+
+// FetchOffset returns the group's committed offset in the topic's
+// partition, as this server has applied it.
+func (l *DistributedLog) FetchOffset(
+	group, topic string,
+	partition uint32,
+) (uint64, error) {
+	if group == "" {
+		return 0, api.ErrInvalidGroup{Group: group}
+	}
+	return l.offsets.fetch(group, topic, partition)
+}
+
+func (l *DistributedLog) NewIterator(offset uint64) *Iterator {
+	return l.topic.NewIterator(offset)
+}
+
+// NewCommittedIterator returns an iterator reading only the default
+// topic's committed records from offset on.
+func (l *DistributedLog) NewCommittedIterator(offset uint64) *CommittedIterator {
+	return l.topic.NewCommittedIterator(offset)
+}
+
 func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
-	return l.log.Read(offset)
+	return l.topic.Read(offset)
+}
+
+// ReadCommitted reads the default topic's record at offset for a
+// read_committed consumer, see Topic.ReadCommitted.
+func (l *DistributedLog) ReadCommitted(offset uint64) (*api.Record, error) {
+	return l.topic.ReadCommitted(offset)
+}
+
+func (l *DistributedLog) OffsetForTime(t time.Time) (uint64, error) {
+	return l.topic.OffsetForTime(t)
+}
+
+// ReadBarrier readies the default topic's reads for the consistency, see
+// Topic.ReadBarrier.
+func (l *DistributedLog) ReadBarrier(c api.Consistency) error {
+	return l.topic.ReadBarrier(c)
 }
 
 func (l *DistributedLog) Join(id, addr string) error {
@@ -204,12 +760,15 @@ func (l *DistributedLog) Join(id, addr string) error {
 	if err := addFuture.Error(); err != nil {
 		return err
 	}
-	return nil
+	return l.reconcilePartitions()
 }
 
 func (l *DistributedLog) Leave(id string) error {
 	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
-	return removeFuture.Error()
+	if err := removeFuture.Error(); err != nil {
+		return err
+	}
+	return l.reconcilePartitions()
 }
 
 func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
@@ -229,10 +788,19 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 }
 
 func (l *DistributedLog) Close() error {
+	l.reaper.stop()
+	l.sessions.stop()
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
 	}
+	// the raft log holds its directory's lock and buffered entries too
+	if err := l.raftLog.Close(); err != nil {
+		return err
+	}
+	if err := l.topics.close(); err != nil {
+		return err
+	}
 	return l.log.Close()
 }
 
@@ -258,13 +826,35 @@ func (l *DistributedLog) GetServers() ([]*api.Server, error) {
 var _ raft.FSM = (*fsm)(nil)
 
 type fsm struct {
-	log *Log
+	topics    *topics
+	producers *producers
+	// offsets, groups and schemas are nil in partitions' state machines,
+	// the topic registry's keeps those of every topic
+	offsets *offsets
+	groups  *consumerGroups
+	schemas *schemas
 }
 
 type RequestType uint8
 
 const (
-	AppendRequestType RequestType = 0
+	AppendRequestType         RequestType = 0
+	RetentionRequestType      RequestType = 1
+	AppendBatchRequestType    RequestType = 2
+	InitProducerRequestType   RequestType = 3
+	BeginTxnRequestType       RequestType = 4
+	CommitTxnRequestType      RequestType = 5
+	AbortTxnRequestType       RequestType = 6
+	CreateTopicRequestType    RequestType = 7
+	DeleteTopicRequestType    RequestType = 8
+	CommitOffsetRequestType   RequestType = 9
+	JoinGroupRequestType      RequestType = 10
+	HeartbeatRequestType      RequestType = 11
+	LeaveGroupRequestType     RequestType = 12
+	RegisterSchemaRequestType RequestType = 13
+	// an ExpireSessions entry is just the leader's time, 8 bytes, for the
+	// groups to reap the sessions timed out by then
+	ExpireSessionsRequestType RequestType = 14
 )
 
 func (l *fsm) Apply(record *raft.Log) interface{} {
@@ -273,6 +863,26 @@ func (l *fsm) Apply(record *raft.Log) interface{} {
 	switch reqType {
 	case AppendRequestType:
 		return l.applyAppend(buf[1:])
+	case RetentionRequestType:
+		return l.applyRetention(buf[1:])
+	case AppendBatchRequestType:
+		return l.applyAppendBatch(buf[1:])
+	case InitProducerRequestType:
+		return l.applyInitProducer(record.Index)
+	case BeginTxnRequestType, CommitTxnRequestType, AbortTxnRequestType:
+		return l.applyTxn(reqType, buf[1:])
+	case CreateTopicRequestType:
+		return l.applyCreateTopic(buf[1:])
+	case DeleteTopicRequestType:
+		return l.applyDeleteTopic(buf[1:])
+	case CommitOffsetRequestType:
+		return l.applyCommitOffset(buf[1:])
+	case JoinGroupRequestType, HeartbeatRequestType, LeaveGroupRequestType:
+		return l.applyGroup(reqType, buf[1:], record.Index)
+	case RegisterSchemaRequestType:
+		return l.applyRegisterSchema(buf[1:], record.Index)
+	case ExpireSessionsRequestType:
+		return l.applyExpireSessions(buf[1:])
 	}
 	return nil
 }
@@ -283,22 +893,399 @@ func (l *fsm) applyAppend(b []byte) interface{} {
 	if err != nil {
 		return err
 	}
-	offset, err := l.log.Append(req.Record)
+	log, err := l.topics.log(req.Topic)
+	if err != nil {
+		return err
+	}
+	records := []*api.Record{req.Record}
+	offsets, err := l.produce(
+		log,
+		req.Topic,
+		req.ProducerId,
+		req.Sequence,
+		records,
+		func() ([]uint64, error) {
+			offset, err := log.Append(req.Record)
+			return []uint64{offset}, err
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceResponse{Offset: offsets[0]}
+}
+
+func (l *fsm) applyAppendBatch(b []byte) interface{} {
+	var req api.ProduceBatchRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	log, err := l.topics.log(req.Topic)
+	if err != nil {
+		return err
+	}
+	offsets, err := l.produce(
+		log,
+		req.Topic,
+		req.ProducerId,
+		req.Sequence,
+		req.Records,
+		func() ([]uint64, error) {
+			return log.AppendBatch(req.Records)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceBatchResponse{Offsets: offsets}
+}
+
+// produce appends the records to the topic's log with write, checking the
+// request against its producer's state first when it's from an idempotent
+// producer.
+func (l *fsm) produce(
+	log *Log,
+	topic string,
+	producerID, sequence uint64,
+	records []*api.Record,
+	write func() ([]uint64, error),
+) ([]uint64, error) {
+	var now int64
+	for _, record := range records {
+		l.producers.tick(record.AppendTime)
+		now = record.AppendTime
+	}
+	l.tickGroups(now)
+	if err := l.abortTimedOut(now); err != nil {
+		return nil, err
+	}
+	var txn uint64
+	if producerID != 0 {
+		offsets, err := l.producers.check(producerID, sequence)
+		if err != nil {
+			return nil, err
+		}
+		if offsets != nil {
+			return offsets, nil
+		}
+		if l.producers.writeInTxn(producerID, topic, log.nextOffset()) {
+			txn = producerID
+		}
+	}
+	// only the log writes control records, and only the records written
+	// in a transaction carry its producer
+	for _, record := range records {
+		record.ProducerId = txn
+		record.Control = api.ControlType_CONTROL_NONE
+	}
+	offsets, err := write()
+	if err != nil {
+		return nil, err
+	}
+	if producerID != 0 {
+		l.producers.appended(producerID, sequence, offsets, now)
+	}
+	return offsets, nil
+}
+
+func (l *fsm) applyTxn(reqType RequestType, b []byte) interface{} {
+	var req api.TxnRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	l.producers.tick(req.Time)
+	l.tickGroups(req.Time)
+	if err = l.abortTimedOut(req.Time); err != nil {
+		return err
+	}
+	if reqType == BeginTxnRequestType {
+		if err = l.producers.begin(req.ProducerId); err != nil {
+			return err
+		}
+		return &api.BeginTxnResponse{}
+	}
+	if reqType == CommitTxnRequestType {
+		offsets, err := l.endTxn(
+			req.ProducerId,
+			api.ControlType_CONTROL_COMMIT,
+			req.Time,
+		)
+		if err != nil {
+			return err
+		}
+		return &api.CommitTxnResponse{Offsets: offsets}
+	}
+	offsets, err := l.endTxn(
+		req.ProducerId,
+		api.ControlType_CONTROL_ABORT,
+		req.Time,
+	)
+	if err != nil {
+		return err
+	}
+	return &api.AbortTxnResponse{Offsets: offsets}
+}
+
+// endTxn writes the control records ending the producer's transaction in
+// the topics it wrote to and returns their offsets.
+func (l *fsm) endTxn(
+	producerID uint64,
+	control api.ControlType,
+	now int64,
+) (map[string]uint64, error) {
+	topics, err := l.producers.txnTopics(producerID)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]uint64, len(topics))
+	for _, topic := range topics {
+		log, err := l.topics.log(topic)
+		if err != nil {
+			return nil, err
+		}
+		offsets[topic], err = log.Append(&api.Record{
+			ProducerId: producerID,
+			Control:    control,
+			AppendTime: now,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.producers.end(producerID, control, offsets)
+	return offsets, nil
+}
+
+// abortTimedOut aborts the transactions that have been open too long. The
+// producers are fenced off, so they can't go on to write records outside
+// the transaction they think is open; they have to be initialized again.
+func (l *fsm) abortTimedOut(now int64) error {
+	for _, id := range l.producers.timedOut() {
+		if _, err := l.endTxn(id, api.ControlType_CONTROL_ABORT, now); err != nil {
+			return err
+		}
+		l.producers.fence(id)
+	}
+	return nil
+}
+
+func (l *fsm) applyInitProducer(index uint64) interface{} {
+	l.producers.init(index)
+	return &api.InitProducerResponse{ProducerId: index}
+}
+
+func (l *fsm) applyCreateTopic(b []byte) interface{} {
+	var req api.CreateTopicRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	if _, err = l.topics.create(req.Name, req.Config, req.Replicas); err != nil {
+		return err
+	}
+	if l.groups != nil {
+		l.groups.topicChanged(req.Name, l.topics.partitionCount)
+	}
+	return &api.CreateTopicResponse{}
+}
+
+func (l *fsm) applyDeleteTopic(b []byte) interface{} {
+	var req api.DeleteTopicRequest
+	err := proto.Unmarshal(b, &req)
 	if err != nil {
 		return err
 	}
-	return &api.ProduceResponse{Offset: offset}
+	if err = l.topics.remove(req.Name); err != nil {
+		return err
+	}
+	l.producers.topicDeleted(req.Name)
+	if l.offsets != nil {
+		l.offsets.topicDeleted(req.Name)
+		l.groups.topicChanged(req.Name, l.topics.partitionCount)
+		l.schemas.topicDeleted(req.Name)
+	}
+	return &api.DeleteTopicResponse{}
+}
+
+func (l *fsm) applyRegisterSchema(b []byte, index uint64) interface{} {
+	if l.schemas == nil {
+		return fmt.Errorf("log: schemas are registered with the topic registry")
+	}
+	var req api.RegisterSchemaRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if l.topics.partitionCount(req.Topic) == 0 {
+		return api.ErrUnknownTopic{Topic: req.Topic}
+	}
+	schema, err := l.schemas.register(&req, index)
+	if err != nil {
+		return err
+	}
+	return &api.RegisterSchemaResponse{Schema: schema}
+}
+
+func (l *fsm) applyCommitOffset(b []byte) interface{} {
+	var req api.CommitOffsetRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	if l.offsets == nil {
+		return fmt.Errorf("log: offsets are committed to the topic registry")
+	}
+	if req.Group == "" {
+		return api.ErrInvalidGroup{Group: req.Group}
+	}
+	if _, _, err = l.topics.partition(req.Topic, req.Partition); err != nil {
+		return err
+	}
+	l.tickGroups(req.Time)
+	if err = l.groups.checkCommit(&req); err != nil {
+		return err
+	}
+	l.offsets.commit(&req)
+	return &api.CommitOffsetResponse{}
+}
+
+func (l *fsm) applyGroup(reqType RequestType, b []byte, index uint64) interface{} {
+	if l.groups == nil {
+		return fmt.Errorf("log: groups are coordinated by the topic registry")
+	}
+	switch reqType {
+	case JoinGroupRequestType:
+		var req api.JoinGroupRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		l.tickGroups(req.Time)
+		res, err := l.groups.join(&req, index, l.topics.partitionCount)
+		if err != nil {
+			return err
+		}
+		return res
+	case HeartbeatRequestType:
+		var req api.HeartbeatRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		l.tickGroups(req.Time)
+		if err := l.groups.heartbeat(&req, l.topics.partitionCount); err != nil {
+			return err
+		}
+		return &api.HeartbeatResponse{}
+	}
+	var req api.LeaveGroupRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	l.tickGroups(req.Time)
+	if err := l.groups.leave(&req, l.topics.partitionCount); err != nil {
+		return err
+	}
+	return &api.LeaveGroupResponse{}
+}
+
+// tickGroups moves the consumer groups' clock on to an applied entry's
+// time. Partitions' state machines have no groups.
+func (l *fsm) tickGroups(now int64) {
+	if l.groups != nil {
+		l.groups.tick(now, l.topics.partitionCount)
+	}
+}
+
+func (l *fsm) applyExpireSessions(b []byte) interface{} {
+	if len(b) != 8 {
+		return fmt.Errorf("log: malformed session expiry entry")
+	}
+	l.tickGroups(int64(enc.Uint64(b)))
+	return nil
+}
+
+func (l *fsm) applyRetention(b []byte) interface{} {
+	var req api.RetentionRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	log, err := l.topics.log(req.Topic)
+	if err != nil {
+		return err
+	}
+	if err = log.Truncate(req.Lowest); err != nil {
+		return err
+	}
+	lowest, err := log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	l.producers.truncated(req.Topic, lowest)
+	return nil
 }
 
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	r := f.log.Reader()
-	return &snapshot{reader: r}, nil
+	// the state is copied now, Persist runs while entries are applied
+	snap := f.producers.snapshot()
+	if f.offsets != nil {
+		snap.Offsets = f.offsets.snapshot()
+		snap.Groups = f.groups.snapshot()
+		snap.Schemas = f.schemas.snapshot()
+	}
+	state, err := proto.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	readers := []io.Reader{stateFrameReader(state)}
+	var logs []io.Closer
+	err = f.topics.each(func(name string, tl *topicLog) error {
+		if tl.partitions != nil {
+			// the partitions' raft groups snapshot their logs
+			b, err := proto.Marshal(&api.Topic{Name: name, Config: tl.config})
+			if err != nil {
+				return err
+			}
+			readers = append(readers, stateFrameReader(b))
+			return nil
+		}
+		if name != "" {
+			b, err := proto.Marshal(&api.Topic{Name: name, Config: tl.config})
+			if err != nil {
+				return err
+			}
+			readers = append(readers, stateFrameReader(b))
+		}
+		r := tl.log.Reader()
+		readers = append(readers, r)
+		logs = append(logs, r)
+		return nil
+	})
+	s := &snapshot{reader: io.MultiReader(readers...), logs: logs}
+	if err != nil {
+		s.Release()
+		return nil, err
+	}
+	return s, nil
+}
+
+// stateFrameReader returns a reader of a state frame holding p.
+func stateFrameReader(p []byte) io.Reader {
+	return bytes.NewReader(encodeFrame(p, stateFrame))
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
+// snapshot is written as a state frame holding the producers' state, the
+// committed offsets, the consumer groups and the schema registry, then
+// the default topic's store frames, followed by each named topic's: a
+// state frame holding the topic and its config, and its store frames. A
+// partitioned topic has just the state frame.
 type snapshot struct {
 	reader io.Reader
+	// logs are the readers of the topics' logs, which pin their segments
+	// until they're closed
+	logs []io.Closer
 }
 
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
@@ -309,44 +1296,187 @@ func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 	return sink.Close()
 }
 
-func (s *snapshot) Release() {}
+func (s *snapshot) Release() {
+	for _, l := range s.logs {
+		_ = l.Close()
+	}
+}
 
 func (f *fsm) Restore(r io.ReadCloser) error {
-	b := make([]byte, lenWidth)
+	b := make([]byte, headerWidth)
 	var buf bytes.Buffer
-	for i := 0; ; i++ {
-		_, err := io.ReadFull(r, b)
+	var key []byte
+	// log is the topic being restored, its frames follow the state frame
+	// naming it
+	log, err := f.topics.log("")
+	if err != nil {
+		return err
+	}
+	var restored, sawState bool
+	// legacy snapshots have no state frame
+	f.producers.restore(&api.ProducerSnapshot{})
+	if f.offsets != nil {
+		f.offsets.restore(nil)
+		f.groups.restore(nil)
+		if err := f.schemas.restore(nil); err != nil {
+			return err
+		}
+	}
+	if err := f.topics.reset(); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	if p, _ := br.Peek(lenWidth); len(p) == lenWidth && enc.Uint64(p)>>attrShift == 0 {
+		// legacy snapshots start with a plain record frame
+		if err := restoreLegacy(br, log); err != nil {
+			return err
+		}
+		return f.topics.prune()
+	}
+	for {
+		_, err := io.ReadFull(br, b)
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
-		size := int64(enc.Uint64(b))
-		if _, err = io.CopyN(&buf, r, size); err != nil {
+		header := enc.Uint64(b[:lenWidth])
+		size := int64(header & lenMask)
+		if _, err = io.CopyN(&buf, br, size); err != nil {
+			return err
+		}
+		if checksum(buf.Bytes()) != enc.Uint32(b[lenWidth:]) {
+			return errChecksum
+		}
+		p, attrs := buf.Bytes(), uint8(header>>attrShift)
+		if attrs&stateFrame != 0 && !sawState {
+			snap := &api.ProducerSnapshot{}
+			if err = proto.Unmarshal(p, snap); err != nil {
+				return err
+			}
+			f.producers.restore(snap)
+			if f.offsets != nil {
+				f.offsets.restore(snap.Offsets)
+				f.groups.restore(snap.Groups)
+				if err = f.schemas.restore(snap.Schemas); err != nil {
+					return err
+				}
+			}
+			sawState = true
+			buf.Reset()
+			continue
+		}
+		if attrs&stateFrame != 0 {
+			topic := &api.Topic{}
+			if err = proto.Unmarshal(p, topic); err != nil {
+				return err
+			}
+			tl, err := f.topics.create(topic.Name, topic.Config, nil)
+			if err != nil {
+				return err
+			}
+			log = tl.log
+			restored = false
+			buf.Reset()
+			continue
+		}
+		if attrs&headerFrame != 0 {
+			// the frames up to the next header are sealed with the
+			// key it names, if it names one. Snapshots are taken
+			// decrypted now, older ones may not have been.
+			if !bytes.HasPrefix(p, storeMagic) {
+				return fmt.Errorf("log: snapshot segment isn't in a known format")
+			}
+			key = nil
+			if id := string(p[len(storeMagic):]); id != "" {
+				if log.Config.Encryption.Keys == nil {
+					return fmt.Errorf(
+						"log: snapshot is encrypted with key %q and no keys are configured",
+						id,
+					)
+				}
+				if key, err = log.Config.Encryption.Keys.Key(id); err != nil {
+					return err
+				}
+			}
+			buf.Reset()
+			continue
+		}
+		if attrs&encryptedFrame != 0 {
+			if p, err = unseal(key, p); err != nil {
+				return err
+			}
+		}
+		records, err := decodeFrame(p, attrs)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if !restored {
+				log.Config.Segment.InitialOffset = record.Offset
+				if err := log.Reset(); err != nil {
+					return err
+				}
+				restored = true
+			}
+			// keep the record's offset, compaction may have left gaps
+			if _, err = log.appendAt(record); err != nil {
+				return err
+			}
+		}
+		buf.Reset()
+	}
+	return f.topics.prune()
+}
+
+// restoreLegacy restores a snapshot taken before store frames had
+// attributes and checksums, the default topic's records each behind a bare
+// length.
+func restoreLegacy(r io.Reader, log *Log) error {
+	b := make([]byte, lenWidth)
+	restored := false
+	for {
+		_, err := io.ReadFull(r, b)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		p := make([]byte, enc.Uint64(b))
+		if _, err = io.ReadFull(r, p); err != nil {
 			return err
 		}
 		record := &api.Record{}
-		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
+		if err = proto.Unmarshal(p, record); err != nil {
 			return err
 		}
-		if i == 0 {
-			f.log.Config.Segment.InitialOffset = record.Offset
-			if err := f.log.Reset(); err != nil {
+		if !restored {
+			log.Config.Segment.InitialOffset = record.Offset
+			if err = log.Reset(); err != nil {
 				return err
 			}
+			restored = true
 		}
-		if _, err = f.log.Append(record); err != nil {
+		if _, err = log.appendAt(record); err != nil {
 			return err
 		}
-		buf.Reset()
 	}
-	return nil
 }
 
 var _ raft.LogStore = (*logStore)(nil)
 
+// firstIndexFile is the file in the raft log's directory keeping the index
+// DeleteRange last compacted the log up to.
+const firstIndexFile = "first"
+
 type logStore struct {
 	*Log
+	// first is the index DeleteRange last compacted the log up to. The
+	// log only removes whole segments, so the entries before first can
+	// still be on disk but are treated as deleted. It's persisted so they
+	// stay deleted across restarts, and accessed atomically, raft
+	// compacts the log while other goroutines read it.
+	first uint64
 }
 
 func newLogStore(dir string, c Config) (*logStore, error) {
@@ -354,21 +1484,83 @@ func newLogStore(dir string, c Config) (*logStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &logStore{log}, nil
+	l := &logStore{Log: log}
+	b, err := ioutil.ReadFile(filepath.Join(dir, firstIndexFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Close()
+		return nil, err
+	case len(b) != 8:
+		log.Close()
+		return nil, fmt.Errorf("log: corrupt first index file in %s", dir)
+	default:
+		l.first = enc.Uint64(b)
+	}
+	return l, nil
 }
 
+// setFirst persists the index the log was compacted up to.
+func (l *logStore) setFirst(first uint64) error {
+	b := make([]byte, 8)
+	enc.PutUint64(b, first)
+	name := filepath.Join(l.Dir, firstIndexFile)
+	if err := ioutil.WriteFile(name+".tmp", b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	if err := syncDir(l.Dir); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&l.first, first)
+	return nil
+}
+
+// bounds returns the indexes of the first and last entries, both 0 if the
+// log has no entries.
+func (l *logStore) bounds() (uint64, uint64, error) {
+	first, err := l.LowestOffset()
+	if err != nil {
+		return 0, 0, err
+	}
+	if floor := atomic.LoadUint64(&l.first); first < floor {
+		first = floor
+	}
+	next := l.nextOffset()
+	if next <= first {
+		return 0, 0, nil
+	}
+	return first, next - 1, nil
+}
+
+// FirstIndex returns the index of the first entry, or 0 if the log has no
+// entries.
 func (l *logStore) FirstIndex() (uint64, error) {
-	return l.LowestOffset()
+	first, _, err := l.bounds()
+	return first, err
 }
 
+// LastIndex returns the index of the last entry, or 0 if the log has no
+// entries.
 func (l *logStore) LastIndex() (uint64, error) {
-	off, err := l.HighestOffset()
-	return off, err
+	_, last, err := l.bounds()
+	return last, err
 }
 
+// GetLog returns raft.ErrLogNotFound for an index that isn't in the log,
+// which tells raft to send a follower a snapshot instead.
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	if index < atomic.LoadUint64(&l.first) {
+		return raft.ErrLogNotFound
+	}
 	in, err := l.Read(index)
-	if err != nil {
+	switch err.(type) {
+	case nil:
+	case api.ErrOffsetOutOfRange, api.ErrOffsetCompacted:
+		return raft.ErrLogNotFound
+	default:
 		return err
 	}
 	out.Data = in.Value
@@ -381,21 +1573,89 @@ func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 func (l *logStore) StoreLog(record *raft.Log) error {
 	return l.StoreLogs([]*raft.Log{record})
 }
+
+// StoreLogs stores the entries at their indexes, which have to follow on
+// from each other and from the log's last entry, if it has one. Raft only
+// stores entries past the log's next index after installing a snapshot on
+// a follower, whose log can still have older entries when it kept trailing
+// logs, so the log is moved forward to the first entry and the older ones
+// dropped.
 func (l *logStore) StoreLogs(records []*raft.Log) error {
-	for _, record := range records {
-		if _, err := l.Append(&api.Record{
+	if len(records) == 0 {
+		return nil
+	}
+	batch := make([]*api.Record, 0, len(records))
+	for i, record := range records {
+		if i > 0 && record.Index != records[i-1].Index+1 {
+			return fmt.Errorf(
+				"log: can't store entry %d after entry %d",
+				record.Index, records[i-1].Index,
+			)
+		}
+		batch = append(batch, &api.Record{
 			Value: record.Data,
 			Term:  record.Term,
 			Type:  uint32(record.Type),
-		}); err != nil {
+		})
+	}
+	index := records[0].Index
+	_, last, err := l.bounds()
+	if err != nil {
+		return err
+	}
+	next := l.nextOffset()
+	if index < next && last != 0 {
+		return fmt.Errorf(
+			"log: can't store entry %d before the next index %d",
+			index, next,
+		)
+	}
+	if index != next {
+		if err := l.resetTo(index); err != nil {
+			return err
+		}
+		if err := l.setFirst(index); err != nil {
 			return err
 		}
 	}
-	return nil
+	_, err = l.AppendBatch(batch)
+	return err
 }
 
+// DeleteRange removes the entries from min to max, inclusive. Raft either
+// removes a prefix after taking or installing a snapshot, which can be the
+// whole log, or, on a follower, the suffix that conflicts with a new
+// leader's log.
 func (l *logStore) DeleteRange(min, max uint64) error {
-	return l.Truncate(max)
+	first, last, err := l.bounds()
+	if err != nil {
+		return err
+	}
+	if last == 0 {
+		return nil
+	}
+	if min <= first {
+		if max >= last {
+			// deleting a conflicting suffix can also delete the whole
+			// log, StoreLogs moves the log back for the entries
+			// replacing it
+			if err = l.resetTo(max + 1); err != nil {
+				return err
+			}
+			return l.setFirst(max + 1)
+		}
+		if err = l.Truncate(max); err != nil {
+			return err
+		}
+		return l.setFirst(max + 1)
+	}
+	if max >= last {
+		return l.TruncateFrom(min)
+	}
+	return fmt.Errorf(
+		"log: can't delete entries %d to %d from the middle of %d to %d",
+		min, max, first, last,
+	)
 }
 
 var _ raft.StreamLayer = (*StreamLayer)(nil)
@@ -0,0 +1,951 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// entries returns raft log entries from first on with the given terms.
+func entries(first uint64, terms ...uint64) []*raft.Log {
+	var logs []*raft.Log
+	for i, term := range terms {
+		logs = append(logs, &raft.Log{
+			Index: first + uint64(i),
+			Term:  term,
+			Type:  raft.LogCommand,
+			Data:  []byte{byte(first + uint64(i)), byte(term)},
+		})
+	}
+	return logs
+}
+
+// appendEntries applies an AppendEntries request the way a raft follower
+// does: entries conflicting with the leader's are deleted from the first
+// conflict on before the leader's entries are stored.
+func appendEntries(t *testing.T, s *logStore, logs []*raft.Log) {
+	t.Helper()
+	last, err := s.LastIndex()
+	require.NoError(t, err)
+	var fresh []*raft.Log
+	for i, entry := range logs {
+		if entry.Index > last {
+			fresh = logs[i:]
+			break
+		}
+		var stored raft.Log
+		require.NoError(t, s.GetLog(entry.Index, &stored))
+		if entry.Term != stored.Term {
+			require.NoError(t, s.DeleteRange(entry.Index, last))
+			fresh = logs[i:]
+			break
+		}
+	}
+	if len(fresh) > 0 {
+		require.NoError(t, s.StoreLogs(fresh))
+	}
+}
+
+func requireLog(t *testing.T, s *logStore, first uint64, terms ...uint64) {
+	t.Helper()
+	got, err := s.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, first, got)
+	last, err := s.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, first+uint64(len(terms))-1, last)
+	for _, want := range entries(first, terms...) {
+		var got raft.Log
+		require.NoError(t, s.GetLog(want.Index, &got))
+		require.Equal(t, want.Index, got.Index)
+		require.Equal(t, want.Term, got.Term)
+		require.Equal(t, want.Data, got.Data)
+	}
+	var missing raft.Log
+	require.Equal(t, raft.ErrLogNotFound, s.GetLog(last+1, &missing))
+}
+
+func TestLogStoreDivergentFollower(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		follower []*raft.Log
+		leader   []*raft.Log
+		terms    []uint64
+	}{
+		// a deposed leader appended entries that were never committed
+		"uncommitted tail": {
+			follower: entries(1, 1, 1, 1, 2, 2, 2),
+			leader:   entries(4, 3, 3),
+			terms:    []uint64{1, 1, 1, 3, 3},
+		},
+		// the conflict is in the middle of a batch frame
+		"conflict inside a batch": {
+			follower: entries(1, 1, 1, 1, 1, 1),
+			leader:   entries(2, 1, 2, 2, 2, 2, 2, 2),
+			terms:    []uint64{1, 1, 2, 2, 2, 2, 2, 2},
+		},
+		// the follower's whole log conflicts
+		"whole log": {
+			follower: entries(1, 1, 1, 1),
+			leader:   entries(1, 2),
+			terms:    []uint64{2},
+		},
+		// the leader resends entries the follower already has
+		"no conflict": {
+			follower: entries(1, 1, 1, 1),
+			leader:   entries(2, 1, 1, 2),
+			terms:    []uint64{1, 1, 1, 2},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-store-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			// a few entries per segment so the deletes cross segments
+			c.Segment.MaxStoreBytes = 64
+			c.Segment.InitialOffset = 1
+			s, err := newLogStore(dir, c)
+			require.NoError(t, err)
+
+			require.NoError(t, s.StoreLogs(tc.follower))
+			appendEntries(t, s, tc.leader)
+			requireLog(t, s, 1, tc.terms...)
+
+			require.NoError(t, s.Close())
+			s, err = newLogStore(dir, c)
+			require.NoError(t, err)
+			requireLog(t, s, 1, tc.terms...)
+			require.NoError(t, s.Close())
+		})
+	}
+}
+
+func TestLogStoreDeleteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 1
+	s, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	reopen := func() {
+		t.Helper()
+		require.NoError(t, s.Close())
+		s, err = newLogStore(dir, c)
+		require.NoError(t, err)
+	}
+	requireEmpty := func() {
+		t.Helper()
+		first, err := s.FirstIndex()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), first)
+		last, err := s.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), last)
+	}
+	requireEmpty()
+
+	require.NoError(t, s.StoreLogs(entries(1, 1, 1, 1, 1, 1, 1)))
+	// compaction after a snapshot deletes a prefix, which stays deleted
+	// after a restart though the log keeps some of it on disk
+	require.NoError(t, s.DeleteRange(1, 3))
+	requireLog(t, s, 4, 1, 1, 1)
+	reopen()
+	requireLog(t, s, 4, 1, 1, 1)
+	var got raft.Log
+	require.Equal(t, raft.ErrLogNotFound, s.GetLog(3, &got))
+
+	// deleting the entries in the middle isn't something raft does
+	require.Error(t, s.DeleteRange(5, 5))
+
+	// compacting the whole log leaves it empty, and the entries after
+	// the snapshot are stored at their indexes
+	require.NoError(t, s.DeleteRange(4, 7))
+	requireEmpty()
+	require.NoError(t, s.StoreLogs(entries(10, 2, 2)))
+	requireLog(t, s, 10, 2, 2)
+	reopen()
+	requireLog(t, s, 10, 2, 2)
+
+	// a follower installing a snapshot can keep older entries, which the
+	// entries after the snapshot replace
+	require.NoError(t, s.StoreLogs(entries(15, 3)))
+	requireLog(t, s, 15, 3)
+	reopen()
+	requireLog(t, s, 15, 3)
+
+	// entries have to follow on from each other and from the log's last
+	// entry
+	require.Error(t, s.StoreLogs(entries(15, 3)))
+	require.Error(t, s.StoreLogs([]*raft.Log{
+		entries(16, 3)[0],
+		entries(18, 3)[0],
+	}))
+	requireLog(t, s, 15, 3)
+	require.NoError(t, s.Close())
+}
+
+// command returns the raft entry at index applying the request.
+func command(
+	t *testing.T,
+	index uint64,
+	reqType RequestType,
+	req proto.Message,
+) *raft.Log {
+	t.Helper()
+	b, err := proto.Marshal(req)
+	require.NoError(t, err)
+	return &raft.Log{
+		Index: index,
+		Type:  raft.LogCommand,
+		Data:  append([]byte{byte(reqType)}, b...),
+	}
+}
+
+// snapshotSink collects a persisted snapshot.
+type snapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *snapshotSink) ID() string    { return "snapshot" }
+func (s *snapshotSink) Cancel() error { return nil }
+func (s *snapshotSink) Close() error  { return nil }
+
+// newFSM returns a state machine keeping its topics in a new directory.
+func newFSM(t *testing.T, c Config) *fsm {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fsm-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	log, err := NewLog(filepath.Join(dir, "log"), c)
+	require.NoError(t, err)
+	f := &fsm{
+		topics:    newTopics(filepath.Join(dir, "topics"), c, log),
+		producers: newProducers(c.Producers),
+		offsets:   newOffsets(),
+		groups:    newConsumerGroups(c.Groups),
+		schemas:   newSchemas(),
+	}
+	t.Cleanup(func() {
+		f.topics.close()
+		log.Close()
+	})
+	return f
+}
+
+// fsmLog returns the fsm's log for the topic.
+func fsmLog(t *testing.T, f *fsm, topic string) *Log {
+	t.Helper()
+	log, err := f.topics.log(topic)
+	require.NoError(t, err)
+	return log
+}
+
+func TestFSMProducers(t *testing.T) {
+	c := Config{}
+	c.Producers.Expiry = time.Hour
+	newFSM := func() *fsm { return newFSM(t, c) }
+	f := newFSM()
+
+	res := f.Apply(command(t, 7, InitProducerRequestType, &api.InitProducerRequest{}))
+	require.Equal(t, uint64(7), res.(*api.InitProducerResponse).ProducerId)
+
+	now := time.Now()
+	produce := func(f *fsm, index, seq uint64, at time.Time) interface{} {
+		return f.Apply(command(t, index, AppendRequestType, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:      []byte("hello world"),
+				AppendTime: at.UnixNano(),
+			},
+			ProducerId: 7,
+			Sequence:   seq,
+		}))
+	}
+	for seq := uint64(0); seq < producerWindow+2; seq++ {
+		res = produce(f, 8+seq, seq, now)
+		require.Equal(t, seq, res.(*api.ProduceResponse).Offset)
+	}
+	// only the latest requests are remembered
+	res = produce(f, 20, 1, now)
+	require.Equal(t, api.ErrOutOfOrderSequence{
+		ProducerID: 7,
+		Sequence:   1,
+		Expected:   producerWindow + 2,
+	}, res)
+	res = produce(f, 21, producerWindow+1, now)
+	require.Equal(t, uint64(producerWindow+1), res.(*api.ProduceResponse).Offset)
+	next, err := fsmLog(t, f, "").HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(producerWindow+1), next)
+
+	// the state is carried in snapshots
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	restored := newFSM()
+	require.NoError(t, restored.Restore(ioutil.NopCloser(&sink.Buffer)))
+	res = produce(restored, 22, producerWindow+1, now)
+	require.Equal(t, uint64(producerWindow+1), res.(*api.ProduceResponse).Offset)
+	res = produce(restored, 23, producerWindow+2, now)
+	require.Equal(t, uint64(producerWindow+2), res.(*api.ProduceResponse).Offset)
+
+	// producers idle for longer than the expiry are removed as new ones
+	// are initialized
+	restored.Apply(command(t, 24, AppendRequestType, &api.ProduceRequest{
+		Record: &api.Record{AppendTime: now.Add(2 * time.Hour).UnixNano()},
+	}))
+	restored.Apply(command(t, 25, InitProducerRequestType, &api.InitProducerRequest{}))
+	res = produce(restored, 26, producerWindow+3, now)
+	require.Equal(t, api.ErrUnknownProducer{ProducerID: 7}, res)
+}
+
+func TestFSMTransactions(t *testing.T) {
+	c := Config{}
+	c.Producers.TxnTimeout = time.Minute
+	newFSM := func() *fsm { return newFSM(t, c) }
+	f := newFSM()
+	now := time.Now()
+	txn := func(f *fsm, index uint64, reqType RequestType, id uint64, at time.Time) interface{} {
+		return f.Apply(command(t, index, reqType, &api.TxnRequest{
+			ProducerId: id,
+			Time:       at.UnixNano(),
+		}))
+	}
+	produce := func(f *fsm, index, id, seq uint64, at time.Time) interface{} {
+		return f.Apply(command(t, index, AppendRequestType, &api.ProduceRequest{
+			Record:     &api.Record{Value: []byte("hello world"), AppendTime: at.UnixNano()},
+			ProducerId: id,
+			Sequence:   seq,
+		}))
+	}
+
+	f.Apply(command(t, 1, InitProducerRequestType, &api.InitProducerRequest{}))
+	f.Apply(command(t, 2, InitProducerRequestType, &api.InitProducerRequest{}))
+	require.IsType(t, &api.BeginTxnResponse{}, txn(f, 3, BeginTxnRequestType, 1, now))
+	require.IsType(t, &api.ProduceResponse{}, produce(f, 4, 1, 0, now))
+	require.IsType(t, &api.AbortTxnResponse{}, txn(f, 5, AbortTxnRequestType, 1, now))
+	require.IsType(t, &api.BeginTxnResponse{}, txn(f, 6, BeginTxnRequestType, 2, now))
+	require.IsType(t, &api.ProduceResponse{}, produce(f, 7, 2, 0, now))
+	require.Equal(t, uint64(2), f.producers.stableOffset(""))
+
+	// the aborted and open transactions are carried in snapshots
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	restored := newFSM()
+	require.NoError(t, restored.Restore(ioutil.NopCloser(&sink.Buffer)))
+	require.Equal(t, uint64(2), restored.producers.stableOffset(""))
+	record, err := fsmLog(t, restored, "").Read(0)
+	require.NoError(t, err)
+	require.False(t, restored.producers.committed("", record))
+
+	// a transaction open past the timeout is aborted as the log moves on
+	// and its producer has to be initialized again
+	res := produce(restored, 8, 0, 0, now.Add(2*time.Minute))
+	require.Equal(t, uint64(4), res.(*api.ProduceResponse).Offset)
+	marker, err := fsmLog(t, restored, "").Read(3)
+	require.NoError(t, err)
+	require.Equal(t, api.ControlType_CONTROL_ABORT, marker.Control)
+	require.Equal(t, uint64(2), marker.ProducerId)
+	record, err = fsmLog(t, restored, "").Read(2)
+	require.NoError(t, err)
+	require.False(t, restored.producers.committed("", record))
+	require.Equal(t, uint64(math.MaxUint64), restored.producers.stableOffset(""))
+	require.Equal(t, api.ErrUnknownProducer{ProducerID: 2}, produce(restored, 9, 2, 1, now.Add(2*time.Minute)))
+}
+
+func TestFSMLegacySnapshot(t *testing.T) {
+	// snapshots taken before store frames had attributes and checksums
+	// hold the default topic's records each behind a bare length
+	var snap []byte
+	for i := uint64(3); i < 5; i++ {
+		p, err := proto.Marshal(&api.Record{Value: []byte("legacy"), Offset: i})
+		require.NoError(t, err)
+		snap = enc.AppendUint64(snap, uint64(len(p)))
+		snap = append(snap, p...)
+	}
+	f := newFSM(t, Config{})
+	require.NoError(t, f.Restore(ioutil.NopCloser(bytes.NewReader(snap))))
+	log := fsmLog(t, f, "")
+	for i := uint64(3); i < 5; i++ {
+		record, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte("legacy"), record.Value)
+	}
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+}
+
+func TestFSMTopics(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	f := newFSM(t, c)
+	config := &api.TopicConfig{MaxStoreBytes: 1024, RetentionMaxRecords: 10}
+	res := f.Apply(command(t, 1, CreateTopicRequestType, &api.CreateTopicRequest{
+		Name:   "orders",
+		Config: config,
+	}))
+	require.IsType(t, &api.CreateTopicResponse{}, res)
+	for i, topic := range []string{"orders", "", "orders"} {
+		res = f.Apply(command(t, uint64(2+i), AppendRequestType, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("topic " + topic)},
+			Topic:  topic,
+		}))
+		require.IsType(t, &api.ProduceResponse{}, res)
+	}
+	// the topic's config overrides the server's
+	require.Equal(t, uint64(4096), fsmLog(t, f, "").Config.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(1024), fsmLog(t, f, "orders").Config.Segment.MaxStoreBytes)
+
+	// the topics are carried in snapshots, replacing those the restored
+	// state machine had
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	restored := newFSM(t, c)
+	restored.Apply(command(t, 1, CreateTopicRequestType, &api.CreateTopicRequest{
+		Name: "stale",
+	}))
+	stale := fsmLog(t, restored, "stale").Dir
+	require.NoError(t, restored.Restore(ioutil.NopCloser(&sink.Buffer)))
+
+	topics, err := restored.topics.list()
+	require.NoError(t, err)
+	require.Len(t, topics, 1)
+	require.Equal(t, "orders", topics[0].Name)
+	require.True(t, proto.Equal(config, topics[0].Config))
+	_, err = os.Stat(stale)
+	require.True(t, os.IsNotExist(err))
+	for topic, want := range map[string]uint64{"": 0, "orders": 1} {
+		log := fsmLog(t, restored, topic)
+		off, err := log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("topic "+topic), record.Value)
+	}
+}
+
+func TestFSMSnapshotPointInTime(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256
+	f := newFSM(t, c)
+	produce := func(f *fsm, index uint64) {
+		res := f.Apply(command(t, index, AppendRequestType, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", index))},
+		}))
+		require.Equal(t, index-1, res.(*api.ProduceResponse).Offset)
+	}
+	for index := uint64(1); index <= 20; index++ {
+		produce(f, index)
+	}
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+
+	// entries applied and segments removed while the snapshot is
+	// persisted aren't in it
+	for index := uint64(21); index <= 30; index++ {
+		produce(f, index)
+	}
+	require.NoError(t, fsmLog(t, f, "").Truncate(25))
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+
+	restored := newFSM(t, c)
+	require.NoError(t, restored.Restore(ioutil.NopCloser(&sink.Buffer)))
+	log := fsmLog(t, restored, "")
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+
+	// so replaying the entries after it doesn't append them twice
+	for index := uint64(21); index <= 30; index++ {
+		produce(restored, index)
+	}
+	for off := uint64(0); off < 30; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off+1), string(record.Value))
+	}
+}
+
+func TestFSMSnapshotAcrossKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-keys-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// each node has a keyring of its own
+	node := func(name, key string) (*fsm, *sealedSnapshots) {
+		keyring := filepath.Join(dir, name+"-keyring")
+		require.NoError(t, ioutil.WriteFile(keyring, []byte(name+" "+key+"\n"), 0600))
+		keys, err := NewFileKeyring(keyring)
+		require.NoError(t, err)
+		c := Config{}
+		c.Segment.MaxStoreBytes = 256
+		c.Encryption.Keys = keys
+		snapshots, err := raft.NewFileSnapshotStore(
+			filepath.Join(dir, name),
+			1,
+			ioutil.Discard,
+		)
+		require.NoError(t, err)
+		return newFSM(t, c), &sealedSnapshots{SnapshotStore: snapshots, keys: keys}
+	}
+	leader, leaderSnapshots := node("leader", "000102030405060708090a0b0c0d0e0f")
+	follower, followerSnapshots := node("follower", "0f0e0d0c0b0a09080706050403020100")
+	// big enough for the snapshot to be sealed in a few chunks
+	value := func(index uint64) string {
+		return fmt.Sprintf("secret %d %s", index, strings.Repeat("x", 16*1024))
+	}
+	for index := uint64(1); index <= 10; index++ {
+		res := leader.Apply(command(t, index, AppendRequestType, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value(index))},
+		}))
+		require.IsType(t, &api.ProduceResponse{}, res)
+	}
+
+	snap, err := leader.Snapshot()
+	require.NoError(t, err)
+	sink, err := leaderSnapshots.Create(raft.SnapshotVersionMax, 10, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, "keyring") {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.NotContains(t, string(b), "secret", path)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// the leader sends the snapshot unsealed and the follower seals it
+	// with its own key, as raft installs it
+	meta, r, err := leaderSnapshots.Open(sink.ID())
+	require.NoError(t, err)
+	installed, err := followerSnapshots.Create(raft.SnapshotVersionMax, 10, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	n, err := io.Copy(installed, r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, meta.Size, n)
+	require.NoError(t, installed.Close())
+
+	_, r, err = followerSnapshots.Open(installed.ID())
+	require.NoError(t, err)
+	require.NoError(t, follower.Restore(r))
+	log := fsmLog(t, follower, "")
+	for off := uint64(0); off < 10; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value(off+1), string(record.Value))
+	}
+	require.Equal(t, "follower", log.activeSegment.keyID)
+}
+
+func TestFSMOffsets(t *testing.T) {
+	f := newFSM(t, Config{})
+	f.Apply(command(t, 1, CreateTopicRequestType, &api.CreateTopicRequest{
+		Name: "orders",
+	}))
+	commit := func(f *fsm, index uint64, req *api.CommitOffsetRequest) interface{} {
+		return f.Apply(command(t, index, CommitOffsetRequestType, req))
+	}
+	res := commit(f, 2, &api.CommitOffsetRequest{Group: "workers", Offset: 3})
+	require.IsType(t, &api.CommitOffsetResponse{}, res)
+	res = commit(f, 3, &api.CommitOffsetRequest{Group: "workers", Topic: "orders", Offset: 5})
+	require.IsType(t, &api.CommitOffsetResponse{}, res)
+	res = commit(f, 4, &api.CommitOffsetRequest{Topic: "orders", Offset: 1})
+	require.Equal(t, api.ErrInvalidGroup{}, res)
+	res = commit(f, 5, &api.CommitOffsetRequest{Group: "workers", Topic: "payments"})
+	require.Equal(t, api.ErrUnknownTopic{Topic: "payments"}, res)
+	res = commit(f, 6, &api.CommitOffsetRequest{Group: "workers", Topic: "orders", Partition: 1})
+	require.Equal(t, api.ErrUnknownPartition{Topic: "orders", Partition: 1}, res)
+
+	// the offsets are carried in snapshots
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	restored := newFSM(t, Config{})
+	commit(restored, 1, &api.CommitOffsetRequest{Group: "stale", Offset: 1})
+	require.NoError(t, restored.Restore(ioutil.NopCloser(&sink.Buffer)))
+	for topic, want := range map[string]uint64{"": 3, "orders": 5} {
+		off, err := restored.offsets.fetch("workers", topic, 0)
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+	}
+	_, err = restored.offsets.fetch("stale", "", 0)
+	require.Equal(t, api.ErrNoCommittedOffset{Group: "stale"}, err)
+
+	// deleting a topic drops the offsets committed in it
+	restored.Apply(command(t, 7, DeleteTopicRequestType, &api.DeleteTopicRequest{
+		Name: "orders",
+	}))
+	_, err = restored.offsets.fetch("workers", "orders", 0)
+	require.Equal(t, api.ErrNoCommittedOffset{Group: "workers", Topic: "orders"}, err)
+}
+
+func TestFSMGroups(t *testing.T) {
+	f := newFSM(t, Config{})
+	for i, topic := range []string{"a", "b", "c"} {
+		f.Apply(command(t, uint64(i+1), CreateTopicRequestType, &api.CreateTopicRequest{
+			Name: topic,
+		}))
+	}
+	second := int64(time.Second)
+	join := func(f *fsm, index uint64, req *api.JoinGroupRequest) interface{} {
+		req.Group = "workers"
+		req.Topics = []string{"a", "b", "c"}
+		return f.Apply(command(t, index, JoinGroupRequestType, req))
+	}
+	heartbeat := func(index uint64, id string, generation uint64, now int64) interface{} {
+		return f.Apply(command(t, index, HeartbeatRequestType, &api.HeartbeatRequest{
+			Group:      "workers",
+			MemberId:   id,
+			Generation: generation,
+			Time:       now,
+		}))
+	}
+	assigned := func(res interface{}) []string {
+		var list []string
+		for _, tp := range res.(*api.JoinGroupResponse).Assignment {
+			list = append(list, tp.Topic)
+		}
+		return list
+	}
+
+	res := join(f, 4, &api.JoinGroupRequest{Strategy: "nope"})
+	require.Equal(t, api.ErrInvalidStrategy{Strategy: "nope"}, res)
+	res = join(f, 5, &api.JoinGroupRequest{Strategy: "roundrobin", Time: 1 * second})
+	require.Equal(t, &api.JoinGroupResponse{
+		MemberId:   "member-5",
+		Generation: 1,
+		Assignment: res.(*api.JoinGroupResponse).Assignment,
+	}, res)
+	require.Equal(t, []string{"a", "b", "c"}, assigned(res))
+
+	// a member joining rebalances the group, fencing off the others'
+	// heartbeats and commits until they join again
+	res = join(f, 6, &api.JoinGroupRequest{Time: 2 * second})
+	require.Equal(t, "member-6", res.(*api.JoinGroupResponse).MemberId)
+	require.Equal(t, uint64(2), res.(*api.JoinGroupResponse).Generation)
+	require.Equal(t, []string{"b"}, assigned(res))
+	res = join(f, 7, &api.JoinGroupRequest{Strategy: "sticky", Time: 2 * second})
+	require.Equal(t, api.ErrInvalidStrategy{Strategy: "sticky", Group: "workers"}, res)
+	illegal := api.ErrIllegalGeneration{Group: "workers", Generation: 1, Current: 2}
+	require.Equal(t, illegal, heartbeat(8, "member-5", 1, 3*second))
+	commit := &api.CommitOffsetRequest{
+		Group:      "workers",
+		Topic:      "a",
+		Offset:     1,
+		MemberId:   "member-5",
+		Generation: 1,
+	}
+	res = f.Apply(command(t, 9, CommitOffsetRequestType, commit))
+	require.Equal(t, illegal, res)
+	res = join(f, 10, &api.JoinGroupRequest{MemberId: "member-5", Time: 3 * second})
+	require.Equal(t, uint64(2), res.(*api.JoinGroupResponse).Generation)
+	require.Equal(t, []string{"a", "c"}, assigned(res))
+	commit.Generation = 2
+	res = f.Apply(command(t, 11, CommitOffsetRequestType, commit))
+	require.IsType(t, &api.CommitOffsetResponse{}, res)
+	commit.Topic = "b"
+	res = f.Apply(command(t, 12, CommitOffsetRequestType, commit))
+	require.Equal(t, api.ErrNotAssigned{
+		Group:    "workers",
+		MemberID: "member-5",
+		Topic:    "b",
+	}, res)
+	require.IsType(t, &api.HeartbeatResponse{}, heartbeat(13, "member-6", 2, 4*second))
+
+	// the groups are carried in snapshots
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	restored := newFSM(t, Config{})
+	join(restored, 1, &api.JoinGroupRequest{})
+	require.NoError(t, restored.Restore(ioutil.NopCloser(&sink.Buffer)))
+	require.True(t, proto.Equal(
+		&api.ProducerSnapshot{Groups: f.groups.snapshot()},
+		&api.ProducerSnapshot{Groups: restored.groups.snapshot()},
+	))
+
+	// a member whose session timed out is dropped from the group
+	res = heartbeat(14, "member-6", 2, 14*second)
+	require.Equal(t, api.ErrIllegalGeneration{
+		Group:      "workers",
+		Generation: 2,
+		Current:    3,
+	}, res)
+	res = join(f, 15, &api.JoinGroupRequest{MemberId: "member-6", Time: 14 * second})
+	require.Equal(t, []string{"a", "b", "c"}, assigned(res))
+	require.Equal(t, api.ErrUnknownMember{
+		Group:    "workers",
+		MemberID: "member-5",
+	}, heartbeat(16, "member-5", 3, 14*second))
+
+	// deleting a topic rebalances the groups consuming it
+	f.Apply(command(t, 17, DeleteTopicRequestType, &api.DeleteTopicRequest{Name: "c"}))
+	res = join(f, 18, &api.JoinGroupRequest{MemberId: "member-6", Time: 15 * second})
+	require.Equal(t, uint64(4), res.(*api.JoinGroupResponse).Generation)
+	require.Equal(t, []string{"a", "b"}, assigned(res))
+
+	// commits outside the membership can't overwrite the members'
+	// offsets while the group has members
+	unfenced := &api.CommitOffsetRequest{
+		Group:  "workers",
+		Topic:  "a",
+		Offset: 2,
+		Time:   15 * second,
+	}
+	res = f.Apply(command(t, 19, CommitOffsetRequestType, unfenced))
+	require.Equal(t, api.ErrUnknownMember{Group: "workers"}, res)
+
+	// the group is gone once its last member leaves
+	res = f.Apply(command(t, 20, LeaveGroupRequestType, &api.LeaveGroupRequest{
+		Group:    "workers",
+		MemberId: "member-6",
+		Time:     15 * second,
+	}))
+	require.IsType(t, &api.LeaveGroupResponse{}, res)
+	require.Empty(t, f.groups.snapshot())
+	res = f.Apply(command(t, 21, CommitOffsetRequestType, unfenced))
+	require.IsType(t, &api.CommitOffsetResponse{}, res)
+}
+
+func TestFSMGroupSessions(t *testing.T) {
+	f := newFSM(t, Config{})
+	f.Apply(command(t, 1, CreateTopicRequestType, &api.CreateTopicRequest{
+		Name: "a",
+	}))
+	second := int64(time.Second)
+	for i, group := range []string{"idle", "busy"} {
+		res := f.Apply(command(t, uint64(i+2), JoinGroupRequestType, &api.JoinGroupRequest{
+			Group:  group,
+			Topics: []string{"a"},
+			Time:   1 * second,
+		}))
+		require.IsType(t, &api.JoinGroupResponse{}, res)
+	}
+	// the groups aren't checked until the first session can time out,
+	// also once they're restored
+	require.Equal(t, 11*second, f.groups.next)
+	restored := newConsumerGroups(Groups{})
+	require.Equal(t, int64(math.MaxInt64), restored.next)
+	restored.restore(f.groups.snapshot())
+	require.Equal(t, 11*second, restored.next)
+	groups := func() []string {
+		var names []string
+		for _, group := range f.groups.snapshot() {
+			names = append(names, group.Name)
+		}
+		return names
+	}
+
+	// any group's entries reap the other groups' timed out sessions
+	res := f.Apply(command(t, 4, HeartbeatRequestType, &api.HeartbeatRequest{
+		Group:      "busy",
+		MemberId:   "member-3",
+		Generation: 1,
+		Time:       8 * second,
+	}))
+	require.IsType(t, &api.HeartbeatResponse{}, res)
+	require.Equal(t, []string{"busy", "idle"}, groups())
+	res = f.Apply(command(t, 5, HeartbeatRequestType, &api.HeartbeatRequest{
+		Group:      "busy",
+		MemberId:   "member-3",
+		Generation: 1,
+		Time:       12 * second,
+	}))
+	require.IsType(t, &api.HeartbeatResponse{}, res)
+	require.Equal(t, []string{"busy"}, groups())
+
+	// and so do the leader's session expiry entries on a quiet log
+	require.False(t, f.groups.expiring(22*second))
+	require.True(t, f.groups.expiring(23*second))
+	expiry := make([]byte, 9)
+	expiry[0] = byte(ExpireSessionsRequestType)
+	enc.PutUint64(expiry[1:], uint64(23*second))
+	require.Nil(t, f.Apply(&raft.Log{
+		Index: 6,
+		Type:  raft.LogCommand,
+		Data:  expiry,
+	}))
+	require.Empty(t, groups())
+	require.False(t, f.groups.expiring(23*second))
+}
+
+func TestAssignors(t *testing.T) {
+	members := []*api.GroupMember{
+		{Id: "m1", Topics: []string{"a", "b"}},
+		{Id: "m2", Topics: []string{"a", "b"}},
+		{Id: "m3", Topics: []string{"b"}},
+	}
+	partitions := map[string]uint32{"a": 3, "b": 4}
+	for name, want := range map[string]map[string]string{
+		"range": {
+			"m1": "a0 a1 b0 b1",
+			"m2": "a2 b2",
+			"m3": "b3",
+		},
+		"roundrobin": {
+			"m1": "a0 a2 b2",
+			"m2": "a1 b0 b3",
+			"m3": "b1",
+		},
+		"sticky": {
+			"m1": "a0 a2 b3",
+			"m2": "a1 b1",
+			"m3": "b0 b2",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := defaultAssignors[name].Assign(members, partitions)
+			require.Equal(t, want, formatAssignment(got))
+
+			// partitions aren't split, an unpartitioned topic goes whole
+			// to one of its consumers
+			got = defaultAssignors[name].Assign(
+				[]*api.GroupMember{
+					{Id: "m1", Topics: []string{"solo"}},
+					{Id: "m2", Topics: []string{"solo"}},
+				},
+				map[string]uint32{"solo": 1},
+			)
+			require.Len(t, got, 1)
+			for _, tps := range formatAssignment(got) {
+				require.Equal(t, "solo0", tps)
+			}
+		})
+	}
+
+	// the sticky assignor keeps what it can of the previous assignment
+	members[0].Assignment = []*api.TopicPartition{
+		{Topic: "a", Partition: 2}, {Topic: "b", Partition: 3},
+	}
+	members = members[:2]
+	got := StickyAssignor{}.Assign(members, partitions)
+	require.Equal(t, map[string]string{
+		"m1": "a2 b3 b0 b2",
+		"m2": "a0 a1 b1",
+	}, formatAssignment(got))
+}
+
+func formatAssignment(assignment map[string][]*api.TopicPartition) map[string]string {
+	formatted := make(map[string]string, len(assignment))
+	for id, tps := range assignment {
+		var parts []string
+		for _, tp := range tps {
+			parts = append(parts, fmt.Sprintf("%s%d", tp.Topic, tp.Partition))
+		}
+		formatted[id] = strings.Join(parts, " ")
+	}
+	return formatted
+}
+
+func TestFSMSchemas(t *testing.T) {
+	f := newFSM(t, Config{})
+	f.Apply(command(t, 1, CreateTopicRequestType, &api.CreateTopicRequest{
+		Name: "orders",
+	}))
+	register := func(f *fsm, index uint64, definition string) interface{} {
+		return f.Apply(command(t, index, RegisterSchemaRequestType, &api.RegisterSchemaRequest{
+			Topic:      "orders",
+			Definition: []byte(definition),
+		}))
+	}
+	v1 := `{"type": "object", "required": ["id"]}`
+	res := register(f, 2, v1)
+	require.Equal(t, &api.Schema{
+		Id:         2,
+		Topic:      "orders",
+		Version:    1,
+		Definition: []byte(v1),
+	}, res.(*api.RegisterSchemaResponse).Schema)
+	// registering a version again returns it
+	res = register(f, 3, v1)
+	require.Equal(t, uint64(2), res.(*api.RegisterSchemaResponse).Schema.Id)
+	res = register(f, 4, `{"type": "object", "required": ["id", "item"]}`)
+	require.IsType(t, api.ErrIncompatibleSchema{}, res)
+	res = register(f, 5, `{"type": `)
+	require.IsType(t, api.ErrInvalidSchema{}, res)
+	res = f.Apply(command(t, 6, RegisterSchemaRequestType, &api.RegisterSchemaRequest{
+		Topic:      "payments",
+		Definition: []byte(v1),
+	}))
+	require.Equal(t, api.ErrUnknownTopic{Topic: "payments"}, res)
+	v2 := `{"type": "object", "properties": {"id": {"type": "integer"}}}`
+	res = register(f, 7, v2)
+	require.Equal(t, uint32(2), res.(*api.RegisterSchemaResponse).Schema.Version)
+
+	// records are validated against the latest version, or the one their
+	// header names, and have the header set to the schema they matched
+	record := &api.Record{Value: []byte(`{"id": 1}`)}
+	require.NoError(t, f.schemas.validate("orders", record))
+	require.Equal(t, "7", record.Headers[SchemaIDHeader])
+	record = &api.Record{Value: []byte(`{"id": "a"}`)}
+	require.IsType(t, api.ErrSchemaViolation{}, f.schemas.validate("orders", record))
+	record.Headers = map[string]string{SchemaIDHeader: "2"}
+	require.NoError(t, f.schemas.validate("orders", record))
+	record = &api.Record{Value: []byte(`{}`)}
+	record.Headers = map[string]string{SchemaIDHeader: "2"}
+	require.IsType(t, api.ErrSchemaViolation{}, f.schemas.validate("orders", record))
+	record.Headers[SchemaIDHeader] = "7"
+	require.Equal(t,
+		api.ErrNoSchema{Topic: "", ID: 7},
+		f.schemas.validate("", record),
+	)
+	// tombstones and the records of topics with no schema aren't checked
+	require.NoError(t, f.schemas.validate("orders", &api.Record{Key: []byte("k")}))
+	require.NoError(t, f.schemas.validate("", &api.Record{Value: []byte("x")}))
+
+	// the schemas are carried in snapshots
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	restored := newFSM(t, Config{})
+	require.NoError(t, restored.Restore(ioutil.NopCloser(&sink.Buffer)))
+	for _, version := range []uint32{0, 1, 2} {
+		want, err := f.schemas.version("orders", version)
+		require.NoError(t, err)
+		got, err := restored.schemas.version("orders", version)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got))
+	}
+	require.IsType(t,
+		api.ErrSchemaViolation{},
+		restored.schemas.validate("orders", &api.Record{Value: []byte(`[]`)}),
+	)
+
+	// deleting a topic drops its schemas
+	restored.Apply(command(t, 8, DeleteTopicRequestType, &api.DeleteTopicRequest{
+		Name: "orders",
+	}))
+	_, err = restored.schemas.get(2)
+	require.Equal(t, api.ErrNoSchema{ID: 2}, err)
+	_, err = restored.schemas.version("orders", 0)
+	require.Equal(t, api.ErrNoSchema{Topic: "orders"}, err)
+}
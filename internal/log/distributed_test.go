@@ -2,10 +2,13 @@ package log_test
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
@@ -84,6 +87,37 @@ func TestMultipleNodes(t *testing.T) {
 		}, 500*time.Millisecond, 50*time.Millisecond)
 	}
 
+	batch := []*api.Record{
+		{Value: []byte("batched first")},
+		{Value: []byte("batched second")},
+	}
+	offsets, err := logs[0].AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(offsets))
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			for i, off := range offsets {
+				got, err := logs[j].Read(off)
+				if err != nil {
+					return false
+				}
+				if !reflect.DeepEqual(got.Value, batch[i].Value) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	require.NoError(t, logs[0].ReadBarrier(
+		api.Consistency_CONSISTENCY_LINEARIZABLE,
+	))
+	require.NoError(t, logs[1].ReadBarrier(api.Consistency_CONSISTENCY_LOCAL))
+	err = logs[1].ReadBarrier(api.Consistency_CONSISTENCY_LINEARIZABLE)
+	require.Equal(t, api.ErrNotLeader{
+		Leader: fmt.Sprintf("127.0.0.1:%d", ports[0]),
+	}, err)
+
 	servers, err := logs[0].GetServers()
 	require.NoError(t, err)
 	require.Equal(t, 3, len(servers))
@@ -124,3 +158,634 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+func TestDistributedRetention(t *testing.T) {
+	var logs []*log.DistributedLog
+	nodeCount := 2
+	ports := dynaport.Get(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-retention-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Segment.MaxStoreBytes = 32
+		config.Retention.MaxRecords = 2
+		config.Retention.CheckInterval = 10 * time.Millisecond
+
+		if i == 0 {
+			config.Raft.Bootstrap = true
+		}
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+
+		logs = append(logs, l)
+	}
+
+	var offs []uint64
+	for i := 0; i < 4; i++ {
+		off, err := logs[0].Append(&api.Record{
+			Value: []byte("hello world"),
+		})
+		require.NoError(t, err)
+		offs = append(offs, off)
+	}
+
+	// the leader's retention decision removes the same segments on
+	// every server
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			if _, err := l.Read(offs[1]); err == nil {
+				return false
+			}
+			if _, err := l.Read(offs[2]); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestDistributedIdempotentProducer(t *testing.T) {
+	var logs []*log.DistributedLog
+	nodeCount := 3
+	ports := dynaport.Get(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-producer-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+
+		if i == 0 {
+			config.Raft.Bootstrap = true
+		}
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+
+		logs = append(logs, l)
+	}
+
+	id, err := logs[0].InitProducer()
+	require.NoError(t, err)
+	require.NotZero(t, id)
+	other, err := logs[0].InitProducer()
+	require.NoError(t, err)
+	require.NotEqual(t, id, other)
+
+	off, err := logs[0].AppendIdempotent(id, 0, &api.Record{
+		Value: []byte("first"),
+	})
+	require.NoError(t, err)
+	// a retry returns the offset the first attempt was appended at
+	retry, err := logs[0].AppendIdempotent(id, 0, &api.Record{
+		Value: []byte("first"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, off, retry)
+
+	batch := []*api.Record{
+		{Value: []byte("batched first")},
+		{Value: []byte("batched second")},
+	}
+	offsets, err := logs[0].AppendBatchIdempotent(id, 1, batch)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{off + 1, off + 2}, offsets)
+
+	_, err = logs[0].AppendIdempotent(id, 3, &api.Record{
+		Value: []byte("skipped a sequence"),
+	})
+	require.Equal(t, api.ErrOutOfOrderSequence{
+		ProducerID: id,
+		Sequence:   3,
+		Expected:   2,
+	}, err)
+	_, err = logs[0].AppendIdempotent(id+100, 0, &api.Record{
+		Value: []byte("never initialized"),
+	})
+	require.Equal(t, api.ErrUnknownProducer{ProducerID: id + 100}, err)
+
+	// the new leader recognizes retries of requests the old one appended
+	require.NoError(t, logs[0].Close())
+	var leader *log.DistributedLog
+	require.Eventually(t, func() bool {
+		for _, l := range logs[1:] {
+			servers, err := l.GetServers()
+			if err != nil {
+				continue
+			}
+			for _, s := range servers {
+				if s.IsLeader && s.Id != "0" {
+					leader = logs[s.Id[0]-'0']
+					return true
+				}
+			}
+		}
+		return false
+	}, 3*time.Second, 50*time.Millisecond)
+
+	retried, err := leader.AppendBatchIdempotent(id, 1, batch)
+	require.NoError(t, err)
+	require.Equal(t, offsets, retried)
+	next, err := leader.AppendIdempotent(id, 2, &api.Record{
+		Value: []byte("second"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, off+3, next)
+}
+
+func TestDistributedTransactions(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "distributed-txn-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]))
+	require.NoError(t, err)
+
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID("0")
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = true
+	l, err := log.NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	id, err := l.InitProducer()
+	require.NoError(t, err)
+	require.Equal(t, api.ErrInvalidTxnState{ProducerID: id}, func() error {
+		_, err := l.CommitTxn(id)
+		return err
+	}())
+
+	require.NoError(t, l.BeginTxn(id))
+	require.Equal(t, api.ErrInvalidTxnState{ProducerID: id, Open: true}, l.BeginTxn(id))
+	inTxn, err := l.AppendIdempotent(id, 0, &api.Record{Value: []byte("in txn")})
+	require.NoError(t, err)
+	outside, err := l.Append(&api.Record{Value: []byte("outside txn")})
+	require.NoError(t, err)
+
+	// the open transaction holds back every record from its start
+	it := l.NewCommittedIterator(0)
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+	_, err = l.ReadCommitted(outside)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	record, err := l.Read(inTxn)
+	require.NoError(t, err)
+	require.Equal(t, id, record.ProducerId)
+
+	commits, err := l.CommitTxn(id)
+	require.NoError(t, err)
+	commit := commits[""]
+	for _, want := range []uint64{inTxn, outside} {
+		record, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, want, record.Offset)
+	}
+	// the commit control record is skipped
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+	_, err = l.ReadCommitted(commit)
+	require.Equal(t, api.ErrOffsetNotCommitted{Offset: commit}, err)
+	record, err = l.Read(commit)
+	require.NoError(t, err)
+	require.Equal(t, api.ControlType_CONTROL_COMMIT, record.Control)
+
+	require.NoError(t, l.BeginTxn(id))
+	aborted, err := l.AppendBatchIdempotent(id, 1, []*api.Record{
+		{Value: []byte("aborted first")},
+		{Value: []byte("aborted second")},
+	})
+	require.NoError(t, err)
+	_, err = l.AbortTxn(id)
+	require.NoError(t, err)
+	after, err := l.Append(&api.Record{Value: []byte("after abort")})
+	require.NoError(t, err)
+
+	record, err = it.Next()
+	require.NoError(t, err)
+	require.Equal(t, after, record.Offset)
+	_, err = l.ReadCommitted(aborted[0])
+	require.Equal(t, api.ErrOffsetNotCommitted{Offset: aborted[0]}, err)
+	// read_uncommitted consumers still see them
+	record, err = l.Read(aborted[1])
+	require.NoError(t, err)
+	require.Equal(t, []byte("aborted second"), record.Value)
+}
+
+func TestDistributedTiering(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "distributed-tiering-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	archive, err := log.NewLocalArchive(filepath.Join(dataDir, "archive"))
+	require.NoError(t, err)
+
+	// a follower restored from a snapshot would lose the archived
+	// records, which only the leader's log knows of
+	config := log.Config{}
+	config.Tiering.Archive = archive
+	_, err = log.NewDistributedLog(dataDir, config)
+	require.Error(t, err)
+}
+
+func TestDistributedTopics(t *testing.T) {
+	var logs []*log.DistributedLog
+	var dirs []string
+	nodeCount := 2
+	ports := dynaport.Get(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-topics-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+		dirs = append(dirs, dataDir)
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Retention.CheckInterval = 10 * time.Millisecond
+
+		if i == 0 {
+			config.Raft.Bootstrap = true
+		}
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+
+		logs = append(logs, l)
+	}
+
+	config := &api.TopicConfig{
+		MaxStoreBytes:       32,
+		RetentionMaxRecords: 2,
+	}
+	require.NoError(t, logs[0].CreateTopic("orders", config))
+	require.Equal(t, api.ErrTopicExists{Topic: "orders"}, logs[0].CreateTopic("orders", nil))
+	require.Equal(t, api.ErrInvalidTopic{Topic: "../orders"}, logs[0].CreateTopic("../orders", nil))
+	_, err := logs[0].Topic("payments")
+	require.Equal(t, api.ErrUnknownTopic{Topic: "payments"}, err)
+
+	// every server has the topic
+	require.Eventually(t, func() bool {
+		topics, err := logs[1].ListTopics()
+		return err == nil && len(topics) == 1 &&
+			topics[0].Name == "orders" &&
+			topics[0].Config.RetentionMaxRecords == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the topic's offsets are its own
+	_, err = logs[0].Append(&api.Record{Value: []byte("default")})
+	require.NoError(t, err)
+	orders, err := logs[0].Topic("orders")
+	require.NoError(t, err)
+	var offs []uint64
+	for i := 0; i < 4; i++ {
+		off, err := orders.Append(&api.Record{Value: []byte("order")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+		offs = append(offs, off)
+	}
+
+	// the topic's retention removes its segments on every server
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			orders, err := l.Topic("orders")
+			if err != nil {
+				return false
+			}
+			if _, err := orders.Read(offs[1]); err == nil {
+				return false
+			}
+			if _, err := orders.Read(offs[2]); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+	record, err := logs[0].Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("default"), record.Value)
+
+	// a transaction ends in every topic it wrote to
+	id, err := logs[0].InitProducer()
+	require.NoError(t, err)
+	require.NoError(t, logs[0].BeginTxn(id))
+	_, err = logs[0].AppendIdempotent(id, 0, &api.Record{Value: []byte("default")})
+	require.NoError(t, err)
+	off, err := orders.AppendIdempotent(id, 1, &api.Record{Value: []byte("order")})
+	require.NoError(t, err)
+	_, err = orders.ReadCommitted(off)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	markers, err := logs[0].CommitTxn(id)
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"": 2, "orders": off + 1}, markers)
+	record, err = orders.ReadCommitted(off)
+	require.NoError(t, err)
+	require.Equal(t, id, record.ProducerId)
+
+	require.NoError(t, logs[0].DeleteTopic("orders"))
+	require.Equal(t, api.ErrUnknownTopic{Topic: "orders"}, logs[0].DeleteTopic("orders"))
+	_, err = orders.Append(&api.Record{Value: []byte("order")})
+	require.Equal(t, api.ErrUnknownTopic{Topic: "orders"}, err)
+	require.Eventually(t, func() bool {
+		topics, err := logs[1].ListTopics()
+		if err != nil || len(topics) != 0 {
+			return false
+		}
+		_, err = os.Stat(filepath.Join(dirs[1], "topics", "orders"))
+		return os.IsNotExist(err)
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestDistributedPartitions(t *testing.T) {
+	var logs []*log.DistributedLog
+	var dirs []string
+	var addrs []string
+	nodeCount := 3
+	ports := dynaport.Get(nodeCount)
+
+	start := func(i int) {
+		dataDir, err := ioutil.TempDir("", "distributed-partitions-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = os.RemoveAll(dataDir) })
+		dirs = append(dirs, dataDir)
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+		addrs = append(addrs, ln.Addr().String())
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Retention.CheckInterval = 10 * time.Millisecond
+
+		if i == 0 {
+			config.Raft.Bootstrap = true
+		}
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+
+		if i != 0 {
+			err = logs[0].Join(fmt.Sprintf("%d", i), addrs[i])
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+		logs = append(logs, l)
+	}
+	start(0)
+	start(1)
+
+	require.NoError(t, logs[0].CreateTopic("events", &api.TopicConfig{
+		Partitions: 3,
+	}))
+
+	// the partitions' leaders are spread over the servers, and each is
+	// written to through its leader once its raft group has one
+	leaders := func() []string {
+		topics, err := logs[0].ListTopics()
+		require.NoError(t, err)
+		var ids []string
+		for _, part := range topics[0].Partitions {
+			var id string
+			for _, r := range part.Replicas {
+				if r.IsLeader {
+					id = r.Id
+				}
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	require.Eventually(t, func() bool {
+		return reflect.DeepEqual([]string{"0", "1", "0"}, leaders())
+	}, 3*time.Second, 50*time.Millisecond)
+	leader := func(partition uint32) *log.Topic {
+		var id int
+		require.Eventually(t, func() bool {
+			n, err := strconv.Atoi(leaders()[partition])
+			id = n
+			return err == nil
+		}, 3*time.Second, 50*time.Millisecond)
+		p, err := logs[id].Partition("events", partition)
+		require.NoError(t, err)
+		return p
+	}
+	appendTo := func(partition uint32, record *api.Record) uint64 {
+		off, err := leader(partition).Append(record)
+		require.NoError(t, err)
+		return off
+	}
+	follower, err := logs[0].Partition("events", 1)
+	require.NoError(t, err)
+	_, err = follower.Append(&api.Record{Value: []byte("follower")})
+	require.Equal(t, api.ErrNotLeader{Leader: addrs[1]}, err)
+
+	// records with a key stay in its partition, and each partition has its
+	// own offsets
+	key := []byte("user-1")
+	p, err := logs[0].PartitionFor("events", api.Partitioner_PARTITIONER_DEFAULT, 0, key)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		got, err := logs[0].PartitionFor("events", api.Partitioner_PARTITIONER_HASH, 0, key)
+		require.NoError(t, err)
+		require.Equal(t, p, got)
+		off := appendTo(p, &api.Record{Key: key, Value: []byte("keyed")})
+		require.Equal(t, uint64(i), off)
+	}
+	other := (p + 1) % 3
+	require.Equal(t, uint64(0), appendTo(other, &api.Record{Value: []byte("other")}))
+
+	// records without a key go round robin
+	seen := make(map[uint32]bool)
+	for i := 0; i < 3; i++ {
+		got, err := logs[0].PartitionFor("events", api.Partitioner_PARTITIONER_DEFAULT, 0, nil)
+		require.NoError(t, err)
+		seen[got] = true
+	}
+	require.Equal(t, 3, len(seen))
+
+	// a batch goes to its keyed records' partition, and can't span two
+	got, err := logs[0].PartitionFor(
+		"events",
+		api.Partitioner_PARTITIONER_DEFAULT,
+		0,
+		nil, key, key,
+	)
+	require.NoError(t, err)
+	require.Equal(t, p, got)
+	var otherKey []byte
+	for i := 2; otherKey == nil; i++ {
+		k := []byte(fmt.Sprintf("user-%d", i))
+		got, err := logs[0].PartitionFor("events", api.Partitioner_PARTITIONER_HASH, 0, k)
+		require.NoError(t, err)
+		if got != p {
+			otherKey = k
+		}
+	}
+	_, err = logs[0].PartitionFor(
+		"events",
+		api.Partitioner_PARTITIONER_DEFAULT,
+		0,
+		key, otherKey,
+	)
+	require.IsType(t, api.ErrBatchPartitions{}, err)
+	// round robin picks once for the whole batch
+	_, err = logs[0].PartitionFor(
+		"events",
+		api.Partitioner_PARTITIONER_ROUND_ROBIN,
+		0,
+		key, otherKey,
+	)
+	require.NoError(t, err)
+
+	got, err = logs[0].PartitionFor("events", api.Partitioner_PARTITIONER_EXPLICIT, 2, key)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), got)
+	_, err = logs[0].PartitionFor("events", api.Partitioner_PARTITIONER_EXPLICIT, 3, key)
+	require.Equal(t, api.ErrUnknownPartition{Topic: "events", Partition: 3}, err)
+	_, err = logs[0].Partition("events", 3)
+	require.Equal(t, api.ErrUnknownPartition{Topic: "events", Partition: 3}, err)
+
+	// a server that joins later becomes a replica of every partition
+	start(2)
+	require.Eventually(t, func() bool {
+		part, err := logs[2].Partition("events", p)
+		if err != nil {
+			return false
+		}
+		record, err := part.Read(1)
+		return err == nil && string(record.Value) == "keyed"
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		topics, err := logs[0].ListTopics()
+		if err != nil || len(topics) != 1 || len(topics[0].Partitions) != 3 {
+			return false
+		}
+		for i, part := range topics[0].Partitions {
+			if part.Id != uint32(i) || len(part.Replicas) != nodeCount {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// a partition dedups its producers' requests on its own, and
+	// transactions don't write to partitions
+	id, err := logs[0].InitProducer()
+	require.NoError(t, err)
+	part := leader(other)
+	off, err := part.AppendIdempotent(id, 0, &api.Record{Value: []byte("once")})
+	require.NoError(t, err)
+	retried, err := part.AppendIdempotent(id, 0, &api.Record{Value: []byte("once")})
+	require.NoError(t, err)
+	require.Equal(t, off, retried)
+	require.NoError(t, logs[0].BeginTxn(id))
+	_, err = part.AppendIdempotent(id, 1, &api.Record{Value: []byte("txn")})
+	require.Equal(t, api.ErrTxnPartitioned{ProducerID: id, Topic: "events"}, err)
+	_, err = logs[0].AbortTxn(id)
+	require.NoError(t, err)
+
+	require.NoError(t, logs[0].DeleteTopic("events"))
+	_, err = part.Append(&api.Record{Value: []byte("gone")})
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		for i, l := range logs {
+			if _, err := l.Partition("events", 0); err == nil {
+				return false
+			}
+			_, err := os.Stat(filepath.Join(dirs[i], "partitions", "events"))
+			if !os.IsNotExist(err) {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+}
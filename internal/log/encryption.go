@@ -0,0 +1,325 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// KeyProvider supplies the AES keys store frames are encrypted with. A
+// segment is encrypted with the key that was current when it was created
+// and names it by ID in its header, so retired keys have to stay available
+// for as long as segments using them are kept.
+type KeyProvider interface {
+	// CurrentKey returns the key new segments are encrypted with.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// FileKeyring is a KeyProvider read from a file with a key on each line as
+// its ID and the hex encoded key separated by a space. The last key is the
+// current one, so a key is rotated in by appending it to the file. Blank
+// lines and lines starting with # are skipped.
+type FileKeyring struct {
+	path string
+
+	mu      sync.Mutex
+	keys    map[string][]byte
+	current string
+}
+
+func NewFileKeyring(path string) (*FileKeyring, error) {
+	k := &FileKeyring{path: path}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// load rereads the keyring file.
+func (k *FileKeyring) load() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys := make(map[string][]byte)
+	var current string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("log: malformed keyring line %q", line)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("log: key %q: %v", fields[0], err)
+		}
+		if _, err = aes.NewCipher(key); err != nil {
+			return fmt.Errorf("log: key %q: %v", fields[0], err)
+		}
+		keys[fields[0]] = key
+		current = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if current == "" {
+		return fmt.Errorf("log: keyring %s has no keys", k.path)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.current = current
+	return nil
+}
+
+// CurrentKey rereads the file, so a key appended to it is used by the
+// next segment created.
+func (k *FileKeyring) CurrentKey() (string, []byte, error) {
+	if err := k.load(); err != nil {
+		return "", nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *FileKeyring) Key(id string) ([]byte, error) {
+	k.mu.Lock()
+	key, ok := k.keys[id]
+	k.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	// the key may have been added since the file was read
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok = k.keys[id]; !ok {
+		return nil, fmt.Errorf("log: key %q not in keyring %s", id, k.path)
+	}
+	return key, nil
+}
+
+// snapshotMagic starts a snapshot sealed by sealedSnapshots, followed by
+// the length and the ID of the key it's sealed with.
+var snapshotMagic = []byte("dislog-snapshot\x00\x01")
+
+const (
+	// snapshotChunk is how much of a snapshot is sealed at once. Every
+	// chunk but the last is full, so the size of the snapshot follows
+	// from the size of the sealed one.
+	snapshotChunk = 64 * 1024
+	// chunkOverhead is what sealing adds to a chunk: its length, the
+	// nonce and the GCM tag.
+	chunkOverhead = 4 + 12 + 16
+)
+
+// sealedSnapshots is a raft snapshot store that seals the snapshots it
+// keeps with the keys' current key. The snapshots are sent to other nodes
+// as they're read, unsealed, so each node needs only its own keys.
+type sealedSnapshots struct {
+	raft.SnapshotStore
+	keys KeyProvider
+}
+
+func (s *sealedSnapshots) Create(
+	version raft.SnapshotVersion,
+	index, term uint64,
+	configuration raft.Configuration,
+	configurationIndex uint64,
+	trans raft.Transport,
+) (raft.SnapshotSink, error) {
+	id, key, err := s.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	sink, err := s.SnapshotStore.Create(
+		version,
+		index,
+		term,
+		configuration,
+		configurationIndex,
+		trans,
+	)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(snapshotMagic)+2, len(snapshotMagic)+2+len(id))
+	copy(header, snapshotMagic)
+	enc.PutUint16(header[len(snapshotMagic):], uint16(len(id)))
+	if _, err = sink.Write(append(header, id...)); err != nil {
+		_ = sink.Cancel()
+		return nil, err
+	}
+	return &sealedSink{SnapshotSink: sink, key: key}, nil
+}
+
+// Open returns the snapshot unsealed, with its meta giving its unsealed
+// size. Snapshots taken before encryption was enabled are returned as
+// they are.
+func (s *sealedSnapshots) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, rc, err := s.SnapshotStore.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &sealedReader{r: bufio.NewReader(rc), Closer: rc}
+	p, _ := r.r.Peek(len(snapshotMagic) + 2)
+	if !bytes.HasPrefix(p, snapshotMagic) {
+		return meta, r, nil
+	}
+	keyID := make([]byte, enc.Uint16(p[len(snapshotMagic):]))
+	if _, err = r.r.Discard(len(p)); err == nil {
+		_, err = io.ReadFull(r.r, keyID)
+	}
+	if err == nil {
+		r.key, err = s.keys.Key(string(keyID))
+	}
+	if err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	sealed := meta.Size - int64(len(p)+len(keyID))
+	chunks := (sealed + snapshotChunk + chunkOverhead - 1) /
+		(snapshotChunk + chunkOverhead)
+	unsealed := *meta
+	unsealed.Size = sealed - chunks*chunkOverhead
+	return &unsealed, r, nil
+}
+
+// sealedSink seals the snapshot written to it a chunk at a time.
+type sealedSink struct {
+	raft.SnapshotSink
+	key   []byte
+	chunk []byte
+}
+
+func (s *sealedSink) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := snapshotChunk - len(s.chunk)
+		if m > len(p) {
+			m = len(p)
+		}
+		s.chunk = append(s.chunk, p[:m]...)
+		p = p[m:]
+		if len(s.chunk) == snapshotChunk {
+			if err := s.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (s *sealedSink) flush() error {
+	p, err := seal(s.key, s.chunk)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	enc.PutUint32(header, uint32(len(p)))
+	if _, err = s.SnapshotSink.Write(append(header, p...)); err != nil {
+		return err
+	}
+	s.chunk = s.chunk[:0]
+	return nil
+}
+
+func (s *sealedSink) Close() error {
+	if len(s.chunk) > 0 {
+		if err := s.flush(); err != nil {
+			_ = s.SnapshotSink.Cancel()
+			return err
+		}
+	}
+	return s.SnapshotSink.Close()
+}
+
+// sealedReader unseals a sealed snapshot's chunks as they're read, or
+// reads a snapshot that isn't sealed as it is if it has no key.
+type sealedReader struct {
+	r *bufio.Reader
+	io.Closer
+	key   []byte
+	chunk []byte
+}
+
+func (r *sealedReader) Read(p []byte) (int, error) {
+	if r.key == nil {
+		return r.r.Read(p)
+	}
+	if len(r.chunk) == 0 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r.r, header); err != nil {
+			return 0, err
+		}
+		sealed := make([]byte, enc.Uint32(header))
+		if _, err := io.ReadFull(r.r, sealed); err != nil {
+			return 0, err
+		}
+		var err error
+		if r.chunk, err = unseal(r.key, sealed); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// seal encrypts p with AES-GCM, prefixing it with the random nonce.
+func seal(key, p []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(p)+gcm.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, p, nil), nil
+}
+
+func unseal(key, p []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	// a frame that fails authentication is as damaged as one that
+	// fails its checksum
+	if len(p) < gcm.NonceSize() {
+		return nil, errChecksum
+	}
+	nonce, p := p[:gcm.NonceSize()], p[gcm.NonceSize():]
+	if p, err = gcm.Open(nil, nonce, p, nil); err != nil {
+		return nil, errChecksum
+	}
+	return p, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -84,6 +85,32 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// Search returns the last entry whose relative offset is at or before off.
+// The record for off is in the frame at pos or in one of the frames after
+// it.
+func (i *index) Search(off uint32) (got uint32, pos uint64, ok bool) {
+	n := int(i.size / entWidth)
+	j := sort.Search(n, func(j int) bool {
+		got, _, _ := i.Read(int64(j))
+		return got > off
+	})
+	if j == 0 {
+		return 0, 0, false
+	}
+	got, pos, _ = i.Read(int64(j - 1))
+	return got, pos, true
+}
+
+// Sync commits the index's mapped entries to stable storage.
+func (i *index) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
+// reset drops every entry so the index can be rewritten from scratch.
+func (i *index) reset() {
+	i.size = 0
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
@@ -0,0 +1,342 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"go.uber.org/zap"
+)
+
+// errTornFrame is the error of a frame running past the end of the store,
+// the partly written tail opening the log drops.
+var errTornFrame = errors.New("log: frame runs past the end of the store")
+
+// Inspector opens the segments in a log's directory as they are on disk,
+// without the repairs opening a Log makes, so they can be examined and
+// repaired offline. It holds the directory's lock until it's closed.
+type Inspector struct {
+	Dir    string
+	Config Config
+	// BaseOffsets are the base offsets of the segments, in order.
+	BaseOffsets []uint64
+	// Orphans are the index files with no store, which opening the log
+	// removes.
+	Orphans []string
+
+	lock *os.File
+}
+
+func NewInspector(dir string, c Config) (*Inspector, error) {
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	baseOffsets, orphans, err := scanDir(dir, zap.L().Named("log"))
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return &Inspector{
+		Dir:         dir,
+		Config:      c,
+		BaseOffsets: baseOffsets,
+		Orphans:     orphans,
+		lock:        lock,
+	}, nil
+}
+
+// Close releases the directory's lock.
+func (i *Inspector) Close() error {
+	return i.lock.Close()
+}
+
+// SegmentReport describes a segment as it is on disk.
+type SegmentReport struct {
+	BaseOffset uint64
+	// NextOffset is the offset after the segment's last readable record.
+	NextOffset       uint64
+	StoreBytes       uint64
+	Frames           int
+	Records          int
+	IndexEntries     int
+	TimeIndexEntries int
+	// KeyID is the key an encrypted segment is sealed with.
+	KeyID string
+	// Repairs are what opening the segment in a log would repair. The
+	// time index is only checked when the index matches the store.
+	Repairs Recovery
+	// CorruptFrames are the positions of the frames that fail their
+	// checksum or don't decode.
+	CorruptFrames []uint64
+}
+
+// OK reports whether the segment is intact.
+func (r SegmentReport) OK() bool {
+	return !r.Repairs.repaired() && len(r.CorruptFrames) == 0
+}
+
+// Frame is one of the frames in a segment's store.
+type Frame struct {
+	Position uint64
+	// Bytes is the frame as it's stored, header included.
+	Bytes   []byte
+	Records []*api.Record
+	// Err is set when the frame is damaged or is the partly written tail.
+	Err error
+}
+
+// Inspect checks the segment with the given base offset against its
+// indexes without changing it.
+func (i *Inspector) Inspect(base uint64) (SegmentReport, error) {
+	r := SegmentReport{
+		BaseOffset: base,
+		NextOffset: base,
+		Repairs:    Recovery{BaseOffset: base},
+	}
+	s, positions, end, err := i.open(base)
+	if err != nil {
+		return r, err
+	}
+	defer s.store.Close()
+	r.StoreBytes = s.store.size
+	r.Frames = len(positions)
+	r.IndexEntries = int(s.index.size / entWidth)
+	r.TimeIndexEntries = int(s.timeIndex.size / tentWidth)
+	r.KeyID = s.keyID
+	r.Repairs.TruncatedBytes = s.store.size - end
+	for _, pos := range positions {
+		records, _, err := s.readFrame(pos)
+		if err != nil {
+			r.CorruptFrames = append(r.CorruptFrames, pos)
+			continue
+		}
+		r.Records += len(records)
+		if n := len(records); n > 0 && records[n-1].Offset >= r.NextOffset {
+			r.NextOffset = records[n-1].Offset + 1
+		}
+	}
+	r.Repairs.RebuiltIndex = !s.indexMatches(positions)
+	if !r.Repairs.RebuiltIndex {
+		s.setNextOffset(positions)
+		r.Repairs.RebuiltTimeIndex = !s.timeIndexMatches()
+	}
+	return r, nil
+}
+
+// Frames calls fn with each of the segment's frames in order, ending with
+// the partly written tail if there is one. The header frame is skipped.
+func (i *Inspector) Frames(base uint64, fn func(Frame) error) error {
+	s, positions, end, err := i.open(base)
+	if err != nil {
+		return err
+	}
+	defer s.store.Close()
+	for j, pos := range positions {
+		next := end
+		if j+1 < len(positions) {
+			next = positions[j+1]
+		}
+		f := Frame{Position: pos, Bytes: make([]byte, next-pos)}
+		if _, err = s.store.ReadAt(f.Bytes, int64(pos)); err != nil {
+			return err
+		}
+		f.Records, _, f.Err = s.readFrame(pos)
+		if err = fn(f); err != nil {
+			return err
+		}
+	}
+	if end == s.store.size {
+		return nil
+	}
+	f := Frame{
+		Position: end,
+		Bytes:    make([]byte, s.store.size-end),
+		Err:      errTornFrame,
+	}
+	if _, err = s.store.ReadAt(f.Bytes, int64(end)); err != nil {
+		return err
+	}
+	return fn(f)
+}
+
+// RebuildIndexes regenerates the segment's index and time index from its
+// store.
+func (i *Inspector) RebuildIndexes(base uint64) error {
+	r, err := i.Inspect(base)
+	if err != nil {
+		return err
+	}
+	// a damaged frame keeps an entry so reading it reports the damage
+	s, positions, _, err := i.openForRepair(base, uint64(r.Records+len(r.CorruptFrames)))
+	if err != nil {
+		return err
+	}
+	if err = s.rebuildIndex(positions); err != nil {
+		s.Close()
+		return err
+	}
+	if err = s.rebuildTimeIndex(positions); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
+// TruncateTail drops the segment's store from its first damaged frame, or
+// its partly written tail, on and rebuilds its indexes. It returns how many
+// bytes were dropped.
+func (i *Inspector) TruncateTail(base uint64) (uint64, error) {
+	r, err := i.Inspect(base)
+	if err != nil {
+		return 0, err
+	}
+	end := r.StoreBytes - r.Repairs.TruncatedBytes
+	if len(r.CorruptFrames) > 0 {
+		end = r.CorruptFrames[0]
+	}
+	if end == r.StoreBytes {
+		return 0, nil
+	}
+	s, _, _, err := i.openForRepair(base, 0)
+	if err != nil {
+		return 0, err
+	}
+	if err = s.store.truncate(end); err != nil {
+		s.Close()
+		return 0, err
+	}
+	if err = s.Close(); err != nil {
+		return 0, err
+	}
+	return r.StoreBytes - end, i.RebuildIndexes(base)
+}
+
+// open opens the segment to read it as it is on disk, without creating or
+// changing any of its files. Its indexes are read into memory rather than
+// mapped, since mapping them grows them, so only its store has to be
+// closed. It returns the positions of the store's record frames and where
+// the last complete frame ends.
+func (i *Inspector) open(base uint64) (*segment, []uint64, uint64, error) {
+	if err := i.check(base); err != nil {
+		return nil, nil, 0, err
+	}
+	f, err := os.Open(path.Join(i.Dir, fmt.Sprintf("%d%s", base, ".store")))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	s := &segment{baseOffset: base, nextOffset: base, config: i.Config}
+	if s.store, err = newStore(f); err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	if err = s.setupKey(); err != nil {
+		s.store.Close()
+		return nil, nil, 0, err
+	}
+	// a missing index reads as an empty one
+	b, err := i.readFile(base, ".index")
+	if err != nil {
+		s.store.Close()
+		return nil, nil, 0, err
+	}
+	s.index = &index{mmap: b, size: uint64(len(b))}
+	if b, err = i.readFile(base, ".timeindex"); err != nil {
+		s.store.Close()
+		return nil, nil, 0, err
+	}
+	s.timeIndex = &timeIndex{mmap: b, size: uint64(len(b))}
+	if off, pos, err := s.index.Read(-1); err == nil {
+		s.nextOffset = base + uint64(off) + 1
+		s.indexedPos = pos
+	}
+	positions, end, err := recordFrames(s)
+	if err != nil {
+		s.store.Close()
+		return nil, nil, 0, err
+	}
+	return s, positions, end, nil
+}
+
+// openForRepair opens the segment with its index mappings big enough for
+// entries index entries and for the index files as they are, which a log
+// would truncate to MaxIndexBytes. It returns the positions of the store's
+// record frames and where the last complete frame ends.
+func (i *Inspector) openForRepair(base, entries uint64) (*segment, []uint64, uint64, error) {
+	if err := i.check(base); err != nil {
+		return nil, nil, 0, err
+	}
+	c := i.Config
+	if n := entries * entWidth; n > c.Segment.MaxIndexBytes {
+		c.Segment.MaxIndexBytes = n
+	}
+	for _, ext := range []string{".index", ".timeindex"} {
+		fi, err := os.Stat(path.Join(i.Dir, fmt.Sprintf("%d%s", base, ext)))
+		if err == nil && uint64(fi.Size()) > c.Segment.MaxIndexBytes {
+			c.Segment.MaxIndexBytes = uint64(fi.Size())
+		}
+	}
+	s, err := newSegment(i.Dir, base, c)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	positions, end, err := recordFrames(s)
+	if err != nil {
+		s.Close()
+		return nil, nil, 0, err
+	}
+	return s, positions, end, nil
+}
+
+// check makes sure the directory has a segment with the base offset, in
+// a store layout the inspector reads.
+func (i *Inspector) check(base uint64) error {
+	found := false
+	for _, off := range i.BaseOffsets {
+		found = found || off == base
+	}
+	if !found {
+		return fmt.Errorf("log: no segment with base offset %d in %s", base, i.Dir)
+	}
+	legacy, err := legacyStore(path.Join(i.Dir, fmt.Sprintf("%d%s", base, ".store")))
+	if err != nil {
+		return err
+	}
+	if legacy {
+		return fmt.Errorf(
+			"log: segment %d is in the legacy store layout, opening the log migrates it",
+			base,
+		)
+	}
+	return nil
+}
+
+// readFile returns the contents of the segment's file with the extension,
+// nothing if there's no such file.
+func (i *Inspector) readFile(base uint64, ext string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path.Join(i.Dir, fmt.Sprintf("%d%s", base, ext)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// recordFrames returns the positions of the segment's record frames, which
+// follow its header, and where the last complete frame ends.
+func recordFrames(s *segment) ([]uint64, uint64, error) {
+	positions, end, _, err := s.store.scan()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(positions) > 0 {
+		// the header holds no records
+		positions = positions[1:]
+	}
+	return positions, end, nil
+}
@@ -0,0 +1,103 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspector-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	i, err := NewInspector(dir, c)
+	require.NoError(t, err)
+	// the log can't be opened while it's inspected
+	_, err = NewLog(dir, c)
+	require.True(t, errors.Is(err, ErrDirLocked))
+
+	require.Equal(t, []uint64{0}, i.BaseOffsets)
+	// inspecting a segment that isn't there fails without creating it
+	_, err = i.Inspect(5)
+	require.Error(t, err)
+	require.Error(t, i.Frames(5, func(Frame) error { return nil }))
+	_, err = os.Stat(filepath.Join(dir, "5.store"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "5.index"))
+	require.True(t, os.IsNotExist(err))
+
+	// nor does inspecting a segment change its files
+	before, err := ioutil.ReadFile(filepath.Join(dir, "0.index"))
+	require.NoError(t, err)
+	r, err := i.Inspect(0)
+	require.NoError(t, err)
+	require.True(t, r.OK())
+	require.Equal(t, uint64(5), r.NextOffset)
+	require.Equal(t, 5, r.Records)
+	require.Equal(t, 5, r.IndexEntries)
+	after, err := ioutil.ReadFile(filepath.Join(dir, "0.index"))
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	var positions []uint64
+	require.NoError(t, i.Frames(0, func(f Frame) error {
+		require.NoError(t, f.Err)
+		require.Equal(t, uint64(len(positions)), f.Records[0].Offset)
+		positions = append(positions, f.Position)
+		return nil
+	}))
+	require.Len(t, positions, 5)
+
+	// damage the fourth record and lose the index
+	f, err := os.OpenFile(filepath.Join(dir, "0.store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("x"), int64(positions[3]+headerWidth+2))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Truncate(filepath.Join(dir, "0.index"), 0))
+
+	r, err = i.Inspect(0)
+	require.NoError(t, err)
+	require.False(t, r.OK())
+	require.True(t, r.Repairs.RebuiltIndex)
+	require.Equal(t, []uint64{positions[3]}, r.CorruptFrames)
+
+	require.NoError(t, i.RebuildIndexes(0))
+	r, err = i.Inspect(0)
+	require.NoError(t, err)
+	require.False(t, r.Repairs.repaired())
+	require.Equal(t, 5, r.IndexEntries)
+
+	n, err := i.TruncateTail(0)
+	require.NoError(t, err)
+	require.Equal(t, r.StoreBytes-positions[3], n)
+	r, err = i.Inspect(0)
+	require.NoError(t, err)
+	require.True(t, r.OK())
+	require.Equal(t, uint64(3), r.NextOffset)
+	require.NoError(t, i.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Empty(t, log.Recoveries())
+	require.NoError(t, log.Close())
+}
@@ -0,0 +1,338 @@
+package log
+
+import (
+	"fmt"
+	"io"
+
+	api "github.com/halladj/dis-log/api/v1"
+)
+
+// readAhead is how much of the store an iterator reads at once.
+const readAhead = 64 * 1024
+
+// Iterator reads the log's records in offset order by walking the store
+// frames sequentially, so reading the next record doesn't need an index
+// lookup. It isn't safe for concurrent use.
+type Iterator struct {
+	log *Log
+	// off is the offset of the next record to return
+	off uint64
+	// seg and pos are where the next frame is read from
+	seg *segment
+	pos uint64
+	// records are the records left in the last frame read
+	records []*api.Record
+	// buf holds the store from bufPos on
+	buf    []byte
+	bufPos uint64
+	// truncations is the number of the latest of the log's truncations
+	// the iterator has accounted for
+	truncations uint64
+}
+
+// NewIterator returns an iterator starting at off.
+func (l *Log) NewIterator(off uint64) *Iterator {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return &Iterator{log: l, off: off, truncations: l.truncated}
+}
+
+// Next returns the record at the iterator's offset, or the first one after
+// it when the offset was compacted away, and moves past it. It returns
+// io.EOF once it has caught up with the log and can be called again when
+// more records are appended.
+func (it *Iterator) Next() (*api.Record, error) {
+	l := it.log
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for {
+		for len(it.records) > 0 {
+			record := it.records[0]
+			it.records = it.records[1:]
+			if record.Offset < it.off {
+				continue
+			}
+			it.off = record.Offset + 1
+			return record, nil
+		}
+		if it.truncations != l.truncated {
+			// the records from where the log was truncated may
+			// have been replaced, so go back for them
+			if lowest := l.lowestOffset(); it.truncations < l.dropped &&
+				it.off > lowest {
+				// from the first record for the truncations
+				// before it
+				it.off = lowest
+			}
+			for _, t := range l.truncations {
+				if t.n > it.truncations && it.off > t.off {
+					it.off = t.off
+				}
+			}
+			it.truncations = l.truncated
+			it.seg = nil
+		}
+		if it.seg == nil || it.seg.closed {
+			// the segment was removed or replaced by compaction
+			it.seek()
+		}
+		if it.seg == nil {
+			l.mu.RUnlock()
+			record, err := l.readArchived(it.off)
+			l.mu.RLock()
+			if _, ok := err.(api.ErrOffsetCompacted); ok {
+				it.off++
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			it.off = record.Offset + 1
+			return record, nil
+		}
+		pos := it.pos
+		frame, attrs, err := it.nextFrame()
+		if err == errChecksum {
+			return nil, api.ErrCorruptRecord{
+				Offset:   it.off,
+				Segment:  it.seg.baseOffset,
+				Position: pos,
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs&headerFrame != 0 {
+			continue
+		}
+		if it.records, err = it.seg.decodePayload(frame[headerWidth:], attrs); err != nil {
+			if err == errChecksum {
+				err = api.ErrCorruptRecord{
+					Offset:   it.off,
+					Segment:  it.seg.baseOffset,
+					Position: pos,
+				}
+			}
+			// read the frame again on the next call
+			it.pos, it.records = pos, nil
+			return nil, err
+		}
+	}
+}
+
+// seek positions the iterator at the frame holding its offset. It leaves
+// seg unset when the offset is before the segments on local disk.
+func (it *Iterator) seek() {
+	l := it.log
+	it.seg, it.records, it.buf = nil, nil, nil
+	if it.off < l.segments[0].baseOffset {
+		return
+	}
+	if it.seg = l.findSegment(it.off); it.seg == nil {
+		// past the end of the log, wait for it at the end of the store
+		it.seg, it.pos = l.activeSegment, l.activeSegment.store.size
+		return
+	}
+	var ok bool
+	if it.pos, ok = it.seg.seek(it.off); !ok {
+		it.pos = 0
+	}
+}
+
+// nextFrame returns the next frame in the log, header included, moving on
+// to the next segment at the end of a closed one. The frame is only valid
+// until the next call.
+func (it *Iterator) nextFrame() ([]byte, uint8, error) {
+	l := it.log
+	for it.pos >= it.seg.store.size {
+		if it.seg == l.activeSegment {
+			return nil, 0, io.EOF
+		}
+		var next *segment
+		for i, s := range l.segments {
+			if s == it.seg && i+1 < len(l.segments) {
+				next = l.segments[i+1]
+				break
+			}
+		}
+		if next == nil {
+			return nil, 0, io.EOF
+		}
+		it.seg, it.pos, it.buf = next, 0, nil
+	}
+	header, err := it.read(it.pos, headerWidth)
+	if err != nil {
+		return nil, 0, err
+	}
+	h := enc.Uint64(header[:lenWidth])
+	size := h & lenMask
+	if size > it.seg.store.size-it.pos-headerWidth {
+		return nil, 0, errChecksum
+	}
+	frame, err := it.read(it.pos, headerWidth+size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if checksum(frame[headerWidth:]) != enc.Uint32(frame[lenWidth:headerWidth]) {
+		return nil, 0, errChecksum
+	}
+	it.pos += headerWidth + size
+	return frame, uint8(h >> attrShift), nil
+}
+
+// read returns n bytes of the segment's store from pos, reading ahead so
+// the frames after it are usually already buffered.
+func (it *Iterator) read(pos, n uint64) ([]byte, error) {
+	if pos < it.bufPos || pos+n > it.bufPos+uint64(len(it.buf)) {
+		size := uint64(readAhead)
+		if size < n {
+			size = n
+		}
+		if rest := it.seg.store.size - pos; size > rest {
+			size = rest
+		}
+		if uint64(cap(it.buf)) < size {
+			it.buf = make([]byte, size)
+		}
+		it.buf = it.buf[:size]
+		if _, err := it.seg.store.ReadAt(it.buf, int64(pos)); err != nil && err != io.EOF {
+			it.buf = nil
+			return nil, err
+		}
+		it.bufPos = pos
+	}
+	off := pos - it.bufPos
+	return it.buf[off : off+n], nil
+}
+
+// CommittedIterator reads a topic's committed records for
+// read_committed consumers. It stops at the start of the earliest open
+// transaction, returning io.EOF until the transaction ends, and skips the
+// records of aborted transactions and the control records.
+type CommittedIterator struct {
+	it        *Iterator
+	topic     string
+	producers *producers
+	// held is a record read past the stable offset, returned once the
+	// transactions before it have ended
+	held *api.Record
+}
+
+// Next returns the next committed record and moves past it.
+func (c *CommittedIterator) Next() (*api.Record, error) {
+	for {
+		record := c.held
+		c.held = nil
+		if record == nil {
+			var err error
+			if record, err = c.it.Next(); err != nil {
+				return nil, err
+			}
+		}
+		if record.Offset >= c.producers.stableOffset(c.topic) {
+			c.held = record
+			return nil, io.EOF
+		}
+		if c.producers.committed(c.topic, record) {
+			return record, nil
+		}
+	}
+}
+
+// frameReader streams the store frames of the segments it has pinned, up
+// to end in the last one, decrypted.
+type frameReader struct {
+	it       *Iterator
+	segments []*segment
+	end      uint64
+	frame    []byte
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	if len(r.frame) == 0 {
+		l := r.it.log
+		l.mu.RLock()
+		var err error
+		r.frame, err = r.next()
+		l.mu.RUnlock()
+		if err == io.EOF {
+			if cerr := r.Close(); cerr != nil {
+				return 0, cerr
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.frame)
+	r.frame = r.frame[n:]
+	return n, nil
+}
+
+// next returns the next frame, moving on to the next segment at the end
+// of one.
+func (r *frameReader) next() ([]byte, error) {
+	it := r.it
+	if it.seg == nil && len(r.segments) > 0 {
+		it.seg = r.segments[0]
+	}
+	for i, s := range r.segments {
+		if s != it.seg {
+			continue
+		}
+		end := s.store.size
+		if i == len(r.segments)-1 && r.end < end {
+			// the records appended since the reader was made
+			end = r.end
+		}
+		if it.pos < end {
+			frame, attrs, err := it.nextFrame()
+			if err != nil {
+				return nil, err
+			}
+			return plainFrame(s, frame, attrs)
+		}
+		if i+1 < len(r.segments) {
+			it.seg, it.pos, it.buf = r.segments[i+1], 0, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// Close unpins the reader's segments.
+func (r *frameReader) Close() error {
+	l := r.it.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	for _, s := range r.segments {
+		if uerr := s.unpin(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	r.segments = nil
+	return err
+}
+
+// plainFrame returns the segment's frame with its encryption taken off.
+// Keys are local to each node, so snapshots carry the records in plaintext
+// and the node restoring one seals them with its own current key.
+func plainFrame(s *segment, frame []byte, attrs uint8) ([]byte, error) {
+	switch {
+	case attrs&headerFrame != 0:
+		return encodeFrame(storeMagic, headerFrame), nil
+	case attrs&encryptedFrame != 0:
+		if s.key == nil {
+			return nil, fmt.Errorf(
+				"log: segment %d has encrypted frames and no key",
+				s.baseOffset,
+			)
+		}
+		p, err := unseal(s.key, frame[headerWidth:])
+		if err != nil {
+			return nil, err
+		}
+		return encodeFrame(p, attrs&^encryptedFrame), nil
+	}
+	return frame, nil
+}
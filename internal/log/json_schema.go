@@ -0,0 +1,326 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is the subset of JSON Schema that records' values are
+// validated against: type, enum, properties, required,
+// additionalProperties, items, minimum, maximum, minLength, maxLength and
+// pattern. Like the spec has validators do, it ignores the keywords it
+// doesn't know.
+type jsonSchema struct {
+	// never is set by the false schema, which no value matches
+	never bool
+
+	Type                 jsonTypes              `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+func parseJSONSchema(definition []byte) (*jsonSchema, error) {
+	s := &jsonSchema{}
+	if err := json.Unmarshal(definition, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *jsonSchema) UnmarshalJSON(b []byte) error {
+	switch string(bytes.TrimSpace(b)) {
+	case "true":
+		return nil
+	case "false":
+		s.never = true
+		return nil
+	}
+	type plain jsonSchema
+	if err := json.Unmarshal(b, (*plain)(s)); err != nil {
+		return err
+	}
+	for _, t := range s.Type {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return fmt.Errorf("unknown type %q", t)
+		}
+	}
+	if s.Pattern != "" {
+		var err error
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonTypes is a schema's type keyword, a type or a list of them.
+type jsonTypes []string
+
+func (t *jsonTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = jsonTypes{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+// allows returns whether the types include t, integers being numbers.
+func (t jsonTypes) allows(typ string) bool {
+	for _, allowed := range t {
+		if allowed == typ || allowed == "number" && typ == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func (t jsonTypes) match(v interface{}) bool {
+	typ := jsonType(v)
+	if t.allows(typ) {
+		return true
+	}
+	n, ok := v.(float64)
+	return ok && t.allows("integer") && n == math.Trunc(n)
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		return "number"
+	}
+	return "string"
+}
+
+func (s *jsonSchema) validate(value []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return s.check(v, "$")
+}
+
+func (s *jsonSchema) check(v interface{}, path string) error {
+	if s.never {
+		return fmt.Errorf("%s: no value is allowed", path)
+	}
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		return fmt.Errorf(
+			"%s: want %s, got %s",
+			path,
+			strings.Join(s.Type, " or "),
+			jsonType(v),
+		)
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+		return fmt.Errorf("%s: not one of the enum's values", path)
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				prop = s.AdditionalProperties
+			}
+			if prop == nil {
+				continue
+			}
+			if err := prop.check(v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.Items == nil {
+			return nil
+		}
+		for i, item := range v {
+			if err := s.Items.check(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s: %v is less than the minimum %v", path, v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s: %v is more than the maximum %v", path, v, *s.Maximum)
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: shorter than %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: longer than %d characters", path, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: doesn't match the pattern %q", path, s.Pattern)
+		}
+	}
+	return nil
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jsonSchema) readable(writer schemaValidator) error {
+	w, ok := writer.(*jsonSchema)
+	if !ok {
+		return errSchemaTypeChanged
+	}
+	return s.readableAt(w, "$")
+}
+
+// readableAt returns why a value written with the writer's schema at the
+// path might not match this one. A property the writer's schema doesn't
+// declare is taken to be missing from what it writes, so adding optional
+// properties stays compatible.
+func (s *jsonSchema) readableAt(w *jsonSchema, path string) error {
+	if w.never {
+		return nil
+	}
+	if s.never {
+		return fmt.Errorf("%s: no longer allows any value", path)
+	}
+	if len(s.Type) > 0 {
+		if len(w.Type) == 0 {
+			return fmt.Errorf("%s: restricted to %s", path, strings.Join(s.Type, " or "))
+		}
+		for _, t := range w.Type {
+			if !s.Type.allows(t) {
+				return fmt.Errorf("%s: no longer allows %s", path, t)
+			}
+		}
+	}
+	if len(s.Enum) > 0 {
+		if len(w.Enum) == 0 {
+			return fmt.Errorf("%s: restricted to an enum", path)
+		}
+		for _, v := range w.Enum {
+			if !inEnum(s.Enum, v) {
+				return fmt.Errorf("%s: no longer allows the enum value %v", path, v)
+			}
+		}
+	}
+	if s.Minimum != nil && (w.Minimum == nil || *w.Minimum < *s.Minimum) {
+		return fmt.Errorf("%s: minimum raised to %v", path, *s.Minimum)
+	}
+	if s.Maximum != nil && (w.Maximum == nil || *w.Maximum > *s.Maximum) {
+		return fmt.Errorf("%s: maximum lowered to %v", path, *s.Maximum)
+	}
+	if s.MinLength != nil && (w.MinLength == nil || *w.MinLength < *s.MinLength) {
+		return fmt.Errorf("%s: minLength raised to %d", path, *s.MinLength)
+	}
+	if s.MaxLength != nil && (w.MaxLength == nil || *w.MaxLength > *s.MaxLength) {
+		return fmt.Errorf("%s: maxLength lowered to %d", path, *s.MaxLength)
+	}
+	if s.Pattern != "" && s.Pattern != w.Pattern {
+		return fmt.Errorf("%s: pattern changed to %q", path, s.Pattern)
+	}
+	for _, name := range s.Required {
+		if !contains(w.Required, name) {
+			return fmt.Errorf("%s: property %q became required", path, name)
+		}
+	}
+	for _, name := range sortedProperties(s.Properties) {
+		wp, ok := w.Properties[name]
+		if !ok {
+			wp = w.AdditionalProperties
+		}
+		if wp == nil {
+			continue
+		}
+		if err := s.Properties[name].readableAt(wp, path+"."+name); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil {
+		for _, name := range sortedProperties(w.Properties) {
+			if _, ok := s.Properties[name]; ok {
+				continue
+			}
+			err := s.AdditionalProperties.readableAt(w.Properties[name], path+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+		wa := w.AdditionalProperties
+		if wa == nil {
+			wa = &jsonSchema{}
+		}
+		if err := s.AdditionalProperties.readableAt(wa, path+".*"); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		wi := w.Items
+		if wi == nil {
+			wi = &jsonSchema{}
+		}
+		if err := s.Items.readableAt(wi, path+"[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedProperties(properties map[string]*jsonSchema) []string {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
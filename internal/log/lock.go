@@ -0,0 +1,11 @@
+package log
+
+import "errors"
+
+// lockFile is the file in a log's directory that the process with the log
+// open holds an advisory lock on, so two logs can't share a directory.
+const lockFile = ".lock"
+
+// ErrDirLocked is returned when opening a log whose directory another log
+// already has open.
+var ErrDirLocked = errors.New("log: directory is in use by another log")
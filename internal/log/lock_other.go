@@ -0,0 +1,18 @@
+//go:build !unix
+
+package log
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockDir only creates the lock file, there's no flock to take an advisory
+// lock with on this platform.
+func lockDir(dir string) (*os.File, error) {
+	return os.OpenFile(
+		filepath.Join(dir, lockFile),
+		os.O_RDWR|os.O_CREATE,
+		0644,
+	)
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockDir takes an exclusive lock on the directory's lock file, failing
+// rather than waiting if it's already held. Closing the file releases it.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(
+		filepath.Join(dir, lockFile),
+		os.O_RDWR|os.O_CREATE,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%w: %s", ErrDirLocked, dir)
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -9,18 +10,49 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/halladj/dis-log/api/v1"
+	"go.uber.org/zap"
 )
 
 type Log struct {
 	mu sync.RWMutex
+	// compactMu serializes compactions, which rewrite segments in the
+	// same directory
+	compactMu sync.Mutex
 
 	Dir    string
 	Config Config
 
+	// lock holds the directory's lock file open, and so locked, for as
+	// long as the log is open
+	lock *os.File
+
 	activeSegment *segment
 	segments      []*segment
+	recoveries    []Recovery
+	logger        *zap.Logger
+	reaper        *reaper
+	compactor     *reaper
+	syncer        *reaper
+	offloader     *reaper
+
+	// truncations are where TruncateFrom removed records from, so
+	// iterators know the records from there on may have been replaced.
+	// They're numbered, truncated is the latest number. Those before the
+	// log's first record are dropped, dropped is the latest number among
+	// them.
+	truncations []truncation
+	truncated   uint64
+	dropped     uint64
+
+	// archived are the segments only in the archive, older than every
+	// segment in segments. They're changed holding both mu and fetchMu,
+	// so reading them takes either.
+	archived []archivedSegment
+	fetchMu  sync.Mutex
+	fetched  []*segment
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -33,92 +65,427 @@ func NewLog(dir string, c Config) (*Log, error) {
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		logger: zap.L().Named("log"),
 	}
-
-	return l, l.setup()
+	if err := l.setup(); err != nil {
+		return nil, err
+	}
+	l.setupReapers()
+	return l, nil
 }
 
-func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+func (l *Log) setup() (err error) {
+	// Reset removes the directory before setting the log up again
+	if err = os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	if l.lock, err = lockDir(l.Dir); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			l.unlock()
+		}
+	}()
+	baseOffsets, orphans, err := scanDir(l.Dir, l.logger)
 	if err != nil {
 		return err
 	}
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
+	// every segment has a store file, indexes without one were left
+	// behind by a removed segment and a new segment with the same base
+	// offset would pick them up
+	for _, name := range orphans {
+		l.logger.Warn(
+			"removing index without a store",
+			zap.String("dir", l.Dir),
+			zap.String("file", name),
 		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
+		if err = os.Remove(path.Join(l.Dir, name)); err != nil {
+			return err
+		}
 	}
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
+	l.segments, l.activeSegment = nil, nil
+	l.recoveries = nil
 	for i := 0; i < len(baseOffsets); i++ {
+		migrated, err := migrateStore(l.Dir, baseOffsets[i], l.logger)
+		if err != nil {
+			return err
+		}
 		if err = l.newSegment(baseOffsets[i]); err != nil {
 			return err
 		}
-		// baseOffset contains dup for index and store so we skip
-		// the dup
-		i++
+		if err = l.recover(l.activeSegment, migrated); err != nil {
+			return err
+		}
+	}
+	// compaction may have removed the last records of a closed segment,
+	// which still owns the offsets up to the next segment
+	for i := 0; i < len(l.segments)-1; i++ {
+		if next := l.segments[i+1].baseOffset; l.segments[i].nextOffset < next {
+			l.segments[i].nextOffset = next
+		}
+	}
+	if err = l.setupArchive(); err != nil {
+		return err
 	}
 	if l.segments == nil {
-		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+		off := l.Config.Segment.InitialOffset
+		if n := len(l.archived); n > 0 {
+			off = l.archived[n-1].nextOffset
+		}
+		if err = l.newSegment(off); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// scanDir returns the base offsets of the segments in dir, in order, and
+// the names of the index files with no store. Files that aren't segment
+// files are logged and skipped.
+func scanDir(dir string, logger *zap.Logger) ([]uint64, []string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var baseOffsets []uint64
+	indexes := make(map[string]uint64)
+	for _, file := range files {
+		switch file.Name() {
+		case lockFile, compactDir, fetchDir, firstIndexFile:
+			continue
+		}
+		ext := path.Ext(file.Name())
+		base := strings.TrimSuffix(file.Name(), ext)
+		off, err := strconv.ParseUint(base, 10, 0)
+		if file.IsDir() || err != nil || strconv.FormatUint(off, 10) != base ||
+			(ext != ".store" && ext != ".index" && ext != ".timeindex") {
+			logger.Warn(
+				"ignoring unknown file",
+				zap.String("dir", dir),
+				zap.String("file", file.Name()),
+			)
+			continue
+		}
+		if ext == ".store" {
+			baseOffsets = append(baseOffsets, off)
+		} else {
+			indexes[file.Name()] = off
+		}
+	}
+	stores := make(map[uint64]bool)
+	for _, off := range baseOffsets {
+		stores[off] = true
+	}
+	var orphans []string
+	for name, off := range indexes {
+		if !stores[off] {
+			orphans = append(orphans, name)
+		}
+	}
+	sort.Strings(orphans)
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	return baseOffsets, orphans, nil
+}
+
+// unlock releases the directory's lock.
+func (l *Log) unlock() error {
+	if l.lock == nil {
+		return nil
+	}
+	err := l.lock.Close()
+	l.lock = nil
+	return err
+}
+
+func (l *Log) setupReapers() {
+	if l.Config.Retention.enabled() {
+		l.reaper = newReaper(l.Config.Retention.CheckInterval, func() {
+			if err := l.Retain(); err != nil {
+				l.logger.Error(
+					"failed to enforce retention",
+					zap.String("dir", l.Dir),
+					zap.Error(err),
+				)
+			}
+		})
+	}
+	if l.Config.Compaction.Enabled {
+		l.compactor = newReaper(l.Config.Compaction.CheckInterval, func() {
+			if err := l.Compact(); err != nil {
+				l.logger.Error(
+					"failed to compact",
+					zap.String("dir", l.Dir),
+					zap.Error(err),
+				)
+			}
+		})
+	}
+	if l.Config.Tiering.Archive != nil {
+		l.offloader = newReaper(l.Config.Tiering.HotRetention.CheckInterval, func() {
+			if err := l.Offload(); err != nil {
+				l.logger.Error(
+					"failed to offload",
+					zap.String("dir", l.Dir),
+					zap.Error(err),
+				)
+			}
+		})
+	}
+	if l.Config.Durability.Sync == SyncInterval {
+		interval := l.Config.Durability.Interval
+		if interval == 0 {
+			interval = defaultSyncInterval
+		}
+		l.syncer = newReaper(interval, func() {
+			if err := l.Sync(); err != nil {
+				l.logger.Error(
+					"failed to sync",
+					zap.String("dir", l.Dir),
+					zap.Error(err),
+				)
+			}
+		})
+	}
+}
+
+// recover repairs the segment after an unclean shutdown, or after its
+// store was migrated from the legacy layout.
+func (l *Log) recover(s *segment, migrated bool) error {
+	r, err := s.recover()
+	if err != nil {
+		return err
+	}
+	r.Migrated = migrated
+	if !r.repaired() {
+		return nil
+	}
+	l.logger.Warn(
+		"recovered segment",
+		zap.String("dir", l.Dir),
+		zap.Uint64("base_offset", r.BaseOffset),
+		zap.Uint64("truncated_bytes", r.TruncatedBytes),
+		zap.Bool("rebuilt_index", r.RebuiltIndex),
+		zap.Bool("rebuilt_time_index", r.RebuiltTimeIndex),
+		zap.Bool("migrated", r.Migrated),
+	)
+	l.recoveries = append(l.recoveries, r)
+	return nil
+}
+
+// Recoveries returns the repairs made to the log's segments when it was
+// last opened.
+func (l *Log) Recoveries() []Recovery {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.recoveries
+}
+
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.append(record)
+}
+
+// appendAt appends a record at the offset it already has, skipping the
+// offsets before it. It's used to restore compacted records.
+func (l *Log) appendAt(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if record.Offset > l.activeSegment.nextOffset {
+		l.activeSegment.nextOffset = record.Offset
+	}
+	return l.append(record)
+}
+
+func (l *Log) append(record *api.Record) (uint64, error) {
+	if record.AppendTime == 0 {
+		record.AppendTime = time.Now().UnixNano()
+	}
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
+	if err = l.syncAppend(); err != nil {
+		return 0, err
+	}
 	if l.activeSegment.IsMaxed() {
 		err = l.newSegment(off + 1)
 	}
 	return off, err
 }
 
+// AppendBatch appends the records under a single lock acquisition and
+// returns their offsets. Records are written to the store in as few frames
+// as the active segment's index allows.
+func (l *Log) AppendBatch(records []*api.Record) ([]uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		if record.AppendTime == 0 {
+			record.AppendTime = now
+		}
+	}
+	offsets := make([]uint64, 0, len(records))
+	for len(records) > 0 {
+		n := l.activeSegment.capacity()
+		if n == 0 {
+			if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if n > len(records) {
+			n = len(records)
+		}
+		off, err := l.activeSegment.AppendBatch(records[:n])
+		if err != nil {
+			return nil, err
+		}
+		if err = l.syncAppend(); err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			offsets = append(offsets, off+uint64(i))
+		}
+		records = records[n:]
+		if l.activeSegment.IsMaxed() {
+			if err = l.newSegment(off + uint64(n)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// syncAppend syncs the active segment when every append must be durable
+// before it's acknowledged.
+func (l *Log) syncAppend() error {
+	if l.Config.Durability.Sync != SyncEveryAppend {
+		return nil
+	}
+	return l.activeSegment.Sync()
+}
+
+// Sync commits every record appended so far to stable storage.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.segments {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
-	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
-		}
+	s := l.findSegment(off)
+	if s == nil && len(l.archived) > 0 && off < l.segments[0].baseOffset {
+		// fetching an archived segment can be slow, so it's done
+		// without the lock
+		l.mu.RUnlock()
+		return l.readArchived(off)
 	}
-	if s == nil || s.nextOffset <= off {
+	defer l.mu.RUnlock()
+	if s == nil {
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
 	return s.Read(off)
 }
 
+// findSegment returns the local segment holding off, or nil if there isn't
+// one. The segments are ordered by offset, so it's a binary search.
+func (l *Log) findSegment(off uint64) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return off < l.segments[i].nextOffset
+	})
+	if i == len(l.segments) || off < l.segments[i].baseOffset {
+		return nil
+	}
+	return l.segments[i]
+}
+
+// OffsetForTime returns the first offset appended at or after t. If every
+// record in the log is older than t it returns the offset the next
+// appended record will get.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	ts := t.UnixNano()
+	for _, s := range l.segments {
+		if off, ok := s.OffsetForTime(ts); ok {
+			return off, nil
+		}
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
+// RotateKey starts a new segment so records appended from now on are
+// encrypted with the key provider's current key. Older segments stay
+// readable with the keys named in their headers.
+func (l *Log) RotateKey() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.activeSegment.store.size == 0 {
+		// nothing's been written with the old key yet
+		return l.activeSegment.setupKey()
+	}
+	return l.newSegment(l.activeSegment.nextOffset)
+}
+
 func (l *Log) newSegment(off uint64) error {
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
 	}
+	if l.Config.Durability.Sync != SyncOS {
+		// the new files are only durable once the directory is
+		if err = syncDir(l.Dir); err != nil {
+			return err
+		}
+	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
 	return nil
 }
 
 func (l *Log) Close() error {
+	// stop the reapers before taking the lock since they may be waiting
+	// on it
+	l.reaper.stop()
+	l.reaper = nil
+	l.compactor.stop()
+	l.compactor = nil
+	l.syncer.stop()
+	l.syncer = nil
+	l.offloader.stop()
+	l.offloader = nil
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+	for _, segment := range l.fetched {
+		if err := segment.Close(); err != nil {
+			return err
+		}
+	}
+	l.fetched = nil
 	for _, segment := range l.segments {
+		if l.Config.Durability.Sync != SyncOS {
+			if err := segment.Sync(); err != nil {
+				return err
+			}
+		}
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
-	return nil
+	return l.unlock()
 }
 
 func (l *Log) Remove() error {
@@ -132,13 +499,27 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
-	return l.setup()
+	if err := l.setup(); err != nil {
+		return err
+	}
+	l.setupReapers()
+	return nil
 }
 
+// LowestOffset returns the lowest offset in the log, including the
+// archived segments.
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	return l.segments[0].baseOffset, nil
+	return l.lowestOffset(), nil
+}
+
+// lowestOffset returns the lowest offset in the log. l.mu must be held.
+func (l *Log) lowestOffset() uint64 {
+	if len(l.archived) > 0 {
+		return l.archived[0].baseOffset
+	}
+	return l.segments[0].baseOffset
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
@@ -151,40 +532,161 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// nextOffset returns the offset the next record is appended at.
+func (l *Log) nextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.segments[len(l.segments)-1].nextOffset
+}
+
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.truncateArchived(lowest); err != nil {
+		return err
+	}
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		// the active segment is never removed, the log always needs
+		// somewhere to append to
+		if s.nextOffset <= lowest+1 && s != l.activeSegment {
 			if err := s.Remove(); err != nil {
 				return err
 			}
+			l.logger.Info(
+				"removed segment",
+				zap.String("dir", l.Dir),
+				zap.Uint64("base_offset", s.baseOffset),
+				zap.Uint64("next_offset", s.nextOffset),
+			)
 			continue
 		}
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	l.dropTruncations()
 	return nil
 }
 
-func (l *Log) Reader() io.Reader {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	readers := make([]io.Reader, len(l.segments))
-	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+// truncation is where TruncateFrom removed records from.
+type truncation struct {
+	n, off uint64
+}
+
+// dropTruncations forgets the truncations before the log's first record.
+// Iterators that missed them go back to the first record instead.
+func (l *Log) dropTruncations() {
+	lowest := l.lowestOffset()
+	kept := l.truncations[:0]
+	for _, t := range l.truncations {
+		if t.off >= lowest {
+			kept = append(kept, t)
+		} else if t.n > l.dropped {
+			l.dropped = t.n
+		}
 	}
-	return io.MultiReader(readers...)
+	l.truncations = kept
 }
 
-type originReader struct {
-	*store
-	off int64
+// TruncateFrom removes the records at off and after it, so the next record
+// appended gets off. Raft uses it to drop the entries a new leader has
+// replaced. Archived records can't be removed.
+func (l *Log) TruncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if off >= l.activeSegment.nextOffset {
+		return nil
+	}
+	if len(l.archived) > 0 && off < l.segments[0].baseOffset {
+		return fmt.Errorf("log: can't truncate archived offsets from %d", off)
+	}
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset < off {
+			segments = append(segments, s)
+			continue
+		}
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.logger.Info(
+			"removed segment",
+			zap.String("dir", l.Dir),
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Uint64("next_offset", s.nextOffset),
+		)
+	}
+	l.segments = segments
+	l.truncated++
+	l.truncations = append(l.truncations, truncation{n: l.truncated, off: off})
+	if len(segments) == 0 {
+		return l.newSegment(off)
+	}
+	l.activeSegment = segments[len(segments)-1]
+	if l.activeSegment.nextOffset <= off {
+		return nil
+	}
+	if err := l.activeSegment.truncateFrom(off); err != nil {
+		return err
+	}
+	return l.syncAppend()
 }
 
-func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
-	o.off += int64(n)
-	return n, err
+// resetTo removes every record so the next record appended gets off, which
+// can be past the offsets the log had. Raft uses it to move its log past a
+// snapshot. Archived records can't be removed.
+func (l *Log) resetTo(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.archived) > 0 {
+		return fmt.Errorf("log: can't reset a log with archived offsets")
+	}
+	for _, s := range l.segments {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.logger.Info(
+			"removed segment",
+			zap.String("dir", l.Dir),
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Uint64("next_offset", s.nextOffset),
+		)
+	}
+	l.segments = nil
+	if err := l.newSegment(off); err != nil {
+		return err
+	}
+	l.dropTruncations()
+	return nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Reader streams the store frames of the segments on local disk, in the
+// layout they have on disk but decrypted, up to the end of the log when
+// it's called.
+// The segments are pinned until the reader reaches the end or is closed,
+// so retention and compaction don't remove them from under it.
+func (l *Log) Reader() io.ReadCloser {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segments := append([]*segment(nil), l.segments...)
+	for _, s := range segments {
+		s.readers++
+	}
+	return &frameReader{
+		it:       &Iterator{log: l},
+		segments: segments,
+		end:      l.activeSegment.store.size,
+	}
 }
@@ -1,9 +1,15 @@
 package log
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	api "github.com/halladj/dis-log/api/v1"
 	"github.com/stretchr/testify/require"
@@ -19,6 +25,22 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"corrupt record error":              testCorruptRecordErr,
+		"recover after crash":               testRecoverAfterCrash,
+		"offset for time":                   testOffsetForTime,
+		"retention":                         testRetention,
+		"compaction":                        testCompaction,
+		"append batch":                      testAppendBatch,
+		"durability":                        testDurability,
+		"sparse index":                      testSparseIndex,
+		"tiering":                           testTiering,
+		"encryption":                        testEncryption,
+		"iterator":                          testIterator,
+		"directory lock":                    testDirLock,
+		"stray files":                       testStrayFiles,
+		"truncate from":                     testTruncateFrom,
+		"legacy store":                      testLegacyStore,
+		"damaged store":                     testDamagedStore,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -37,7 +59,9 @@ func TestLog(t *testing.T) {
 
 func testAppendRead(t *testing.T, log *Log) {
 	append := &api.Record{
-		Value: []byte("hello world"),
+		Value:      []byte("hello world"),
+		CreateTime: 1,
+		Headers:    map[string]string{"content-type": "text/plain"},
 	}
 	off, err := log.Append(append)
 	require.NoError(t, err)
@@ -46,6 +70,8 @@ func testAppendRead(t *testing.T, log *Log) {
 	read, err := log.Read(off)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
+	require.Equal(t, append.CreateTime, read.CreateTime)
+	require.Equal(t, append.Headers, read.Headers)
 
 }
 
@@ -96,8 +122,10 @@ func testReader(t *testing.T, log *Log) {
 	b, err := ioutil.ReadAll(reader)
 	require.NoError(t, err)
 
+	// the store starts with its header frame
+	header := headerWidth + uint64(len(storeMagic))
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[header+headerWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 }
@@ -117,3 +145,936 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testCorruptRecordErr(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+
+	_, err = log.Read(off)
+	require.NoError(t, err)
+
+	s := segmentFor(t, log, off)
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	require.NoError(t, err)
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0}, int64(pos+headerWidth+1))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	read, err := log.Read(off)
+	require.Nil(t, read)
+	require.Equal(t, api.ErrCorruptRecord{
+		Offset:   off,
+		Segment:  s.baseOffset,
+		Position: pos,
+	}, err)
+}
+
+func testRecoverAfterCrash(t *testing.T, o *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.Close())
+	require.Empty(t, o.Recoveries())
+
+	// simulate a crash: the last segment's index was never written
+	// back and its store ends with half a frame, and an older segment's
+	// index still has the zero-filled tail newIndex grows it to
+	last := segmentFor(t, o, 2)
+	require.NoError(t, os.Remove(last.index.Name()))
+	f, err := os.OpenFile(last.store.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 42, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Truncate(
+		o.segments[0].index.Name(),
+		int64(o.Config.Segment.MaxIndexBytes),
+	))
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+
+	require.Equal(t, []Recovery{{
+		BaseOffset:   o.segments[0].baseOffset,
+		RebuiltIndex: true,
+	}, {
+		BaseOffset:     last.baseOffset,
+		TruncatedBytes: 10,
+		RebuiltIndex:   true,
+	}}, n.Recoveries())
+
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	for i := uint64(0); i <= off; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, append.Value, read.Value)
+		require.Equal(t, i, read.Offset)
+	}
+
+	off, err = n.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func testLegacyStore(t *testing.T, o *Log) {
+	require.NoError(t, o.Close())
+	// the layout stores had before frames had attributes and checksums:
+	// a bare length before each record, ending with a torn length
+	var store, index []byte
+	for i := uint64(0); i < 3; i++ {
+		p, err := proto.Marshal(&api.Record{
+			Value:  []byte("hello world"),
+			Offset: i,
+		})
+		require.NoError(t, err)
+		entry := make([]byte, entWidth)
+		enc.PutUint32(entry, uint32(i))
+		enc.PutUint64(entry[offWidth:], uint64(len(store)))
+		index = append(index, entry...)
+		store = enc.AppendUint64(store, uint64(len(p)))
+		store = append(store, p...)
+	}
+	store = append(store, 0, 0, 0)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(o.Dir, "0.store"), store, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(o.Dir, "0.index"), index, 0644))
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.Equal(t, []Recovery{{
+		RebuiltIndex: true,
+		Migrated:     true,
+	}}, n.Recoveries())
+	for i := uint64(0); i < 3; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), read.Value)
+		require.Equal(t, i, read.Offset)
+	}
+	off, err := n.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, n.Close())
+
+	n, err = NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.Empty(t, n.Recoveries())
+	require.NoError(t, n.Close())
+
+	// a store in neither layout isn't opened
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(o.Dir, "0.store"),
+		[]byte{batchFrame, 0, 0, 0, 0, 0, 0, 1, 0},
+		0644,
+	))
+	_, err = NewLog(o.Dir, o.Config)
+	require.Error(t, err)
+}
+
+func testDamagedStore(t *testing.T, o *Log) {
+	o.Config.Segment.MaxStoreBytes = 1024
+	require.NoError(t, o.Close())
+	require.NoError(t, os.RemoveAll(o.Dir))
+	o, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.Close())
+
+	// a length in the middle of the store pointing past its end isn't
+	// taken for a torn tail
+	_, pos, err := o.segments[0].index.Read(1)
+	require.NoError(t, err)
+	f, err := os.OpenFile(o.segments[0].store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0, 0, 0, 0, 0, 0, 1, 0}, int64(pos))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = NewLog(o.Dir, o.Config)
+	require.Error(t, err)
+
+	// unless the log is opened to repair it
+	o.Config.Segment.Repair = true
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.NoError(t, n.Close())
+}
+
+func testOffsetForTime(t *testing.T, log *Log) {
+	start := time.Unix(0, 1000)
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{
+			Value:      []byte("hello world"),
+			AppendTime: start.Add(time.Duration(i) * time.Second).UnixNano(),
+		})
+		require.NoError(t, err)
+	}
+	// a record stamped by a clock that went backwards
+	_, err := log.Append(&api.Record{
+		Value:      []byte("hello world"),
+		AppendTime: start.UnixNano(),
+	})
+	require.NoError(t, err)
+
+	for in, want := range map[time.Duration]uint64{
+		-time.Second:      0,
+		0:                 0,
+		time.Nanosecond:   1,
+		2 * time.Second:   2,
+		3 * time.Second:   3,
+		3*time.Second + 1: 5,
+	} {
+		off, err := log.OffsetForTime(start.Add(in))
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+	}
+
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.Empty(t, n.Recoveries())
+	off, err := n.OffsetForTime(start.Add(2 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	// a lost time index is rebuilt from the records
+	require.NoError(t, n.Close())
+	require.NoError(t, os.Remove(segmentFor(t, n, 3).timeIndex.Name()))
+	n, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.Len(t, n.Recoveries(), 1)
+	require.True(t, n.Recoveries()[0].RebuiltTimeIndex)
+	off, err = n.OffsetForTime(start.Add(3 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func segmentFor(t *testing.T, log *Log, off uint64) *segment {
+	t.Helper()
+	for _, s := range log.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return s
+		}
+	}
+	t.Fatalf("no segment holds offset %d", off)
+	return nil
+}
+
+func testRetention(t *testing.T, o *Log) {
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		_, err := o.Append(&api.Record{
+			Value:      []byte("hello world"),
+			AppendTime: start.Add(time.Duration(i) * time.Minute).UnixNano(),
+		})
+		require.NoError(t, err)
+	}
+	// every record fills its own segment, leaving an empty active one
+	require.Len(t, o.segments, 5)
+	size := o.segments[0].store.size
+	now := start.Add(10 * time.Minute)
+
+	_, ok := o.RetentionOffset(Retention{}, now)
+	require.False(t, ok)
+
+	for name, tc := range map[string]struct {
+		r      Retention
+		lowest uint64
+		ok     bool
+	}{
+		"max records":  {Retention{MaxRecords: 2}, 1, true},
+		"max bytes":    {Retention{MaxBytes: size*3 - 1}, 1, true},
+		"max age":      {Retention{MaxAge: 8 * time.Minute}, 1, true},
+		"within limit": {Retention{MaxRecords: 4, MaxAge: time.Hour}, 0, false},
+		"never active": {Retention{MaxRecords: 1, MaxAge: time.Second}, 3, true},
+	} {
+		lowest, ok := o.RetentionOffset(tc.r, now)
+		require.Equal(t, tc.ok, ok, name)
+		require.Equal(t, tc.lowest, lowest, name)
+	}
+
+	require.NoError(t, o.Close())
+	c := o.Config
+	c.Retention.MaxRecords = 2
+	c.Retention.CheckInterval = time.Millisecond
+	n, err := NewLog(o.Dir, c)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Eventually(t, func() bool {
+		off, err := n.LowestOffset()
+		return err == nil && off == 2
+	}, time.Second, 10*time.Millisecond)
+	_, err = n.Read(1)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	read, err := n.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), read.Offset)
+}
+
+func testCompaction(t *testing.T, o *Log) {
+	require.NoError(t, o.Close())
+	c := o.Config
+	c.Segment.MaxStoreBytes = 90
+	c.Compaction.TombstoneRetention = time.Hour
+	log, err := NewLog(o.Dir, c)
+	require.NoError(t, err)
+
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("first")},
+		{Key: []byte("b"), Value: []byte("first")},
+		{Key: []byte("a"), Value: []byte("second")},
+		{Value: []byte("no key")},
+		{Key: []byte("b")},
+		{Key: []byte("c"), Value: []byte("first")},
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	// three records per segment, leaving an empty active one
+	require.Len(t, log.segments, 3)
+
+	require.NoError(t, log.Compact())
+	for off, compacted := range []bool{true, true, false, false, false, false} {
+		read, err := log.Read(uint64(off))
+		if compacted {
+			require.Equal(t, api.ErrOffsetCompacted{Offset: uint64(off)}, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, records[off].Value, read.Value)
+		require.Equal(t, uint64(off), read.Offset)
+	}
+
+	// a reopened log still owns the compacted offsets
+	require.NoError(t, log.Close())
+	log, err = NewLog(o.Dir, c)
+	require.NoError(t, err)
+	require.Empty(t, log.Recoveries())
+	_, err = log.Read(1)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: 1}, err)
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	off, err = log.Append(&api.Record{Key: []byte("a")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+
+	// expired tombstones go, along with what they deleted
+	log.Config.Compaction.TombstoneRetention = 0
+	require.NoError(t, log.Compact())
+	for _, off := range []uint64{2, 4} {
+		_, err = log.Read(off)
+		require.Equal(t, api.ErrOffsetCompacted{Offset: off}, err)
+	}
+	read, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), read.Key)
+
+	// appends carry on while segments are compacted, which never
+	// removes the newest record for a key
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 50; i++ {
+			if _, err := log.Append(&api.Record{
+				Key:   []byte("d"),
+				Value: []byte{byte(i)},
+			}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, log.Compact())
+	}
+	require.NoError(t, <-done)
+	require.NoError(t, log.Compact())
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	read, err = log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte{49}, read.Value)
+	_, err = log.Read(off - 1)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: off - 1}, err)
+	require.NoError(t, log.Close())
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	// one record fills a segment's index so the batch spans segments
+	c := log.Config
+	c.Segment.MaxIndexBytes = entWidth
+	require.NoError(t, log.Close())
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}
+	offsets, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offsets)
+	require.Equal(t, 4, len(log.segments))
+
+	for i, off := range offsets {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, records[i].Value, read.Value)
+		require.Equal(t, off, read.Offset)
+		require.NotZero(t, read.AppendTime)
+	}
+}
+
+func testDurability(t *testing.T, o *Log) {
+	require.NoError(t, o.Close())
+	onDisk := func(log *Log) uint64 {
+		fi, err := os.Stat(log.activeSegment.store.Name())
+		require.NoError(t, err)
+		return uint64(fi.Size())
+	}
+	record := &api.Record{Value: []byte("hello world")}
+
+	c := o.Config
+	// keep every record in the active segment
+	c.Segment.MaxStoreBytes = 1024
+	c.Durability = Durability{Sync: SyncEveryAppend}
+	log, err := NewLog(o.Dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, log.activeSegment.store.size, onDisk(log))
+	require.False(t, log.activeSegment.dirty)
+	require.NoError(t, log.Close())
+
+	c.Durability = Durability{
+		Sync:     SyncInterval,
+		Interval: 10 * time.Millisecond,
+	}
+	log, err = NewLog(o.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	size := log.activeSegment.store.size
+	require.Eventually(t, func() bool {
+		return onDisk(log) == size
+	}, time.Second, 10*time.Millisecond)
+}
+
+func testSparseIndex(t *testing.T, o *Log) {
+	start := time.Unix(0, 1000)
+	// a record indexed densely before the switch to a sparse index
+	_, err := o.Append(&api.Record{
+		Value:      []byte("dense"),
+		AppendTime: start.UnixNano(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+
+	c := o.Config
+	c.Segment.MaxStoreBytes = 4096
+	// too small to index every record
+	c.Segment.MaxIndexBytes = entWidth * 16
+	c.Segment.IndexIntervalBytes = 128
+	log, err := NewLog(o.Dir, c)
+	require.NoError(t, err)
+	require.Empty(t, log.Recoveries())
+
+	count := 40
+	for i := 1; i <= count; i++ {
+		_, err := log.Append(&api.Record{
+			Value:      []byte("hello world"),
+			AppendTime: start.Add(time.Duration(i) * time.Second).UnixNano(),
+		})
+		require.NoError(t, err)
+	}
+	s := segmentFor(t, log, 1)
+	require.Equal(t, s, log.activeSegment)
+	require.Less(t, s.index.size, uint64(count)*entWidth)
+	require.Less(t, s.timeIndex.size, uint64(count)*tentWidth)
+
+	check := func(log *Log) {
+		read, err := log.Read(0)
+		require.NoError(t, err)
+		require.Equal(t, []byte("dense"), read.Value)
+		for i := 1; i <= count; i++ {
+			read, err := log.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), read.Offset)
+		}
+		for _, i := range []int{1, 7, 23, count} {
+			off, err := log.OffsetForTime(start.Add(time.Duration(i) * time.Second))
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), off)
+		}
+	}
+	check(log)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(o.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Recoveries())
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(count), off)
+	check(log)
+
+	// a lost sparse index is rebuilt sparse
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(s.index.Name()))
+	require.NoError(t, os.Remove(s.timeIndex.Name()))
+	log, err = NewLog(o.Dir, c)
+	require.NoError(t, err)
+	require.Len(t, log.Recoveries(), 1)
+	require.Less(t, log.activeSegment.index.size, uint64(count)*entWidth)
+	check(log)
+}
+
+func testTiering(t *testing.T, o *Log) {
+	require.NoError(t, o.Close())
+	dir, err := ioutil.TempDir("", "archive-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archive, err := NewLocalArchive(dir)
+	require.NoError(t, err)
+
+	c := o.Config
+	c.Tiering = Tiering{
+		Archive:      archive,
+		HotRetention: Retention{MaxRecords: 1, CheckInterval: time.Hour},
+	}
+	log, err := NewLog(o.Dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Offload())
+	names, err := archive.List()
+	require.NoError(t, err)
+	require.Len(t, names, 4*len(archiveExts))
+	require.Equal(t, uint64(3), log.segments[0].baseOffset)
+	_, err = os.Stat(filepath.Join(o.Dir, "0.store"))
+	require.True(t, os.IsNotExist(err))
+
+	check := func(log *Log, lowest uint64) {
+		off, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, lowest, off)
+		for off := lowest; off < 4; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, read.Offset)
+		}
+	}
+	check(log, 0)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(o.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log, 0)
+
+	// truncating past archived segments deletes them from the archive
+	require.NoError(t, log.Truncate(1))
+	names, err = archive.List()
+	require.NoError(t, err)
+	require.Len(t, names, 2*len(archiveExts))
+	check(log, 2)
+	_, err = log.Read(1)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	// uploads and downloads don't hold up appends and reads of the
+	// segments on local disk
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	blocking := newBlockingArchive(archive)
+	log.Config.Tiering.Archive = blocking
+	offloaded := make(chan error)
+	go func() { offloaded <- log.Offload() }()
+	<-blocking.started
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = log.Read(off)
+	require.NoError(t, err)
+	close(blocking.release)
+	require.NoError(t, <-offloaded)
+	require.Equal(t, uint64(5), log.segments[0].baseOffset)
+
+	blocking = newBlockingArchive(archive)
+	log.Config.Tiering.Archive = blocking
+	read := make(chan error)
+	go func() {
+		_, err := log.Read(3)
+		read <- err
+	}()
+	<-blocking.started
+	_, err = log.Read(off)
+	require.NoError(t, err)
+	close(blocking.release)
+	require.NoError(t, <-read)
+}
+
+// blockingArchive is an archive whose uploads and downloads wait until
+// they're released.
+type blockingArchive struct {
+	SegmentArchive
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newBlockingArchive(archive SegmentArchive) *blockingArchive {
+	return &blockingArchive{
+		SegmentArchive: archive,
+		started:        make(chan struct{}),
+		release:        make(chan struct{}),
+	}
+}
+
+func (a *blockingArchive) wait() {
+	a.once.Do(func() { close(a.started) })
+	<-a.release
+}
+
+func (a *blockingArchive) Put(name string, r io.Reader) error {
+	a.wait()
+	return a.SegmentArchive.Put(name, r)
+}
+
+func (a *blockingArchive) Get(name string) (io.ReadCloser, error) {
+	a.wait()
+	return a.SegmentArchive.Get(name)
+}
+
+func testEncryption(t *testing.T, o *Log) {
+	// a plaintext segment written before encryption was enabled
+	_, err := o.Append(&api.Record{Value: []byte("plaintext")})
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+
+	keyring := filepath.Join(o.Dir, "keyring")
+	require.NoError(t, ioutil.WriteFile(keyring, []byte(
+		"# test keys\nk1 000102030405060708090a0b0c0d0e0f\n",
+	), 0600))
+	keys, err := NewFileKeyring(keyring)
+	require.NoError(t, err)
+
+	c := o.Config
+	c.Segment.MaxStoreBytes = 1024
+	c.Encryption = Encryption{Keys: keys}
+	log, err := NewLog(o.Dir, c)
+	require.NoError(t, err)
+	require.NoError(t, log.RotateKey())
+	_, err = log.Append(&api.Record{Value: []byte("secret one")})
+	require.NoError(t, err)
+	require.Equal(t, "k1", log.activeSegment.keyID)
+
+	// rotate in a new key online
+	f, err := os.OpenFile(keyring, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString("k2 0f0e0d0c0b0a09080706050403020100\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, log.RotateKey())
+	_, err = log.Append(&api.Record{Value: []byte("secret two")})
+	require.NoError(t, err)
+	require.Equal(t, "k2", log.activeSegment.keyID)
+
+	check := func(log *Log) {
+		for off, want := range []string{"plaintext", "secret one", "secret two"} {
+			read, err := log.Read(uint64(off))
+			require.NoError(t, err)
+			require.Equal(t, []byte(want), read.Value)
+		}
+	}
+	check(log)
+	for _, s := range log.segments[1:] {
+		b, err := ioutil.ReadFile(s.store.Name())
+		require.NoError(t, err)
+		require.NotContains(t, string(b), "secret")
+	}
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(o.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Recoveries())
+	check(log)
+
+	// tampered ciphertext with a matching checksum fails authentication
+	s := segmentFor(t, log, 2)
+	_, pos, err := s.index.Read(0)
+	require.NoError(t, err)
+	p, _, err := s.store.ReadFrame(pos)
+	require.NoError(t, err)
+	p[len(p)-1] ^= 0xff
+	f, err = os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	crc := make([]byte, crcWidth)
+	enc.PutUint32(crc, checksum(p))
+	_, err = f.WriteAt(append(crc, p...), int64(pos+lenWidth))
+	require.NoError(t, err)
+	_, err = log.Read(2)
+	require.IsType(t, api.ErrCorruptRecord{}, err)
+}
+
+func testIterator(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	// a batch frame holding several records
+	_, err := log.AppendBatch([]*api.Record{
+		{Value: []byte("batched")},
+		{Value: []byte("batched")},
+		{Value: []byte("batched")},
+	})
+	require.NoError(t, err)
+
+	next := func(it *Iterator, want uint64) {
+		t.Helper()
+		record, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, want, record.Offset)
+	}
+	it := log.NewIterator(0)
+	for off := uint64(0); off < 6; off++ {
+		next(it, off)
+	}
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+
+	// the iterator picks up records appended after it caught up
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	next(it, 6)
+
+	// starting inside a batch frame
+	it = log.NewIterator(4)
+	next(it, 4)
+	next(it, 5)
+
+	// removing the segment an iterator is on moves it to the next one
+	it = log.NewIterator(1)
+	next(it, 1)
+	require.NoError(t, log.Truncate(1))
+	next(it, 2)
+	// unless the records it hasn't read were removed too
+	require.NoError(t, log.Truncate(5))
+	_, err = it.Next()
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+func testDirLock(t *testing.T, o *Log) {
+	_, err := NewLog(o.Dir, o.Config)
+	require.True(t, errors.Is(err, ErrDirLocked))
+
+	// the lock is released when the log is closed
+	require.NoError(t, o.Close())
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.NoError(t, n.Close())
+}
+
+func testStrayFiles(t *testing.T, o *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.Close())
+
+	for _, name := range []string{
+		".1.store.swp",
+		"notes.txt",
+		"x.store",
+		"01.store",
+		// an index left behind by a removed segment
+		"9.index",
+	} {
+		require.NoError(t, ioutil.WriteFile(
+			filepath.Join(o.Dir, name),
+			[]byte("stray"),
+			0644,
+		))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(o.Dir, "5.store.d"), 0755))
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	off, err := n.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	for off := uint64(0); off < 3; off++ {
+		record, err := n.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+	_, err = os.Stat(filepath.Join(n.Dir, "9.index"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(n.Dir, "notes.txt"))
+	require.NoError(t, err)
+}
+
+func testTruncateFrom(t *testing.T, o *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(&api.Record{Value: []byte("first")})
+		require.NoError(t, err)
+	}
+	// offsets 3 to 5 in one batch frame
+	_, err := o.AppendBatch([]*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("first")},
+		{Value: []byte("first")},
+	})
+	require.NoError(t, err)
+	it := o.NewIterator(5)
+	record, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), record.Offset)
+
+	// cut the batch frame in two, removing the later segments
+	require.NoError(t, o.TruncateFrom(4))
+	off, err := o.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	_, err = o.Read(4)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	record, err = o.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), record.Value)
+
+	off, err = o.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	// the iterator goes back for the offsets that were appended again
+	record, err = it.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), record.Offset)
+	require.Equal(t, []byte("second"), record.Value)
+
+	// truncating from a segment's base offset removes the segment
+	require.NoError(t, o.TruncateFrom(1))
+	off, err = o.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	require.NoError(t, o.Close())
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.Empty(t, n.Recoveries())
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	for off, value := range []string{"first", "second"} {
+		record, err := n.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, []byte(value), record.Value)
+	}
+	defer n.Close()
+
+	// the truncations before the log's first record are dropped, an
+	// iterator that missed them goes back to the first record
+	for i := 0; i < 3; i++ {
+		_, err = n.Append(&api.Record{Value: []byte("third")})
+		require.NoError(t, err)
+	}
+	it = n.NewIterator(3)
+	for i := 0; i < 2; i++ {
+		_, err = it.Next()
+		require.NoError(t, err)
+	}
+	require.NoError(t, n.TruncateFrom(2))
+	for i := 0; i < 3; i++ {
+		_, err = n.Append(&api.Record{Value: []byte("fourth")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, n.Truncate(2))
+	require.Empty(t, n.truncations)
+	record, err = it.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), record.Offset)
+	require.Equal(t, []byte("fourth"), record.Value)
+}
+
+// BenchmarkLogProduceConsume appends records while consumers tail the log,
+// reading the records a little behind the newest one.
+func BenchmarkLogProduceConsume(b *testing.B) {
+	dir, err := ioutil.TempDir("", "log-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	log, err := NewLog(dir, c)
+	require.NoError(b, err)
+	defer log.Close()
+
+	record := &api.Record{Value: make([]byte, 128)}
+	for i := 0; i < 1000; i++ {
+		_, err := log.Append(record)
+		require.NoError(b, err)
+	}
+	done := make(chan struct{})
+	var produced uint64
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := log.Append(record); err != nil {
+				return
+			}
+			atomic.AddUint64(&produced, 1)
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i uint64
+		for pb.Next() {
+			highest, err := log.HighestOffset()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err = log.Read(highest - i%1000); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+	close(done)
+	b.ReportMetric(float64(atomic.LoadUint64(&produced))/b.Elapsed().Seconds(), "appends/s")
+}
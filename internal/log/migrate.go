@@ -0,0 +1,111 @@
+package log
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// legacyStore reports whether the store file is in the layout stores had
+// before frames carried attributes and checksums, a bare length before
+// each record. A store in the current layout starts with a header frame,
+// whose length has the header attribute in its top byte where a legacy
+// length has a zero. A store too short to tell holds no complete frame
+// in either layout.
+func legacyStore(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	b := make([]byte, lenWidth)
+	if _, err = io.ReadFull(f, b); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	switch uint8(enc.Uint64(b) >> attrShift) {
+	case headerFrame:
+		return false, nil
+	case 0:
+		return true, nil
+	}
+	return false, fmt.Errorf("log: %s isn't in a known store format", name)
+}
+
+// migrateStore rewrites the segment's store in the current layout if it's
+// in the legacy one, and reports whether it was. Every record has to
+// decode, only a tail too short to hold the record its length describes
+// is taken as torn and dropped. The indexes are left for recovery to
+// rebuild against the rewritten store.
+func migrateStore(dir string, baseOffset uint64, logger *zap.Logger) (bool, error) {
+	name := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store"))
+	legacy, err := legacyStore(name)
+	if err != nil || !legacy {
+		return false, err
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	tmp := name + ".migrate"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+	s := &store{File: f, buf: bufio.NewWriter(f)}
+	if _, _, err = s.AppendFrame(storeMagic, headerFrame); err != nil {
+		s.Close()
+		return false, err
+	}
+	var pos, records uint64
+	for pos+lenWidth <= uint64(len(b)) {
+		n := enc.Uint64(b[pos:])
+		if n > uint64(len(b))-pos-lenWidth {
+			break
+		}
+		p := b[pos+lenWidth : pos+lenWidth+n]
+		if err = proto.Unmarshal(p, &api.Record{}); err != nil {
+			s.Close()
+			return false, fmt.Errorf(
+				"log: can't migrate %s, the record at position %d doesn't decode: %v",
+				name, pos, err,
+			)
+		}
+		if _, _, err = s.Append(p); err != nil {
+			s.Close()
+			return false, err
+		}
+		pos += lenWidth + n
+		records++
+	}
+	if err = s.Sync(); err != nil {
+		s.Close()
+		return false, err
+	}
+	if err = s.Close(); err != nil {
+		return false, err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return false, err
+	}
+	if err = syncDir(dir); err != nil {
+		return false, err
+	}
+	logger.Info(
+		"migrated legacy store",
+		zap.String("dir", dir),
+		zap.Uint64("base_offset", baseOffset),
+		zap.Uint64("records", records),
+		zap.Uint64("dropped_bytes", uint64(len(b))-pos),
+	)
+	return true, nil
+}
@@ -0,0 +1,212 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// groupHeaderTimeout is how long an accepted connection has to name its
+// raft group.
+const groupHeaderTimeout = 10 * time.Second
+
+var errGroupClosed = errors.New("log: raft group closed")
+
+// raftMux shares a stream layer between raft groups: the DistributedLog's
+// own, named "", and its partitions'. A connection starts with the name
+// of the group it's for, a 2 byte length followed by the name, written
+// after the stream layer's own handshake. Connections for groups this
+// server doesn't have, like a partition it hasn't created yet, are closed
+// and raft retries them.
+type raftMux struct {
+	layer  raft.StreamLayer
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	groups map[string]*groupLayer
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newRaftMux(layer raft.StreamLayer) *raftMux {
+	m := &raftMux{
+		layer:  layer,
+		logger: zap.L().Named("raft-mux"),
+		groups: make(map[string]*groupLayer),
+		closed: make(chan struct{}),
+	}
+	go m.serve()
+	return m
+}
+
+// group returns the stream layer of the group with the name.
+func (m *raftMux) group(name string) *groupLayer {
+	g := &groupLayer{
+		mux:   m,
+		name:  name,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.groups[name] = g
+	m.mu.Unlock()
+	return g
+}
+
+func (m *raftMux) serve() {
+	const baseDelay = 5 * time.Millisecond
+	const maxDelay = time.Second
+	var delay time.Duration
+	for {
+		conn, err := m.layer.Accept()
+		if err != nil {
+			// like raft's transport, back off on errors until closed
+			if delay == 0 {
+				delay = baseDelay
+			} else if delay *= 2; delay > maxDelay {
+				delay = maxDelay
+			}
+			select {
+			case <-m.closed:
+				return
+			case <-time.After(delay):
+				continue
+			}
+		}
+		delay = 0
+		go m.route(conn)
+	}
+}
+
+// route hands the connection to the group it names.
+func (m *raftMux) route(conn net.Conn) {
+	name, err := readGroup(conn)
+	if err != nil {
+		m.logger.Debug("failed to read raft group", zap.Error(err))
+		conn.Close()
+		return
+	}
+	m.mu.Lock()
+	g, ok := m.groups[name]
+	m.mu.Unlock()
+	if !ok {
+		conn.Close()
+		return
+	}
+	select {
+	case g.conns <- conn:
+	case <-g.done:
+		conn.Close()
+	case <-m.closed:
+		conn.Close()
+	}
+}
+
+func readGroup(conn net.Conn) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(groupHeaderTimeout)); err != nil {
+		return "", err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return "", err
+	}
+	name := make([]byte, enc.Uint16(b))
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return "", err
+	}
+	return string(name), conn.SetReadDeadline(time.Time{})
+}
+
+func (m *raftMux) dial(
+	name string,
+	addr raft.ServerAddress,
+	timeout time.Duration,
+) (net.Conn, error) {
+	conn, err := m.layer.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 2+len(name))
+	enc.PutUint16(b, uint16(len(name)))
+	copy(b[2:], name)
+	if err = conn.SetWriteDeadline(time.Now().Add(timeout)); err == nil {
+		_, err = conn.Write(b)
+	}
+	if err == nil {
+		err = conn.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("log: raft group %q: %w", name, err)
+	}
+	return conn, nil
+}
+
+func (m *raftMux) remove(g *groupLayer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// a group of the same name may have replaced it
+	if m.groups[g.name] == g {
+		delete(m.groups, g.name)
+	}
+}
+
+// close closes the shared stream layer.
+func (m *raftMux) close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.closed)
+		err = m.layer.Close()
+	})
+	return err
+}
+
+var _ raft.StreamLayer = (*groupLayer)(nil)
+
+// groupLayer is a raft group's stream layer on a raftMux. Raft closes it
+// on shutdown; closing the DistributedLog's own group's closes the mux.
+type groupLayer struct {
+	mux   *raftMux
+	name  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (g *groupLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-g.conns:
+		return conn, nil
+	case <-g.done:
+		return nil, errGroupClosed
+	}
+}
+
+func (g *groupLayer) Dial(
+	addr raft.ServerAddress,
+	timeout time.Duration,
+) (net.Conn, error) {
+	return g.mux.dial(g.name, addr, timeout)
+}
+
+func (g *groupLayer) Close() error {
+	var err error
+	g.once.Do(func() {
+		close(g.done)
+		g.mux.remove(g)
+		if g.name == "" {
+			err = g.mux.close()
+		}
+	})
+	return err
+}
+
+func (g *groupLayer) Addr() net.Addr {
+	return g.mux.layer.Addr()
+}
@@ -0,0 +1,100 @@
+package log
+
+import (
+	"sort"
+	"sync"
+
+	api "github.com/halladj/dis-log/api/v1"
+)
+
+// offsets holds consumer groups' committed offsets, so consumers can pick
+// up where their group left off without storing offsets themselves. Like
+// producers it's part of the replicated state machine, changed by applying
+// raft entries and carried in snapshots, and read concurrently with the
+// entries being applied.
+type offsets struct {
+	mu      sync.RWMutex
+	offsets map[offsetKey]*api.GroupOffset
+}
+
+type offsetKey struct {
+	group     string
+	topic     string
+	partition uint32
+}
+
+func newOffsets() *offsets {
+	return &offsets{offsets: make(map[offsetKey]*api.GroupOffset)}
+}
+
+// commit records the group's offset in the topic's partition.
+func (o *offsets) commit(req *api.CommitOffsetRequest) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.offsets[offsetKey{req.Group, req.Topic, req.Partition}] = &api.GroupOffset{
+		Group:      req.Group,
+		Topic:      req.Topic,
+		Partition:  req.Partition,
+		Offset:     req.Offset,
+		CommitTime: req.Time,
+	}
+}
+
+// fetch returns the group's committed offset in the topic's partition.
+func (o *offsets) fetch(group, topic string, partition uint32) (uint64, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	committed, ok := o.offsets[offsetKey{group, topic, partition}]
+	if !ok {
+		return 0, api.ErrNoCommittedOffset{
+			Group:     group,
+			Topic:     topic,
+			Partition: partition,
+		}
+	}
+	return committed.Offset, nil
+}
+
+// topicDeleted forgets the offsets committed in a deleted topic, so a
+// topic created under its name starts afresh.
+func (o *offsets) topicDeleted(topic string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for key := range o.offsets {
+		if key.topic == topic {
+			delete(o.offsets, key)
+		}
+	}
+}
+
+// snapshot returns the committed offsets in a stable order, so every
+// server's snapshot of the same state is the same.
+func (o *offsets) snapshot() []*api.GroupOffset {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	list := make([]*api.GroupOffset, 0, len(o.offsets))
+	for _, committed := range o.offsets {
+		list = append(list, committed)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Partition < b.Partition
+	})
+	return list
+}
+
+func (o *offsets) restore(list []*api.GroupOffset) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.offsets = make(map[offsetKey]*api.GroupOffset, len(list))
+	for _, committed := range list {
+		key := offsetKey{committed.Group, committed.Topic, committed.Partition}
+		o.offsets[key] = committed
+	}
+}
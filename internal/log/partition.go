@@ -0,0 +1,273 @@
+package log
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/hashicorp/raft"
+
+	api "github.com/halladj/dis-log/api/v1"
+)
+
+// Partitioner picks which of a topic's partitions a record with the key
+// is appended to.
+type Partitioner interface {
+	Partition(key []byte, partitions uint32) uint32
+}
+
+// HashPartitioner picks a partition by the FNV-1a hash of the record's
+// key, so the records sharing a key stay in order in one partition.
+type HashPartitioner struct{}
+
+func (HashPartitioner) Partition(key []byte, partitions uint32) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % partitions
+}
+
+// RoundRobinPartitioner spreads records over the partitions in turn.
+type RoundRobinPartitioner struct {
+	next uint32
+}
+
+func (p *RoundRobinPartitioner) Partition(_ []byte, partitions uint32) uint32 {
+	return (atomic.AddUint32(&p.next, 1) - 1) % partitions
+}
+
+// ExplicitPartitioner appends every record to the partition it is.
+type ExplicitPartitioner uint32
+
+func (p ExplicitPartitioner) Partition([]byte, uint32) uint32 {
+	return uint32(p)
+}
+
+// keyPartitioner hashes keyed records and spreads the others round robin.
+type keyPartitioner struct {
+	roundRobin RoundRobinPartitioner
+}
+
+func (p *keyPartitioner) Partition(key []byte, partitions uint32) uint32 {
+	if len(key) == 0 {
+		return p.roundRobin.Partition(key, partitions)
+	}
+	return HashPartitioner{}.Partition(key, partitions)
+}
+
+// newPartitioners returns a partitioned topic's partitioners by kind, the
+// default being the one its config names. The round robin ones keep their
+// place on each server, they aren't replicated.
+func newPartitioners(c *api.TopicConfig) map[api.Partitioner]Partitioner {
+	p := map[api.Partitioner]Partitioner{
+		api.Partitioner_PARTITIONER_HASH:        HashPartitioner{},
+		api.Partitioner_PARTITIONER_ROUND_ROBIN: &RoundRobinPartitioner{},
+	}
+	p[api.Partitioner_PARTITIONER_DEFAULT] = &keyPartitioner{}
+	if def, ok := p[c.Partitioner]; ok {
+		p[api.Partitioner_PARTITIONER_DEFAULT] = def
+	}
+	return p
+}
+
+// partition is one of a partitioned topic's partitions: a log replicated
+// by a raft group of its own, so the partitions' appends don't queue up
+// behind each other. Its state machine is the same as the topic
+// registry's, with the partition's log as its default topic.
+type partition struct {
+	id        uint32
+	dir       string
+	raft      *raft.Raft
+	raftLog   *logStore
+	log       *Log
+	topics    *topics
+	producers *producers
+}
+
+// partitions opens partitioned topics' partitions. Each keeps its log and
+// raft state in dir/<topic>/<partition> and its raft group shares the
+// DistributedLog's stream layer through mux.
+type partitions struct {
+	dir    string
+	config Config
+	mux    *raftMux
+}
+
+// open opens the topic's partitions. A partition with no raft state yet
+// is bootstrapped with the replicas by the one of them that leads it
+// first, so the partitions' leaders are spread over the replicas: the one
+// marked leader bootstraps partition 0 and the replicas after it take the
+// next partitions in turn. The others wait to be replicated to.
+func (p *partitions) open(
+	topic string,
+	config *api.TopicConfig,
+	logConfig Config,
+	replicas []*api.Server,
+) ([]*partition, error) {
+	local, first := -1, 0
+	for i, r := range replicas {
+		if raft.ServerID(r.Id) == p.config.Raft.LocalID {
+			local = i
+		}
+		if r.IsLeader {
+			first = i
+		}
+	}
+	parts := make([]*partition, 0, config.Partitions)
+	for id := uint32(0); id < config.Partitions; id++ {
+		var bootstrap []raft.Server
+		if local >= 0 && (first+int(id))%len(replicas) == local {
+			bootstrap = raftServers(replicas)
+		}
+		part, err := p.openPartition(topic, id, config, logConfig, bootstrap)
+		if err != nil {
+			for _, part := range parts {
+				part.close()
+			}
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func (p *partitions) openPartition(
+	topic string,
+	id uint32,
+	config *api.TopicConfig,
+	logConfig Config,
+	bootstrap []raft.Server,
+) (*partition, error) {
+	part := &partition{
+		id:  id,
+		dir: filepath.Join(p.dir, topic, strconv.FormatUint(uint64(id), 10)),
+	}
+	logDir := filepath.Join(part.dir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	if part.log, err = NewLog(logDir, logConfig); err != nil {
+		return nil, err
+	}
+	part.topics = newTopics(filepath.Join(part.dir, "topics"), p.config, part.log)
+	// the partition's retention is the topic's
+	part.topics.logs[""].config = config
+	part.producers = newProducers(p.config.Producers)
+	part.producers.register = true
+	part.raft, part.raftLog, err = openRaft(
+		part.dir,
+		p.config,
+		p.mux.group(fmt.Sprintf("%s/%d", topic, id)),
+		&fsm{topics: part.topics, producers: part.producers},
+		bootstrap,
+	)
+	if err != nil {
+		part.log.Close()
+		return nil, err
+	}
+	return part, nil
+}
+
+// remove deletes the topic's partitions' directories.
+func (p *partitions) remove(topic string) error {
+	return os.RemoveAll(filepath.Join(p.dir, topic))
+}
+
+// prune deletes the directories of the partitioned topics that aren't
+// kept, left behind by topics deleted while the server was behind.
+func (p *partitions) prune(keep func(topic string) bool) error {
+	entries, err := os.ReadDir(p.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if keep(entry.Name()) {
+			continue
+		}
+		if err = p.remove(entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicas returns the servers of the partition's raft group.
+func (p *partition) replicas() ([]*api.Server, error) {
+	future := p.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	leader := p.raft.Leader()
+	var servers []*api.Server
+	for _, server := range future.Configuration().Servers {
+		servers = append(servers, &api.Server{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			IsLeader: leader == server.Address,
+		})
+	}
+	return servers, nil
+}
+
+// reconcile makes the servers of the partition's raft group the topic
+// registry's, adding those that joined it and removing those that left.
+// Only the partition's leader can.
+func (p *partition) reconcile(servers []raft.Server) error {
+	if p.raft.State() != raft.Leader {
+		return nil
+	}
+	future := p.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	current := make(map[raft.ServerID]raft.ServerAddress)
+	for _, srv := range future.Configuration().Servers {
+		current[srv.ID] = srv.Address
+	}
+	wanted := make(map[raft.ServerID]bool, len(servers))
+	for _, srv := range servers {
+		wanted[srv.ID] = true
+		if addr, ok := current[srv.ID]; ok && addr == srv.Address {
+			continue
+		}
+		// AddVoter moves a server that's there under another address
+		if err := p.raft.AddVoter(srv.ID, srv.Address, 0, 0).Error(); err != nil {
+			return err
+		}
+	}
+	for id := range current {
+		if wanted[id] {
+			continue
+		}
+		if err := p.raft.RemoveServer(id, 0, 0).Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *partition) close() error {
+	if err := p.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := p.raftLog.Close(); err != nil {
+		return err
+	}
+	return p.log.Close()
+}
+
+func raftServers(servers []*api.Server) []raft.Server {
+	list := make([]raft.Server, 0, len(servers))
+	for _, srv := range servers {
+		list = append(list, raft.Server{
+			ID:      raft.ServerID(srv.Id),
+			Address: raft.ServerAddress(srv.RpcAddr),
+		})
+	}
+	return list
+}
@@ -0,0 +1,335 @@
+package log
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/halladj/dis-log/api/v1"
+)
+
+// producerWindow is how many of a producer's latest requests are
+// remembered, bounding how many it can have in flight and still have
+// their retries recognized.
+const producerWindow = 5
+
+const (
+	defaultProducerExpiry = 7 * 24 * time.Hour
+	defaultTxnTimeout     = time.Minute
+)
+
+// producers is the deduplication and transaction state of idempotent
+// producers. It's part of the replicated state machine: it's only changed
+// by applying raft entries and carried in snapshots, so every server holds
+// the same state and a new leader recognizes retries of requests its
+// predecessor appended. Consumers read the transaction state concurrently
+// with the entries being applied, so it's guarded by mu.
+type producers struct {
+	mu         sync.RWMutex
+	expiry     time.Duration
+	txnTimeout time.Duration
+	// now is the newest append time applied, the clock producers expire
+	// and transactions time out by
+	now   int64
+	state map[uint64]*api.ProducerState
+	// aborted are the aborted transactions whose records are still in the
+	// log, in the order they aborted
+	aborted []*api.AbortedTxn
+	// register has producers registered by their first request rather
+	// than by init. A partition's raft group doesn't issue producer IDs,
+	// the topic registry's does, so its producers start with whatever
+	// sequence number they send it first.
+	register bool
+}
+
+func newProducers(c Producers) *producers {
+	p := &producers{
+		expiry:     c.Expiry,
+		txnTimeout: c.TxnTimeout,
+		state:      make(map[uint64]*api.ProducerState),
+	}
+	if p.expiry == 0 {
+		p.expiry = defaultProducerExpiry
+	}
+	if p.txnTimeout == 0 {
+		p.txnTimeout = defaultTxnTimeout
+	}
+	return p
+}
+
+// init registers a producer under id, expiring the producers that have
+// been idle too long. A producer with an open transaction is kept until
+// the transaction times out.
+func (p *producers) init(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	p.state[id] = &api.ProducerState{ProducerId: id, LastTime: p.now}
+}
+
+// expire forgets the producers that have been idle too long. p.mu must be
+// held.
+func (p *producers) expire() {
+	for pid, s := range p.state {
+		if !s.InTxn && p.now-s.LastTime > int64(p.expiry) {
+			delete(p.state, pid)
+		}
+	}
+}
+
+// check decides whether a producer's request is appended. It returns the
+// offsets the request was appended at if it's a retry of a recent one,
+// and nil if it's the next request and should be appended.
+func (p *producers) check(id, seq uint64) ([]uint64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	s, ok := p.state[id]
+	if !ok && p.register {
+		return nil, nil
+	}
+	if !ok {
+		return nil, api.ErrUnknownProducer{ProducerID: id}
+	}
+	if seq == s.NextSequence {
+		return nil, nil
+	}
+	for _, r := range s.Recent {
+		if r.Sequence == seq {
+			return r.Offsets, nil
+		}
+	}
+	return nil, api.ErrOutOfOrderSequence{
+		ProducerID: id,
+		Sequence:   seq,
+		Expected:   s.NextSequence,
+	}
+}
+
+// appended records that the producer's next request was appended at the
+// offsets.
+func (p *producers) appended(id, seq uint64, offsets []uint64, t int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.state[id]
+	if !ok {
+		// registered by its first request
+		p.expire()
+		s = &api.ProducerState{ProducerId: id}
+		p.state[id] = s
+	}
+	s.NextSequence = seq + 1
+	s.LastTime = t
+	s.Recent = append(s.Recent, &api.ProducedSequence{
+		Sequence: seq,
+		Offsets:  offsets,
+	})
+	if len(s.Recent) > producerWindow {
+		s.Recent = s.Recent[len(s.Recent)-producerWindow:]
+	}
+}
+
+// writeInTxn returns whether the producer has an open transaction, which
+// its records appended to the topic at next are then part of.
+func (p *producers) writeInTxn(id uint64, topic string, next uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.state[id]
+	if !ok || !s.InTxn {
+		return false
+	}
+	if _, ok := s.TxnOffsets[topic]; !ok {
+		// the transaction starts in the topic before its records are
+		// appended, so consumers never see them as committed
+		s.TxnOffsets[topic] = next
+	}
+	return true
+}
+
+// inTxn returns whether the producer has an open transaction.
+func (p *producers) inTxn(id uint64) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	s, ok := p.state[id]
+	return ok && s.InTxn
+}
+
+// begin opens a transaction for the producer.
+func (p *producers) begin(id uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.state[id]
+	if !ok {
+		return api.ErrUnknownProducer{ProducerID: id}
+	}
+	if s.InTxn {
+		return api.ErrInvalidTxnState{ProducerID: id, Open: true}
+	}
+	s.InTxn = true
+	s.TxnOffsets = make(map[string]uint64)
+	s.TxnStartTime = p.now
+	s.LastTime = p.now
+	return nil
+}
+
+// txnTopics returns the topics the producer's open transaction wrote to,
+// in name order, failing if it has no open transaction.
+func (p *producers) txnTopics(id uint64) ([]string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	s, ok := p.state[id]
+	if !ok {
+		return nil, api.ErrUnknownProducer{ProducerID: id}
+	}
+	if !s.InTxn {
+		return nil, api.ErrInvalidTxnState{ProducerID: id}
+	}
+	topics := make([]string, 0, len(s.TxnOffsets))
+	for topic := range s.TxnOffsets {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// end closes the producer's transaction, its control records having been
+// appended at markers, by topic.
+func (p *producers) end(
+	id uint64,
+	control api.ControlType,
+	markers map[string]uint64,
+) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.state[id]
+	if control == api.ControlType_CONTROL_ABORT {
+		for topic, marker := range markers {
+			p.aborted = append(p.aborted, &api.AbortedTxn{
+				ProducerId:  id,
+				Topic:       topic,
+				FirstOffset: s.TxnOffsets[topic],
+				LastOffset:  marker,
+			})
+		}
+	}
+	s.InTxn = false
+	s.TxnOffsets = nil
+	s.LastTime = p.now
+}
+
+// fence forgets the producer, so its requests fail until it's initialized
+// again.
+func (p *producers) fence(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.state, id)
+}
+
+// timedOut returns the producers whose transactions have been open longer
+// than the timeout, in ID order so every server aborts them alike.
+func (p *producers) timedOut() []uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var ids []uint64
+	for id, s := range p.state {
+		if s.InTxn && p.now-s.TxnStartTime > int64(p.txnTimeout) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// stableOffset is the offset read_committed consumers read the topic up
+// to, the start of the earliest transaction open in it.
+func (p *producers) stableOffset(topic string) uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var stable uint64 = math.MaxUint64
+	for _, s := range p.state {
+		if first, ok := s.TxnOffsets[topic]; ok && first < stable {
+			stable = first
+		}
+	}
+	return stable
+}
+
+// committed returns whether read_committed consumers see the record: it
+// isn't a control record or written by an aborted transaction.
+func (p *producers) committed(topic string, record *api.Record) bool {
+	if record.Control != api.ControlType_CONTROL_NONE {
+		return false
+	}
+	if record.ProducerId == 0 {
+		return true
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, a := range p.aborted {
+		if a.ProducerId == record.ProducerId && a.Topic == topic &&
+			a.FirstOffset <= record.Offset && record.Offset < a.LastOffset {
+			return false
+		}
+	}
+	return true
+}
+
+// truncated forgets the aborted transactions no longer in the topic's
+// log.
+func (p *producers) truncated(topic string, lowest uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	aborted := p.aborted[:0:0]
+	for _, a := range p.aborted {
+		if a.Topic != topic || a.LastOffset >= lowest {
+			aborted = append(aborted, a)
+		}
+	}
+	p.aborted = aborted
+}
+
+// topicDeleted forgets the transactions' records in a deleted topic, so a
+// topic created under its name starts afresh.
+func (p *producers) topicDeleted(topic string) {
+	p.truncated(topic, math.MaxUint64)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.state {
+		delete(s.TxnOffsets, topic)
+	}
+}
+
+// tick advances the clock to an applied record's append time.
+func (p *producers) tick(t int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t > p.now {
+		p.now = t
+	}
+}
+
+func (p *producers) snapshot() *api.ProducerSnapshot {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	snap := &api.ProducerSnapshot{Time: p.now, Aborted: p.aborted}
+	for _, s := range p.state {
+		snap.Producers = append(snap.Producers, s)
+	}
+	// a stable order so every server's snapshot of the same state is the
+	// same
+	sort.Slice(snap.Producers, func(i, j int) bool {
+		return snap.Producers[i].ProducerId < snap.Producers[j].ProducerId
+	})
+	return snap
+}
+
+func (p *producers) restore(snap *api.ProducerSnapshot) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.now = snap.Time
+	p.aborted = snap.Aborted
+	p.state = make(map[uint64]*api.ProducerState, len(snap.Producers))
+	for _, s := range snap.Producers {
+		p.state[s.ProducerId] = s
+	}
+}
@@ -0,0 +1,162 @@
+package log
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoSchema validates records' values as a protobuf message, described
+// by a FileDescriptorSet holding its file and the files it imports.
+type protoSchema struct {
+	message protoreflect.MessageDescriptor
+}
+
+func parseProtoSchema(definition []byte, messageName string) (*protoSchema, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(definition, &set); err != nil {
+		return nil, fmt.Errorf("invalid FileDescriptorSet: %w", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil, fmt.Errorf("message %q: %w", messageName, err)
+	}
+	message, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q isn't a message", messageName)
+	}
+	return &protoSchema{message: message}, nil
+}
+
+// validate unmarshals the value as the message, which has to have its
+// required fields and no fields the message doesn't declare.
+func (p *protoSchema) validate(value []byte) error {
+	m := dynamicpb.NewMessage(p.message)
+	if err := proto.Unmarshal(value, m); err != nil {
+		return err
+	}
+	return unknownFields(m)
+}
+
+func unknownFields(m protoreflect.Message) error {
+	if len(m.GetUnknown()) > 0 {
+		return fmt.Errorf("%s: unknown fields", m.Descriptor().FullName())
+	}
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+			v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+				err = unknownFields(v.Message())
+				return err == nil
+			})
+		case fd.Message() == nil:
+		case fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len() && err == nil; i++ {
+				err = unknownFields(list.Get(i).Message())
+			}
+		default:
+			err = unknownFields(v.Message())
+		}
+		return err == nil
+	})
+	return err
+}
+
+func (p *protoSchema) readable(writer schemaValidator) error {
+	w, ok := writer.(*protoSchema)
+	if !ok {
+		return errSchemaTypeChanged
+	}
+	return readableMessage(p.message, w.message, make(map[[2]protoreflect.FullName]bool))
+}
+
+// readableMessage returns why a message written as w might not be read as
+// r: a field number reused with another wire type or cardinality, or a
+// required field w doesn't have. Renamed fields and the fields only one of
+// them has are fine.
+func readableMessage(
+	r, w protoreflect.MessageDescriptor,
+	seen map[[2]protoreflect.FullName]bool,
+) error {
+	key := [2]protoreflect.FullName{r.FullName(), w.FullName()}
+	if seen[key] {
+		return nil
+	}
+	seen[key] = true
+	fields := r.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		rf := fields.Get(i)
+		wf := w.Fields().ByNumber(rf.Number())
+		if wf == nil {
+			if rf.Cardinality() == protoreflect.Required {
+				return fmt.Errorf("%s: required field %d isn't written", r.FullName(), rf.Number())
+			}
+			continue
+		}
+		if err := readableField(rf, wf, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readableField(
+	r, w protoreflect.FieldDescriptor,
+	seen map[[2]protoreflect.FullName]bool,
+) error {
+	if r.IsMap() != w.IsMap() || r.IsList() != w.IsList() {
+		return fmt.Errorf("%s: field %d changed cardinality", r.FullName(), r.Number())
+	}
+	if r.IsMap() {
+		if err := readableField(r.MapKey(), w.MapKey(), seen); err != nil {
+			return err
+		}
+		return readableField(r.MapValue(), w.MapValue(), seen)
+	}
+	if wireKind(r.Kind()) != wireKind(w.Kind()) {
+		return fmt.Errorf(
+			"%s: field %d changed from %s to %s",
+			r.FullName(),
+			r.Number(),
+			w.Kind(),
+			r.Kind(),
+		)
+	}
+	if r.Message() != nil {
+		return readableMessage(r.Message(), w.Message(), seen)
+	}
+	return nil
+}
+
+// wireKind groups the kinds that are encoded alike, so a field can change
+// between them.
+func wireKind(k protoreflect.Kind) string {
+	switch k {
+	case protoreflect.Int32Kind, protoreflect.Int64Kind,
+		protoreflect.Uint32Kind, protoreflect.Uint64Kind,
+		protoreflect.BoolKind, protoreflect.EnumKind:
+		return "varint"
+	case protoreflect.Sint32Kind, protoreflect.Sint64Kind:
+		return "zigzag"
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind:
+		return "fixed32"
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind:
+		return "fixed64"
+	case protoreflect.StringKind, protoreflect.BytesKind:
+		return "bytes"
+	}
+	return k.String()
+}
@@ -0,0 +1,90 @@
+package log
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetentionInterval = time.Minute
+	defaultSyncInterval      = 100 * time.Millisecond
+)
+
+// RetentionOffset returns the offset to truncate the log up to so that it
+// fits r at now. It is false when no closed segment falls outside r.
+func (l *Log) RetentionOffset(r Retention, now time.Time) (uint64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var bytes uint64
+	for _, s := range l.segments {
+		bytes += s.store.size
+	}
+	records := l.activeSegment.nextOffset - l.segments[0].baseOffset
+	var lowest uint64
+	var ok bool
+	for _, s := range l.segments {
+		if s == l.activeSegment {
+			break
+		}
+		expired := r.MaxAge != 0 && s.maxTime != 0 &&
+			now.Sub(time.Unix(0, s.maxTime)) > r.MaxAge
+		if !expired &&
+			(r.MaxBytes == 0 || bytes <= r.MaxBytes) &&
+			(r.MaxRecords == 0 || records <= r.MaxRecords) {
+			break
+		}
+		bytes -= s.store.size
+		records -= s.nextOffset - s.baseOffset
+		lowest, ok = s.nextOffset-1, true
+	}
+	return lowest, ok
+}
+
+// Retain removes the closed segments that fall outside the log's retention
+// policy.
+func (l *Log) Retain() error {
+	lowest, ok := l.RetentionOffset(l.Config.Retention, time.Now())
+	if !ok {
+		return nil
+	}
+	return l.Truncate(lowest)
+}
+
+// reaper calls fn on an interval until it's stopped.
+type reaper struct {
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+func newReaper(interval time.Duration, fn func()) *reaper {
+	if interval == 0 {
+		interval = defaultRetentionInterval
+	}
+	r := &reaper{done: make(chan struct{})}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+	return r
+}
+
+// stop stops the reaper and waits for a running fn to return. Stopping it
+// again does nothing.
+func (r *reaper) stop() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() { close(r.done) })
+	r.wg.Wait()
+}
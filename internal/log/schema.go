@@ -0,0 +1,247 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	api "github.com/halladj/dis-log/api/v1"
+)
+
+// SchemaIDHeader is the record header naming the schema a record's value
+// was validated against, by ID, so consumers can decode it without
+// guessing. A producer can set it to validate against an older version of
+// the topic's schema than the latest.
+const SchemaIDHeader = "schema-id"
+
+// schemaValidator is a schema compiled for validating records' values.
+type schemaValidator interface {
+	// validate returns why the value doesn't match the schema, if it
+	// doesn't.
+	validate(value []byte) error
+	// readable returns why records written with the writer's schema can't
+	// be read with this one, if they can't.
+	readable(writer schemaValidator) error
+}
+
+var errSchemaTypeChanged = errors.New("the schema type changed")
+
+func compileSchema(
+	kind api.SchemaType,
+	definition []byte,
+	messageName string,
+) (schemaValidator, error) {
+	switch kind {
+	case api.SchemaType_SCHEMA_TYPE_JSON:
+		return parseJSONSchema(definition)
+	case api.SchemaType_SCHEMA_TYPE_PROTOBUF:
+		return parseProtoSchema(definition, messageName)
+	}
+	return nil, fmt.Errorf("unknown schema type %d", kind)
+}
+
+// checkCompatibility returns why the next version of a schema isn't
+// compatible with the latest, if it isn't.
+func checkCompatibility(c api.Compatibility, next, latest schemaValidator) error {
+	switch c {
+	case api.Compatibility_COMPATIBILITY_BACKWARD:
+		return next.readable(latest)
+	case api.Compatibility_COMPATIBILITY_FORWARD:
+		return latest.readable(next)
+	case api.Compatibility_COMPATIBILITY_FULL:
+		if err := next.readable(latest); err != nil {
+			return err
+		}
+		return latest.readable(next)
+	case api.Compatibility_COMPATIBILITY_NONE:
+		return nil
+	}
+	return fmt.Errorf("unknown compatibility %d", c)
+}
+
+// schemas is the schema registry: the versions of each topic's schema,
+// which the records produced to the topic are validated against. Like
+// producers it's part of the replicated state machine, so every server
+// validates alike; schemas are named after the raft index they were
+// registered at, which keeps their IDs unique across topics and over
+// topics being deleted.
+type schemas struct {
+	mu       sync.RWMutex
+	byID     map[uint64]*api.Schema
+	topics   map[string][]*api.Schema
+	compiled map[uint64]schemaValidator
+}
+
+func newSchemas() *schemas {
+	return &schemas{
+		byID:     make(map[uint64]*api.Schema),
+		topics:   make(map[string][]*api.Schema),
+		compiled: make(map[uint64]schemaValidator),
+	}
+}
+
+// register adds the next version of the topic's schema, unless one of
+// its versions has the same definition already, which it returns instead.
+func (s *schemas) register(
+	req *api.RegisterSchemaRequest,
+	index uint64,
+) (*api.Schema, error) {
+	v, err := compileSchema(req.Type, req.Definition, req.MessageName)
+	if err != nil {
+		return nil, api.ErrInvalidSchema{Topic: req.Topic, Reason: err.Error()}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := s.topics[req.Topic]
+	for _, schema := range versions {
+		if schema.Type == req.Type &&
+			schema.MessageName == req.MessageName &&
+			bytes.Equal(schema.Definition, req.Definition) {
+			return schema, nil
+		}
+	}
+	if n := len(versions); n > 0 {
+		latest := versions[n-1]
+		err = checkCompatibility(req.Compatibility, v, s.compiled[latest.Id])
+		if err != nil {
+			return nil, api.ErrIncompatibleSchema{
+				Topic:   req.Topic,
+				Version: latest.Version,
+				Reason:  err.Error(),
+			}
+		}
+	}
+	schema := &api.Schema{
+		Id:          index,
+		Topic:       req.Topic,
+		Version:     uint32(len(versions) + 1),
+		Type:        req.Type,
+		Definition:  req.Definition,
+		MessageName: req.MessageName,
+	}
+	s.byID[schema.Id] = schema
+	s.topics[req.Topic] = append(versions, schema)
+	s.compiled[schema.Id] = v
+	return schema, nil
+}
+
+// get returns the schema with the ID.
+func (s *schemas) get(id uint64) (*api.Schema, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	schema, ok := s.byID[id]
+	if !ok {
+		return nil, api.ErrNoSchema{ID: id}
+	}
+	return schema, nil
+}
+
+// version returns the version of the topic's schema, the latest for 0.
+func (s *schemas) version(topic string, version uint32) (*api.Schema, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions := s.topics[topic]
+	if version == 0 && len(versions) > 0 {
+		return versions[len(versions)-1], nil
+	}
+	if version == 0 || int(version) > len(versions) {
+		return nil, api.ErrNoSchema{Topic: topic, Version: version}
+	}
+	return versions[version-1], nil
+}
+
+// validate checks the record's value against the schema its header names
+// or else the topic's latest, and sets the header to the schema's ID. The
+// records of topics with no schema aren't checked. Tombstones have no
+// value to check, and a missing record nothing to check or to carry the
+// header.
+func (s *schemas) validate(topic string, record *api.Record) error {
+	if record == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var schema *api.Schema
+	if header, ok := record.GetHeaders()[SchemaIDHeader]; ok {
+		id, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			return api.ErrSchemaViolation{
+				Topic:  topic,
+				Reason: fmt.Sprintf("invalid %s header %q", SchemaIDHeader, header),
+			}
+		}
+		if schema = s.byID[id]; schema == nil || schema.Topic != topic {
+			return api.ErrNoSchema{Topic: topic, ID: id}
+		}
+	} else if versions := s.topics[topic]; len(versions) > 0 {
+		schema = versions[len(versions)-1]
+	} else {
+		return nil
+	}
+	if len(record.GetValue()) > 0 || len(record.GetKey()) == 0 {
+		if err := s.compiled[schema.Id].validate(record.GetValue()); err != nil {
+			return api.ErrSchemaViolation{
+				Topic:    topic,
+				SchemaID: schema.Id,
+				Reason:   err.Error(),
+			}
+		}
+	}
+	if record.Headers == nil {
+		record.Headers = make(map[string]string, 1)
+	}
+	record.Headers[SchemaIDHeader] = strconv.FormatUint(schema.Id, 10)
+	return nil
+}
+
+// topicDeleted forgets a deleted topic's schemas, so a topic created
+// under its name starts afresh.
+func (s *schemas) topicDeleted(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, schema := range s.topics[topic] {
+		delete(s.byID, schema.Id)
+		delete(s.compiled, schema.Id)
+	}
+	delete(s.topics, topic)
+}
+
+// snapshot returns the schemas by ID.
+func (s *schemas) snapshot() []*api.Schema {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*api.Schema, 0, len(s.byID))
+	for _, schema := range s.byID {
+		list = append(list, schema)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+func (s *schemas) restore(list []*api.Schema) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID = make(map[uint64]*api.Schema, len(list))
+	s.topics = make(map[string][]*api.Schema)
+	s.compiled = make(map[uint64]schemaValidator, len(list))
+	for _, schema := range list {
+		v, err := compileSchema(schema.Type, schema.Definition, schema.MessageName)
+		if err != nil {
+			return fmt.Errorf("schema %d: %w", schema.Id, err)
+		}
+		s.byID[schema.Id] = schema
+		s.topics[schema.Topic] = append(s.topics[schema.Topic], schema)
+		s.compiled[schema.Id] = v
+	}
+	for _, versions := range s.topics {
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].Version < versions[j].Version
+		})
+	}
+	return nil
+}
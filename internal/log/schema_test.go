@@ -0,0 +1,166 @@
+package log
+
+import (
+	"testing"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"item": {"type": "string", "maxLength": 8},
+		"tags": {"type": "array", "items": {"enum": ["new", "paid"]}}
+	},
+	"required": ["id"],
+	"additionalProperties": false
+}`
+
+func TestJSONSchemaValidate(t *testing.T) {
+	s, err := parseJSONSchema([]byte(orderSchema))
+	require.NoError(t, err)
+	for value, want := range map[string]string{
+		`{"id": 1, "item": "book", "tags": ["new"]}`: "",
+		`{"id": 2}`:                      "",
+		`{"item": "book"}`:               `$: missing required property "id"`,
+		`{"id": 1.5}`:                    "$.id: want integer, got number",
+		`{"id": 0}`:                      "$.id: 0 is less than the minimum 1",
+		`{"id": 1, "item": "paperback"}`: "$.item: longer than 8 characters",
+		`{"id": 1, "tags": ["new", 1]}`:  "$.tags[1]: not one of the enum's values",
+		`{"id": 1, "price": 3}`:          "$.price: no value is allowed",
+		`[]`:                             "$: want object, got array",
+	} {
+		err := s.validate([]byte(value))
+		if want == "" {
+			require.NoError(t, err, value)
+		} else {
+			require.EqualError(t, err, want, value)
+		}
+	}
+	require.Error(t, s.validate([]byte(`{"id":`)))
+
+	_, err = parseJSONSchema([]byte(`{"type": "decimal"}`))
+	require.Error(t, err)
+	_, err = parseJSONSchema([]byte(`{"pattern": "("}`))
+	require.Error(t, err)
+}
+
+func TestJSONSchemaCompatibility(t *testing.T) {
+	latest, err := parseJSONSchema([]byte(orderSchema))
+	require.NoError(t, err)
+	for next, want := range map[string]string{
+		// adding an optional property
+		`{"type": "object", "properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"item": {"type": "string", "maxLength": 8},
+			"tags": {"type": "array", "items": {"enum": ["new", "paid"]}},
+			"note": {"type": "string"}
+		}, "required": ["id"]}`: "",
+		// widening a type and loosening bounds
+		`{"type": "object", "properties": {
+			"id": {"type": "number"},
+			"item": {"type": "string"}
+		}}`: "",
+		`{"type": "object", "properties": {
+			"id": {"type": "integer", "minimum": 1}
+		}, "required": ["id", "item"]}`: `$: property "item" became required`,
+		`{"type": "object", "properties": {
+			"id": {"type": "string"}
+		}}`: "$.id: no longer allows integer",
+		`{"type": "object", "properties": {
+			"item": {"type": "string", "maxLength": 4}
+		}}`: "$.item: maxLength lowered to 4",
+		`{"type": "object", "properties": {
+			"tags": {"items": {"enum": ["new"]}}
+		}}`: "$.tags[]: no longer allows the enum value paid",
+	} {
+		s, err := parseJSONSchema([]byte(next))
+		require.NoError(t, err)
+		err = checkCompatibility(api.Compatibility_COMPATIBILITY_BACKWARD, s, latest)
+		if want == "" {
+			require.NoError(t, err, next)
+		} else {
+			require.EqualError(t, err, want, next)
+		}
+	}
+
+	// a closed schema can't read what an open one writes
+	open, err := parseJSONSchema([]byte(`{
+		"type": "object",
+		"properties": {"id": {"type": "integer", "minimum": 1}},
+		"required": ["id"]
+	}`))
+	require.NoError(t, err)
+	err = checkCompatibility(api.Compatibility_COMPATIBILITY_FORWARD, open, latest)
+	require.EqualError(t, err, "$.*: no longer allows any value")
+	err = checkCompatibility(api.Compatibility_COMPATIBILITY_NONE, open, latest)
+	require.NoError(t, err)
+}
+
+// recordDescriptor returns the file declaring api.Record as a
+// FileDescriptorSet, after changing it.
+func recordDescriptor(t *testing.T, change func(*descriptorpb.DescriptorProto)) []byte {
+	t.Helper()
+	file := protodesc.ToFileDescriptorProto(api.File_api_v1_log_proto)
+	for _, m := range file.MessageType {
+		if m.GetName() == "Record" && change != nil {
+			change(m)
+		}
+	}
+	b, err := proto.Marshal(&descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{file},
+	})
+	require.NoError(t, err)
+	return b
+}
+
+func TestProtoSchema(t *testing.T) {
+	s, err := parseProtoSchema(recordDescriptor(t, nil), "log.v1.Record")
+	require.NoError(t, err)
+	value, err := proto.Marshal(&api.Record{
+		Value:   []byte("hello"),
+		Headers: map[string]string{"trace": "1"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.validate(value))
+	require.Error(t, s.validate([]byte{0xff}))
+	// field 31, which the message doesn't declare
+	value = append(value, 0xf8, 0x01, 0x01)
+	require.EqualError(t, s.validate(value), "log.v1.Record: unknown fields")
+
+	_, err = parseProtoSchema(recordDescriptor(t, nil), "log.v1.Nope")
+	require.Error(t, err)
+	_, err = parseProtoSchema(recordDescriptor(t, nil), "log.v1.Partitioner")
+	require.Error(t, err)
+
+	// renaming a field or changing it to a kind encoded alike is fine,
+	// reusing its number for another isn't
+	renamed, err := parseProtoSchema(recordDescriptor(t, func(m *descriptorpb.DescriptorProto) {
+		for _, f := range m.Field {
+			if f.GetName() == "term" {
+				f.Name = proto.String("epoch")
+				f.Type = descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()
+			}
+		}
+	}), "log.v1.Record")
+	require.NoError(t, err)
+	require.NoError(t, checkCompatibility(api.Compatibility_COMPATIBILITY_FULL, renamed, s))
+	changed, err := parseProtoSchema(recordDescriptor(t, func(m *descriptorpb.DescriptorProto) {
+		for _, f := range m.Field {
+			if f.GetName() == "offset" {
+				f.Type = descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+			}
+		}
+	}), "log.v1.Record")
+	require.NoError(t, err)
+	err = checkCompatibility(api.Compatibility_COMPATIBILITY_BACKWARD, changed, s)
+	require.EqualError(t, err, "log.v1.Record.offset: field 2 changed from uint64 to string")
+	json, err := parseJSONSchema([]byte(orderSchema))
+	require.NoError(t, err)
+	require.Equal(t, errSchemaTypeChanged, json.readable(s))
+}
@@ -1,7 +1,10 @@
 package log
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path"
 
@@ -12,8 +15,27 @@ import (
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
-	config                 Config
+	// maxTime is the latest append time in the segment
+	maxTime int64
+	// indexedPos is the store position of the last indexed frame
+	indexedPos uint64
+	// dirty is set when records were appended since the last sync
+	dirty bool
+	// uploaded is set once the closed segment is in the archive
+	uploaded bool
+	// keyID and key are what the segment's frames are encrypted with,
+	// unset for a plaintext segment
+	keyID string
+	key   []byte
+	// closed is set once the segment is closed, so iterators reading it
+	// know to find their place again
+	closed bool
+	// readers is how many snapshot readers have the segment pinned, its
+	// files stay open after it's closed until the last one is done
+	readers int
+	config  Config
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -33,6 +55,9 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
+	if err = s.setupKey(); err != nil {
+		return nil, err
+	}
 	indexFile, err := os.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
 		os.O_RDWR|os.O_CREATE,
@@ -44,48 +69,668 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
-	if off, _, err := s.index.Read(-1); err != nil {
+	if off, pos, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
 		s.nextOffset = baseOffset + uint64(off) + 1
+		s.indexedPos = pos
+	}
+	timeIndexFile, err := os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")),
+		os.O_RDWR|os.O_CREATE,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, c); err != nil {
+		return nil, err
+	}
+	if ts, _, err := s.timeIndex.Read(-1); err == nil {
+		s.maxTime = ts
 	}
 	return s, nil
 }
 
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	return s.AppendBatch([]*api.Record{record})
+}
+
+// AppendBatch writes the records to a single store frame, compressed with
+// the configured codec, and returns the offset of the first one. A dense
+// index gets an entry per record pointing at the frame, a sparse one at
+// most an entry for the frame's first record.
+func (s *segment) AppendBatch(records []*api.Record) (offset uint64, err error) {
+	if s.store.size == 0 {
+		header := append(append([]byte{}, storeMagic...), s.keyID...)
+		if _, _, err = s.store.AppendFrame(header, headerFrame); err != nil {
+			return 0, err
+		}
+	}
+	sparse := s.sparse()
+	indexed := s.indexesFrame(s.store.size)
+	entries := uint64(len(records))
+	if sparse {
+		entries = 0
+		if indexed {
+			entries = 1
+		}
+	}
+	if uint64(len(s.index.mmap)) < s.index.size+entries*entWidth {
+		return 0, io.EOF
+	}
 	cur := s.nextOffset
-	record.Offset = cur
-	p, err := proto.Marshal(record)
+	for i, record := range records {
+		record.Offset = cur + uint64(i)
+	}
+	p, attrs, err := s.encode(records)
 	if err != nil {
 		return 0, err
 	}
-	_, pos, err := s.store.Append(p)
+	_, pos, err := s.store.AppendFrame(p, attrs)
 	if err != nil {
 		return 0, err
 	}
-	if err = s.index.Write(
+	var timed bool
+	for i, record := range records {
 		// index offsets are relative to base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
-		pos,
-	); err != nil {
-		return 0, err
+		rel := uint32(record.Offset - s.baseOffset)
+		if !sparse || (indexed && i == 0) {
+			if err = s.index.Write(rel, pos); err != nil {
+				return 0, err
+			}
+			s.indexedPos = pos
+		}
+		if record.AppendTime > s.maxTime {
+			// a sparse time index only has entries in indexed frames,
+			// which keeps it as small as the offset index
+			if !sparse || (indexed && !timed) {
+				if err = s.timeIndex.Write(record.AppendTime, rel); err != nil {
+					return 0, err
+				}
+				timed = true
+			}
+			s.maxTime = record.AppendTime
+		}
 	}
-	s.nextOffset++
+	s.nextOffset = cur + uint64(len(records))
+	s.dirty = true
 	return cur, nil
 }
 
-func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+// encode marshals the records into a store frame, sealed with the
+// segment's key if it has one.
+func (s *segment) encode(records []*api.Record) ([]byte, uint8, error) {
+	p, attrs, err := s.marshal(records)
+	if err != nil || s.key == nil {
+		return p, attrs, err
+	}
+	if p, err = seal(s.key, p); err != nil {
+		return nil, 0, err
+	}
+	return p, attrs | encryptedFrame, nil
+}
+
+// marshal marshals the records into a frame payload. Without a codec a
+// lone record gets a plain record frame, so segments written before
+// batches existed read the same way.
+func (s *segment) marshal(records []*api.Record) ([]byte, uint8, error) {
+	codec := s.config.Segment.Compression
+	if codec == CodecNone && len(records) == 1 {
+		p, err := proto.Marshal(records[0])
+		return p, 0, err
+	}
+	p, err := proto.Marshal(&api.RecordBatch{Records: records})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	if p, err = codec.compress(p); err != nil {
+		return nil, 0, err
+	}
+	return p, batchFrame | uint8(codec), nil
+}
+
+// setupKey reads the key the segment is encrypted with from the header
+// frame. A segment with an empty store takes the current key if encryption
+// is enabled, and writes the header with its first record.
+func (s *segment) setupKey() error {
+	s.keyID, s.key = "", nil
+	keys := s.config.Encryption.Keys
+	if s.store.size == 0 {
+		if keys == nil {
+			return nil
+		}
+		id, key, err := keys.CurrentKey()
+		if err != nil {
+			return err
+		}
+		s.keyID, s.key = id, key
+		return nil
+	}
+	p, attrs, err := s.store.ReadFrame(0)
+	if err != nil {
+		// a torn header recovery drops
+		return nil
+	}
+	if attrs&headerFrame == 0 || !bytes.HasPrefix(p, storeMagic) {
+		return fmt.Errorf(
+			"log: segment %d's store isn't in a known format",
+			s.baseOffset,
+		)
+	}
+	id := string(p[len(storeMagic):])
+	if id == "" {
+		// a plaintext segment
+		return nil
+	}
+	if keys == nil {
+		return fmt.Errorf(
+			"log: segment %d is encrypted with key %q and no keys are configured",
+			s.baseOffset, id,
+		)
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		return err
+	}
+	s.keyID, s.key = id, key
+	return nil
+}
+
+// sparse reports whether the segment writes a sparse index.
+func (s *segment) sparse() bool {
+	return s.config.Segment.IndexIntervalBytes != 0
+}
+
+// indexesFrame reports whether the frame at pos gets index entries.
+func (s *segment) indexesFrame(pos uint64) bool {
+	return !s.sparse() || s.index.size == 0 ||
+		pos >= s.indexedPos+s.config.Segment.IndexIntervalBytes
+}
+
+// readFrame returns the records held by the store frame at pos and the
+// position of the frame after it. The codec comes from the frame, so
+// segments written under another config still read.
+func (s *segment) readFrame(pos uint64) ([]*api.Record, uint64, error) {
+	p, attrs, err := s.store.ReadFrame(pos)
+	if err != nil {
+		return nil, 0, err
 	}
-	p, err := s.store.Read(pos)
+	records, err := s.decodePayload(p, attrs)
 	if err != nil {
+		return nil, 0, err
+	}
+	return records, pos + headerWidth + uint64(len(p)), nil
+}
+
+// decodePayload decrypts and decodes the payload of one of the segment's
+// frames.
+func (s *segment) decodePayload(p []byte, attrs uint8) ([]*api.Record, error) {
+	if attrs&encryptedFrame != 0 {
+		if s.key == nil {
+			return nil, fmt.Errorf(
+				"log: segment %d has encrypted frames and no key",
+				s.baseOffset,
+			)
+		}
+		var err error
+		if p, err = unseal(s.key, p); err != nil {
+			return nil, err
+		}
+	}
+	return decodeFrame(p, attrs)
+}
+
+func decodeFrame(p []byte, attrs uint8) ([]*api.Record, error) {
+	var err error
+	if attrs&batchFrame == 0 {
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return nil, err
+		}
+		return []*api.Record{record}, nil
+	}
+	if p, err = Codec(attrs & codecMask).decompress(p); err != nil {
+		return nil, err
+	}
+	batch := &api.RecordBatch{}
+	if err = proto.Unmarshal(p, batch); err != nil {
 		return nil, err
 	}
-	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	return batch.Records, nil
+}
+
+func (s *segment) Read(off uint64) (*api.Record, error) {
+	if off >= s.nextOffset {
+		return nil, io.EOF
+	}
+	pos, ok := s.seek(off)
+	if !ok {
+		return nil, api.ErrOffsetCompacted{Offset: off}
+	}
+	for pos < s.store.size {
+		records, next, err := s.readFrame(pos)
+		if err == errChecksum {
+			return nil, api.ErrCorruptRecord{
+				Offset:   off,
+				Segment:  s.baseOffset,
+				Position: pos,
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if record.Offset == off {
+				return record, nil
+			}
+			if record.Offset > off {
+				return nil, api.ErrOffsetCompacted{Offset: off}
+			}
+		}
+		pos = next
+	}
+	return nil, api.ErrOffsetCompacted{Offset: off}
+}
+
+// seek returns the position of the frame to scan forward from to find off.
+// A dense index usually has the entry for off at its relative position,
+// otherwise, because the index is sparse or compaction left gaps, it's
+// the nearest entry before off.
+func (s *segment) seek(off uint64) (uint64, bool) {
+	rel := uint32(off - s.baseOffset)
+	if got, pos, err := s.index.Read(int64(rel)); err == nil && got == rel {
+		return pos, true
+	}
+	_, pos, ok := s.index.Search(rel)
+	return pos, ok
+}
+
+// OffsetForTime returns the first offset in the segment appended at or
+// after ts, counting a record as appended no earlier than any record
+// before it.
+func (s *segment) OffsetForTime(ts int64) (uint64, bool) {
+	off, ok := s.timeIndex.Search(ts)
+	if !s.sparse() {
+		return s.baseOffset + uint64(off), ok
+	}
+	// a sparse time index skips records, so the first one at or after ts
+	// may come before the entry found, but not before the entry ahead of
+	// it
+	from := s.baseOffset
+	if before, ok := s.timeIndex.Before(ts); ok {
+		from = s.baseOffset + uint64(before) + 1
+	}
+	if ok && from == s.baseOffset+uint64(off) {
+		return from, true
+	}
+	pos, found := s.seek(from)
+	for found && pos < s.store.size {
+		records, next, err := s.readFrame(pos)
+		if err != nil {
+			break
+		}
+		for _, record := range records {
+			if ok && record.Offset >= s.baseOffset+uint64(off) {
+				return s.baseOffset + uint64(off), true
+			}
+			if record.Offset >= from && record.AppendTime >= ts {
+				return record.Offset, true
+			}
+		}
+		pos = next
+	}
+	return s.baseOffset + uint64(off), ok
+}
+
+// Recovery describes the repairs made to a segment when it was opened.
+type Recovery struct {
+	BaseOffset uint64
+	// TruncatedBytes is the size of the partially written tail dropped
+	// from the store.
+	TruncatedBytes uint64
+	// RebuiltIndex is set when the index was missing, short or pointed
+	// somewhere other than the store frames and was regenerated.
+	RebuiltIndex bool
+	// RebuiltTimeIndex is set when the time index was missing or did not
+	// cover the records in the store and was regenerated.
+	RebuiltTimeIndex bool
+	// Migrated is set when the store was in the layout from before
+	// frames had checksums and was rewritten in the current one.
+	Migrated bool
+}
+
+func (r Recovery) repaired() bool {
+	return r.TruncatedBytes > 0 || r.RebuiltIndex || r.RebuiltTimeIndex ||
+		r.Migrated
+}
+
+// recover checks the segment's store and index against each other after
+// an unclean shutdown: a torn frame at the end of the store is dropped and
+// the index is rebuilt from the store frames when they disagree. Damage
+// anywhere else in the store is an error unless the config asks for it to
+// be repaired.
+func (s *segment) recover() (Recovery, error) {
+	r := Recovery{BaseOffset: s.baseOffset}
+	positions, end, torn, err := s.store.scan()
+	if err != nil {
+		return r, err
+	}
+	if end < s.store.size {
+		if !torn && !s.config.Segment.Repair {
+			return r, fmt.Errorf(
+				"log: segment %d's store is damaged at position %d",
+				s.baseOffset, end,
+			)
+		}
+		r.TruncatedBytes = s.store.size - end
+		if err = s.store.truncate(end); err != nil {
+			return r, err
+		}
+		if end == 0 {
+			// the header may have been what was torn
+			if err = s.setupKey(); err != nil {
+				return r, err
+			}
+		}
+	}
+	if len(positions) > 0 {
+		// the header holds no records
+		positions = positions[1:]
+	}
+	if !s.indexMatches(positions) {
+		r.RebuiltIndex = true
+		if err = s.rebuildIndex(positions); err != nil {
+			return r, err
+		}
+	}
+	s.setNextOffset(positions)
+	if !s.timeIndexMatches() {
+		r.RebuiltTimeIndex = true
+		if err = s.rebuildTimeIndex(positions); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// setNextOffset sets the segment's next offset from the last index entry
+// and the last of the store frames at positions.
+func (s *segment) setNextOffset(positions []uint64) {
+	s.nextOffset = s.baseOffset
+	if off, pos, err := s.index.Read(-1); err == nil {
+		s.nextOffset = s.baseOffset + uint64(off) + 1
+		s.indexedPos = pos
+	}
+	if len(positions) > 0 {
+		// a sparse index doesn't cover the records after its last entry
+		records, _, err := s.readFrame(positions[len(positions)-1])
+		if err == nil && len(records) > 0 {
+			if next := records[len(records)-1].Offset + 1; next > s.nextOffset {
+				s.nextOffset = next
+			}
+		}
+	}
+}
+
+// indexMatches reports whether the index entries walk the store frames in
+// order, with every frame indexed at least once since a batch frame has an
+// entry per record. A sparse index only has to point at a subset of the
+// frames, starting with the first.
+func (s *segment) indexMatches(positions []uint64) bool {
+	if s.index.size%entWidth != 0 ||
+		s.index.size > uint64(len(s.index.mmap)) {
+		return false
+	}
+	n := int64(s.index.size / entWidth)
+	if n == 0 || len(positions) == 0 {
+		return n == 0 && len(positions) == 0
+	}
+	prev := int64(-1)
+	var frame, count int
+	for i := int64(0); i < n; i++ {
+		off, pos, err := s.index.Read(i)
+		if err != nil || int64(off) <= prev {
+			return false
+		}
+		if pos != positions[frame] {
+			frame++
+			for s.sparse() && frame < len(positions) && positions[frame] < pos {
+				frame++
+			}
+			if i == 0 || frame == len(positions) || pos != positions[frame] {
+				return false
+			}
+			count = 0
+		}
+		count++
+		prev = int64(off)
+	}
+	records, _, err := s.readFrame(positions[frame])
+	if s.sparse() {
+		// the last entry has to point at the frame holding its record
+		for _, record := range records {
+			if record.Offset == s.baseOffset+uint64(prev) {
+				return true
+			}
+		}
+		return err != nil
+	}
+	if frame != len(positions)-1 {
+		return false
+	}
+	// the last frame is the one a crash could have left partly indexed
+	return err != nil || len(records) == count
+}
+
+// rebuildIndex regenerates the index from the store frames, taking each
+// entry's offset from its record since compaction leaves gaps.
+func (s *segment) rebuildIndex(positions []uint64) error {
+	s.index.reset()
+	s.indexedPos = 0
+	var next uint32
+	for _, pos := range positions {
+		indexed := s.indexesFrame(pos)
+		records, _, err := s.readFrame(pos)
+		if err != nil {
+			// keep a damaged frame indexed so reading it reports
+			// the damage
+			if indexed {
+				if err = s.index.Write(next, pos); err != nil {
+					return err
+				}
+				s.indexedPos = pos
+			}
+			next++
+			continue
+		}
+		for i, record := range records {
+			off := next
+			if record.Offset >= s.baseOffset+uint64(next) {
+				off = uint32(record.Offset - s.baseOffset)
+			}
+			if indexed && (!s.sparse() || i == 0) {
+				if err = s.index.Write(off, pos); err != nil {
+					return err
+				}
+				s.indexedPos = pos
+			}
+			next = off + 1
+		}
+	}
+	return nil
+}
+
+func (s *segment) timeIndexMatches() bool {
+	if s.timeIndex.size%tentWidth != 0 ||
+		s.timeIndex.size > uint64(len(s.timeIndex.mmap)) {
+		return false
+	}
+	var maxTime int64
+	prev := int64(-1)
+	for i := int64(0); i < int64(s.timeIndex.size/tentWidth); i++ {
+		ts, off, _ := s.timeIndex.Read(i)
+		if ts <= maxTime || int64(off) <= prev ||
+			s.baseOffset+uint64(off) >= s.nextOffset {
+			return false
+		}
+		maxTime, prev = ts, int64(off)
+	}
+	s.maxTime = maxTime
+	if s.nextOffset == s.baseOffset {
+		return true
+	}
+	// the last record is the one most likely to be missing an entry
+	last, err := s.Read(s.nextOffset - 1)
+	if err != nil {
+		// a damaged record can't be indexed by a rebuild either
+		return true
+	}
+	if s.sparse() {
+		// a sparse time index skips records, so only the segment's
+		// latest append time has to be taken from the record
+		if last.AppendTime > s.maxTime {
+			s.maxTime = last.AppendTime
+		}
+		return true
+	}
+	return last.AppendTime <= maxTime
+}
+
+// rebuildTimeIndex regenerates the time index from the store frames. A
+// sparse time index gets entries in the frames the offset index has
+// entries for.
+func (s *segment) rebuildTimeIndex(positions []uint64) error {
+	s.timeIndex.reset()
+	s.maxTime = 0
+	indexed := make(map[uint64]bool)
+	for i := int64(0); s.sparse() && i < int64(s.index.size/entWidth); i++ {
+		_, pos, _ := s.index.Read(i)
+		indexed[pos] = true
+	}
+	for _, pos := range positions {
+		records, _, err := s.readFrame(pos)
+		if err != nil {
+			// a damaged frame can't be indexed
+			continue
+		}
+		var timed bool
+		for _, record := range records {
+			if record.AppendTime <= s.maxTime {
+				continue
+			}
+			if !s.sparse() || (indexed[pos] && !timed) {
+				if err = s.timeIndex.Write(
+					record.AppendTime,
+					uint32(record.Offset-s.baseOffset),
+				); err != nil {
+					return err
+				}
+				timed = true
+			}
+			s.maxTime = record.AppendTime
+		}
+	}
+	return nil
+}
+
+// truncateFrom removes the records at off and after it from the segment,
+// which has to hold records before off. A batch frame holding records on
+// both sides of off is rewritten with the ones before it, and the indexes
+// are rebuilt from the frames left.
+func (s *segment) truncateFrom(off uint64) error {
+	pos, ok := s.seek(off)
+	if !ok {
+		pos = 0
+	}
+	var keep []*api.Record
+	for pos < s.store.size {
+		p, attrs, err := s.store.ReadFrame(pos)
+		if err != nil {
+			return err
+		}
+		next := pos + headerWidth + uint64(len(p))
+		if attrs&headerFrame != 0 {
+			pos = next
+			continue
+		}
+		records, err := s.decodePayload(p, attrs)
+		if err != nil {
+			return err
+		}
+		if n := len(records); n > 0 && records[n-1].Offset >= off {
+			for _, record := range records {
+				if record.Offset < off {
+					keep = append(keep, record)
+				}
+			}
+			break
+		}
+		pos = next
+	}
+	if err := s.store.truncate(pos); err != nil {
+		return err
+	}
+	if len(keep) > 0 {
+		p, attrs, err := s.encode(keep)
+		if err != nil {
+			return err
+		}
+		if _, _, err = s.store.AppendFrame(p, attrs); err != nil {
+			return err
+		}
+	}
+	positions, _, _, err := s.store.scan()
+	if err != nil {
+		return err
+	}
+	if len(positions) > 0 {
+		positions = positions[1:]
+	}
+	if err = s.rebuildIndex(positions); err != nil {
+		return err
+	}
+	if err = s.rebuildTimeIndex(positions); err != nil {
+		return err
+	}
+	// offsets compaction removed from before off stay used
+	s.nextOffset = off
+	s.dirty = true
+	return nil
+}
+
+// Sync commits the segment's store and indexes to stable storage. The store
+// goes first so the indexes never point past what's on disk.
+func (s *segment) Sync() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// capacity returns how many more records the segment's index can hold.
+func (s *segment) capacity() int {
+	if s.IsMaxed() {
+		return 0
+	}
+	if s.sparse() {
+		// a sparse index needs at most an entry per frame
+		if uint64(len(s.index.mmap))-s.index.size < entWidth {
+			return 0
+		}
+		return math.MaxInt32
+	}
+	return int((uint64(len(s.index.mmap)) - s.index.size) / entWidth)
 }
 
 func (s *segment) IsMaxed() bool {
@@ -94,9 +739,31 @@ func (s *segment) IsMaxed() bool {
 }
 
 func (s *segment) Close() error {
+	s.closed = true
+	if s.readers > 0 {
+		// the last reader to unpin the segment closes its files
+		return nil
+	}
+	return s.closeFiles()
+}
+
+// unpin releases a reader's pin on the segment, closing its files if it
+// was closed while pinned.
+func (s *segment) unpin() error {
+	s.readers--
+	if s.readers > 0 || !s.closed {
+		return nil
+	}
+	return s.closeFiles()
+}
+
+func (s *segment) closeFiles() error {
 	if err := s.index.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
@@ -110,6 +777,9 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 
 	api "github.com/halladj/dis-log/api/v1"
@@ -55,3 +56,77 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-batch-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	// every codec writes to the same segment, which has to read them all
+	// back whatever it's currently configured with
+	var want []*api.Record
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecSnappy, CodecZstd} {
+		s.config.Segment.Compression = codec
+		batch := []*api.Record{
+			{Value: []byte(codec.String() + " first")},
+			{Value: []byte(codec.String() + " second")},
+		}
+		off, err := s.AppendBatch(batch)
+		require.NoError(t, err)
+		require.Equal(t, 16+uint64(len(want)), off)
+		want = append(want, batch...)
+
+		off, err = s.Append(&api.Record{Value: []byte(codec.String() + " single")})
+		require.NoError(t, err)
+		require.Equal(t, 16+uint64(len(want)), off)
+		want = append(want, &api.Record{Value: []byte(codec.String() + " single")})
+	}
+
+	check := func(s *segment) {
+		t.Helper()
+		require.Equal(t, 16+uint64(len(want)), s.nextOffset)
+		for i, record := range want {
+			got, err := s.Read(16 + uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, record.Value, got.Value)
+			require.Equal(t, 16+uint64(i), got.Offset)
+		}
+	}
+	check(s)
+	require.NoError(t, s.Close())
+
+	// the index of a batch has an entry per record, and is rebuilt that
+	// way when it's lost
+	require.NoError(t, os.Remove(path.Join(dir, "16.index")))
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	r, err := s.recover()
+	require.NoError(t, err)
+	require.True(t, r.RebuiltIndex)
+	check(s)
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	r, err = s.recover()
+	require.NoError(t, err)
+	require.False(t, r.repaired())
+	check(s)
+
+	// a batch that doesn't fit in the index is rejected whole
+	c.Segment.MaxIndexBytes = s.index.size + entWidth
+	require.NoError(t, s.Close())
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	size := s.store.size
+	_, err = s.AppendBatch(want[:2])
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, size, s.store.size)
+	require.NoError(t, s.Close())
+}
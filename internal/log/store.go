@@ -3,23 +3,69 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 var (
 	enc = binary.BigEndian
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errChecksum is returned by the store when a frame's checksum does not
+	// match its payload or the frame runs past the end of the file, and by
+	// the segment when an encrypted frame fails authentication. The
+	// segment turns it into an api.ErrCorruptRecord.
+	errChecksum = errors.New("log: record checksum mismatch")
 )
 
 const (
 	lenWidth = 8
+	crcWidth = 4
+	// every frame in the store is laid out as
+	// [payload length][crc32c of payload][payload]
+	headerWidth = lenWidth + crcWidth
+
+	// the top byte of the length prefix holds the frame's attributes,
+	// zero for a frame holding a single uncompressed record
+	attrShift        = 56
+	lenMask   uint64 = 1<<attrShift - 1
+
+	// batchFrame marks a frame holding a batch of records compressed with
+	// the codec in the low bits of the attributes
+	batchFrame uint8 = 0x80
+	codecMask  uint8 = 0x0f
+	// encryptedFrame marks a frame sealed with the segment's key
+	encryptedFrame uint8 = 0x40
+	// headerFrame marks the frame every segment's store starts with,
+	// holding storeMagic followed by the ID of the key an encrypted
+	// segment is sealed with
+	headerFrame uint8 = 0x20
+	// stateFrame marks the frame a raft snapshot starts with, holding the
+	// state machine's state besides the log. It's never in a store.
+	stateFrame uint8 = 0x10
 )
 
+// storeMagic starts the payload of a store's header frame, naming the
+// version of the frame layout. Stores written before frames had attributes
+// and checksums have no header, see migrateStore.
+var storeMagic = []byte("dislog\x00\x01")
+
+// store is a segment's file of frames. Appends are buffered and serialized
+// by mu, while reads of the part of the file that's already been written go
+// straight to the file without taking mu, so readers don't wait on writers
+// or on each other.
 type store struct {
 	*os.File
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// flushed is how much of the store is in the file. It's only changed
+	// with mu held but is read atomically without it.
+	flushed uint64
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -29,63 +75,240 @@ func newStore(f *os.File) (*store, error) {
 	}
 	size := uint64(fi.Size())
 	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
+		File:    f,
+		size:    size,
+		flushed: size,
+		buf:     bufio.NewWriter(f),
 	}, nil
 }
 
 
+// encodeFrame lays p out in a frame carrying the given attributes, as
+// AppendFrame writes it.
+func encodeFrame(p []byte, attrs uint8) []byte {
+	frame := make([]byte, headerWidth+len(p))
+	enc.PutUint64(frame, uint64(len(p))|uint64(attrs)<<attrShift)
+	enc.PutUint32(frame[lenWidth:], checksum(p))
+	copy(frame[headerWidth:], p)
+	return frame
+}
+
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
+	return s.AppendFrame(p, 0)
+}
+
+// AppendFrame appends p in a frame carrying the given attributes.
+func (s *store) AppendFrame(p []byte, attrs uint8) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	header := uint64(len(p)) | uint64(attrs)<<attrShift
+	if err := binary.Write(s.buf, enc, header); err != nil {
+		return 0, 0, err
+	}
+	if err := binary.Write(s.buf, enc, checksum(p)); err != nil {
 		return 0, 0, err
 	}
 	w, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
-	w += lenWidth
+	w += headerWidth
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
 
 func (s *store) Read(pos uint64) ([]byte, error) {
+	b, _, err := s.ReadFrame(pos)
+	return b, err
+}
+
+// ReadFrame returns the payload of the frame at pos and its attributes.
+func (s *store) ReadFrame(pos uint64) ([]byte, uint8, error) {
+	end, err := s.flushedTo(pos + headerWidth)
+	if err != nil {
+		return nil, 0, err
+	}
+	if pos+headerWidth > end {
+		return nil, 0, errChecksum
+	}
+	header := make([]byte, headerWidth)
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
+		return nil, 0, err
+	}
+	size := enc.Uint64(header[:lenWidth]) & lenMask
+	if size > end-pos-headerWidth {
+		// the rest of the frame may still be buffered
+		if end, err = s.flushedTo(pos + headerWidth + size); err != nil {
+			return nil, 0, err
+		}
+	}
+	if size > end-pos-headerWidth {
+		// the length prefix points past the end of the store, so
+		// either the prefix or the tail of the file is damaged
+		return nil, 0, errChecksum
+	}
+	b := make([]byte, size)
+	if _, err := s.File.ReadAt(b, int64(pos+headerWidth)); err != nil {
+		return nil, 0, err
+	}
+	if checksum(b) != enc.Uint32(header[lenWidth:]) {
+		return nil, 0, errChecksum
+	}
+	return b, uint8(enc.Uint64(header[:lenWidth]) >> attrShift), nil
+}
+
+func (s *store) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.flushedTo(uint64(off) + uint64(len(p))); err != nil {
+		return 0, err
+	}
+	return s.File.ReadAt(p, off)
+}
+
+// flushedTo makes sure the store is in the file up to n, only taking the
+// lock and flushing the buffered writes if it isn't already, and returns
+// how much of the store is in the file.
+func (s *store) flushedTo(n uint64) (uint64, error) {
+	if flushed := atomic.LoadUint64(&s.flushed); n <= flushed {
+		return flushed, nil
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return 0, err
+	}
+	return s.size, nil
+}
+
+// flush writes the buffered frames to the file. It's called with mu held.
+func (s *store) flush() error {
 	if err := s.buf.Flush(); err != nil {
-		return nil, err
+		return err
 	}
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	atomic.StoreUint64(&s.flushed, s.size)
+	return nil
+}
+
+// scan walks the frame headers from the start of the store and returns the
+// position of every frame it can walk past and where the last of them
+// ends. Anything past end is either a tail torn by a crash while it was
+// being written, which torn reports and which is safe to drop, or damage
+// to the store. The tail is only taken as torn when it's shorter than the
+// frame its header describes, or is a complete last frame failing its
+// checksum, the frame before it passes its own checksum, and no intact
+// frame starts inside it, so a bad length in the middle of the store isn't
+// mistaken for the end of it.
+func (s *store) scan() (positions []uint64, end uint64, torn bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return nil, 0, false, err
 	}
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
-		return nil, err
+	header := make([]byte, headerWidth)
+	for end+headerWidth <= s.size {
+		if _, err := s.File.ReadAt(header, int64(end)); err != nil {
+			return nil, 0, false, err
+		}
+		size := enc.Uint64(header[:lenWidth]) & lenMask
+		if size > s.size-end-headerWidth {
+			break
+		}
+		next := end + headerWidth + size
+		if next == s.size {
+			// the last frame is the one a crash would have torn, so
+			// only keep it if its payload matches its checksum
+			ok, err := s.verify(end)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			if !ok {
+				break
+			}
+		}
+		positions = append(positions, end)
+		end = next
 	}
-	return b, nil
+	if end == s.size {
+		return positions, end, false, nil
+	}
+	if n := len(positions); n > 0 {
+		if ok, err := s.verify(positions[n-1]); err != nil || !ok {
+			return positions, end, false, err
+		}
+	}
+	tail := make([]byte, s.size-end)
+	if _, err := s.File.ReadAt(tail, int64(end)); err != nil {
+		return nil, 0, false, err
+	}
+	return positions, end, !holdsFrame(tail[1:]), nil
 }
 
+// holdsFrame reports whether an intact frame starts anywhere in b. Empty
+// frames aren't counted since a zero filled tail is full of them.
+func holdsFrame(b []byte) bool {
+	for i := 0; i+headerWidth < len(b); i++ {
+		size := enc.Uint64(b[i:]) & lenMask
+		if size == 0 || size > uint64(len(b)-i-headerWidth) {
+			continue
+		}
+		p := b[i+headerWidth : uint64(i+headerWidth)+size]
+		if checksum(p) == enc.Uint32(b[i+lenWidth:]) {
+			return true
+		}
+	}
+	return false
+}
 
-func (s *store) ReadAt(p []byte, off int64) (int, error) {
+// verify reports whether the payload of the complete frame at pos matches
+// its checksum. It's called with mu held and the store flushed.
+func (s *store) verify(pos uint64) (bool, error) {
+	header := make([]byte, headerWidth)
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
+		return false, err
+	}
+	b := make([]byte, enc.Uint64(header[:lenWidth])&lenMask)
+	if _, err := s.File.ReadAt(b, int64(pos+headerWidth)); err != nil {
+		return false, err
+	}
+	return checksum(b) == enc.Uint32(header[lenWidth:]), nil
+}
+
+// truncate drops everything in the store from pos onwards.
+func (s *store) truncate(pos uint64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
-		return 0, err
+	if err := s.flush(); err != nil {
+		return err
 	}
-	return s.File.ReadAt(p, off)
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
+	atomic.StoreUint64(&s.flushed, pos)
+	return nil
+}
+
+// Sync flushes the buffered writes and commits the file to stable storage.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
 }
 
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.buf.Flush()
+	err := s.flush()
 	if err != nil {
 		return err
 	}
 	return s.File.Close()
 }
+
+func checksum(p []byte) uint32 {
+	return crc32.Checksum(p, crcTable)
+}
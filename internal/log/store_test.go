@@ -3,6 +3,8 @@ package log
 import (
 	"io/ioutil"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -10,7 +12,7 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + headerWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -53,13 +55,13 @@ func testRead(t *testing.T, s *store) {
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+		b := make([]byte, headerWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, headerWidth, n)
 		off += int64(n)
 
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[:lenWidth])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
@@ -69,6 +71,35 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_checksum_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+
+	// flip a bit in the payload of the second record
+	b := make([]byte, 1)
+	_, err = s.ReadAt(b, int64(width+headerWidth))
+	require.NoError(t, err)
+	b[0] ^= 0x01
+	_, err = s.File.WriteAt(b, int64(width+headerWidth))
+	require.NoError(t, err)
+
+	_, err = s.Read(0)
+	require.NoError(t, err)
+	_, err = s.Read(width)
+	require.Equal(t, errChecksum, err)
+
+	// a length prefix that runs past the end of the store is a torn write
+	_, err = s.File.WriteAt([]byte{0xff}, int64(width*2+1))
+	require.NoError(t, err)
+	_, err = s.Read(width * 2)
+	require.Equal(t, errChecksum, err)
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
@@ -88,6 +119,34 @@ func TestStoreClose(t *testing.T) {
 	require.True(t, afterSize > beforeSize)
 }
 
+func TestStoreReadWhileAppending(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_while_appending_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	positions := make(chan uint64, 1000)
+	go func() {
+		defer close(positions)
+		for i := 0; i < 1000; i++ {
+			_, pos, err := s.Append(write)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			positions <- pos
+		}
+	}()
+	// the frames are read right after they're appended, so reads land
+	// both in the buffered tail and in what's already in the file
+	for pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+}
+
 func openFile(name string) (file *os.File, size int64, err error) {
 	f, err := os.OpenFile(
 		name,
@@ -103,3 +162,58 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+// BenchmarkStoreProduceConsume appends frames while consumers read back the
+// frames just behind the tail.
+func BenchmarkStoreProduceConsume(b *testing.B) {
+	f, err := ioutil.TempFile("", "store_produce_consume_bench")
+	require.NoError(b, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f)
+	require.NoError(b, err)
+	defer s.Close()
+
+	var positions []uint64
+	var mu sync.Mutex
+	for i := 0; i < 1000; i++ {
+		_, pos, err := s.Append(write)
+		require.NoError(b, err)
+		positions = append(positions, pos)
+	}
+	done := make(chan struct{})
+	var produced uint64
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, pos, err := s.Append(write)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			positions = append(positions, pos)
+			mu.Unlock()
+			atomic.AddUint64(&produced, 1)
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			mu.Lock()
+			n := len(positions)
+			pos := positions[n-1-i%1000]
+			mu.Unlock()
+			if _, err := s.Read(pos); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+	close(done)
+	b.ReportMetric(float64(atomic.LoadUint64(&produced))/b.Elapsed().Seconds(), "appends/s")
+}
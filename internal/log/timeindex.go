@@ -0,0 +1,130 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tysonmote/gommap"
+)
+
+var (
+	tsWidth   uint64 = 8
+	tentWidth        = tsWidth + offWidth
+)
+
+// timeIndex maps append times to offsets within a segment. An entry is only
+// written when a record's append time is later than every record before it
+// in the segment, so the entries are sorted by both timestamp and offset.
+type timeIndex struct {
+	file *os.File
+	mmap gommap.MMap
+	size uint64
+}
+
+func newTimeIndex(f *os.File, c Config) (*timeIndex, error) {
+	idx := &timeIndex{
+		file: f,
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	idx.size = uint64(fi.Size())
+	if err = os.Truncate(
+		f.Name(), int64(c.Segment.MaxIndexBytes),
+	); err != nil {
+		return nil, err
+	}
+	if idx.mmap, err = gommap.Map(
+		idx.file.Fd(),
+		gommap.PROT_READ|gommap.PROT_WRITE,
+		gommap.MAP_SHARED,
+	); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (i *timeIndex) Close() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	if err := i.file.Sync(); err != nil {
+		return err
+	}
+	if err := i.file.Truncate(int64(i.size)); err != nil {
+		return err
+	}
+	return i.file.Close()
+}
+
+func (i *timeIndex) Read(in int64) (ts int64, out uint32, err error) {
+	if i.size == 0 {
+		return 0, 0, io.EOF
+	}
+	if in == -1 {
+		in = int64(i.size/tentWidth) - 1
+	}
+	pos := uint64(in) * tentWidth
+	if i.size < pos+tentWidth {
+		return 0, 0, io.EOF
+	}
+	ts = int64(enc.Uint64(i.mmap[pos : pos+tsWidth]))
+	out = enc.Uint32(i.mmap[pos+tsWidth : pos+tentWidth])
+	return ts, out, nil
+}
+
+func (i *timeIndex) Write(ts int64, off uint32) error {
+	if uint64(len(i.mmap)) < i.size+tentWidth {
+		return io.EOF
+	}
+	enc.PutUint64(i.mmap[i.size:i.size+tsWidth], uint64(ts))
+	enc.PutUint32(i.mmap[i.size+tsWidth:i.size+tentWidth], off)
+	i.size += tentWidth
+	return nil
+}
+
+// Search returns the relative offset of the first entry whose timestamp is
+// at or after ts.
+func (i *timeIndex) Search(ts int64) (off uint32, ok bool) {
+	n := int(i.size / tentWidth)
+	j := sort.Search(n, func(j int) bool {
+		got, _, _ := i.Read(int64(j))
+		return got >= ts
+	})
+	if j == n {
+		return 0, false
+	}
+	_, off, _ = i.Read(int64(j))
+	return off, true
+}
+
+// Sync commits the index's mapped entries to stable storage.
+func (i *timeIndex) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
+// Before returns the relative offset of the last entry whose timestamp is
+// before ts.
+func (i *timeIndex) Before(ts int64) (off uint32, ok bool) {
+	n := int(i.size / tentWidth)
+	j := sort.Search(n, func(j int) bool {
+		got, _, _ := i.Read(int64(j))
+		return got >= ts
+	})
+	if j == 0 {
+		return 0, false
+	}
+	_, off, _ = i.Read(int64(j - 1))
+	return off, true
+}
+
+// reset drops every entry so the index can be rewritten from scratch.
+func (i *timeIndex) reset() {
+	i.size = 0
+}
+
+func (i *timeIndex) Name() string {
+	return i.file.Name()
+}
@@ -0,0 +1,72 @@
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newTimeIndex(f, c)
+	require.NoError(t, err)
+	_, _, err = idx.Read(-1)
+	require.Error(t, err)
+	_, ok := idx.Search(0)
+	require.False(t, ok)
+
+	entries := []struct {
+		Ts  int64
+		Off uint32
+	}{
+		{Ts: 100, Off: 0},
+		{Ts: 200, Off: 3},
+		{Ts: 300, Off: 4},
+	}
+
+	for _, want := range entries {
+		err = idx.Write(want.Ts, want.Off)
+		require.NoError(t, err)
+	}
+
+	for ts, want := range map[int64]uint32{
+		0:   0,
+		100: 0,
+		101: 3,
+		200: 3,
+		300: 4,
+	} {
+		off, ok := idx.Search(ts)
+		require.True(t, ok)
+		require.Equal(t, want, off)
+	}
+	_, ok = idx.Search(301)
+	require.False(t, ok)
+
+	_, ok = idx.Before(100)
+	require.False(t, ok)
+	off, ok := idx.Before(201)
+	require.True(t, ok)
+	require.Equal(t, uint32(3), off)
+
+	_, _, err = idx.Read(int64(len(entries)))
+	require.Equal(t, io.EOF, err)
+	_ = idx.Close()
+
+	// index should build its state from the existing file
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newTimeIndex(f, c)
+	require.NoError(t, err)
+	ts, off, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, entries[2].Ts, ts)
+	require.Equal(t, entries[2].Off, off)
+}
@@ -0,0 +1,582 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+// topicName is what a topic can be called. Names are directory names, so
+// "." and ".." are ruled out separately.
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+func validTopic(name string) bool {
+	return topicName.MatchString(name) && name != "." && name != ".."
+}
+
+// topics is the registry of a DistributedLog's topics, each with its own
+// log. The default topic, named "", is the log the DistributedLog had
+// before it had topics and is always there; the named topics are created
+// and deleted by applying raft entries, so every server has the same ones.
+// Readers look topics up while entries are applied, so the registry is
+// guarded by mu.
+type topics struct {
+	mu sync.RWMutex
+	// dir holds a directory per named topic
+	dir string
+	// config is what a topic's config overrides
+	config Config
+	logs   map[string]*topicLog
+	// partitions opens the partitions of partitioned topics, which can't
+	// be created without it
+	partitions *partitions
+}
+
+// topicLog is a topic's log, or a partitioned topic's partitions.
+type topicLog struct {
+	log          *Log
+	config       *api.TopicConfig
+	partitions   []*partition
+	partitioners map[api.Partitioner]Partitioner
+}
+
+func newTopics(dir string, config Config, log *Log) *topics {
+	return &topics{
+		dir:    dir,
+		config: config,
+		logs: map[string]*topicLog{
+			"": {log: log, config: &api.TopicConfig{}},
+		},
+	}
+}
+
+// log returns the topic's log. A partitioned topic's records are in its
+// partitions' logs, not the registry's.
+func (t *topics) log(name string) (*Log, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tl, ok := t.logs[name]
+	if !ok {
+		return nil, api.ErrUnknownTopic{Topic: name}
+	}
+	if tl.partitions != nil {
+		return nil, fmt.Errorf("log: topic %q is partitioned", name)
+	}
+	return tl.log, nil
+}
+
+// partition returns the topic's partition with the id. An unpartitioned
+// topic has just the one, 0, and returns a nil partition for it.
+func (t *topics) partition(name string, id uint32) (*topicLog, *partition, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tl, ok := t.logs[name]
+	if !ok {
+		return nil, nil, api.ErrUnknownTopic{Topic: name}
+	}
+	if tl.partitions == nil && id == 0 {
+		return tl, nil, nil
+	}
+	if id >= uint32(len(tl.partitions)) {
+		return nil, nil, api.ErrUnknownPartition{Topic: name, Partition: id}
+	}
+	return tl, tl.partitions[id], nil
+}
+
+// partitionCount returns how many partitions the topic has, 1 for an
+// unpartitioned topic and 0 for one that doesn't exist.
+func (t *topics) partitionCount(name string) uint32 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tl, ok := t.logs[name]
+	if !ok {
+		return 0
+	}
+	if tl.partitions == nil {
+		return 1
+	}
+	return uint32(len(tl.partitions))
+}
+
+// partitionFor returns the partition of the topic the partitioner of the
+// kind picks for records with the keys; explicit picks partition. A batch
+// is a single entry of one partition's raft group, so it goes to the one
+// partition: the keyed partitioners pick its keyed records' partition,
+// failing the batch if their keys map to different ones, and the others
+// make one pick for the whole batch.
+func (t *topics) partitionFor(
+	name string,
+	kind api.Partitioner,
+	partition uint32,
+	keys ...[]byte,
+) (uint32, error) {
+	t.mu.RLock()
+	tl, ok := t.logs[name]
+	t.mu.RUnlock()
+	if !ok {
+		return 0, api.ErrUnknownTopic{Topic: name}
+	}
+	n := uint32(len(tl.partitions))
+	if n == 0 {
+		n = 1
+	}
+	if kind == api.Partitioner_PARTITIONER_EXPLICIT {
+		if partition >= n {
+			return 0, api.ErrUnknownPartition{Topic: name, Partition: partition}
+		}
+		return partition, nil
+	}
+	if tl.partitions == nil {
+		return 0, nil
+	}
+	p, ok := tl.partitioners[kind]
+	if !ok {
+		return 0, fmt.Errorf("log: unknown partitioner %v", kind)
+	}
+	var key []byte
+	for _, k := range keys {
+		if len(k) > 0 {
+			key = k
+			break
+		}
+	}
+	picked := p.Partition(key, n)
+	switch p.(type) {
+	case HashPartitioner, *keyPartitioner:
+	default:
+		return picked, nil
+	}
+	for _, k := range keys {
+		if len(k) == 0 {
+			continue
+		}
+		if other := (HashPartitioner{}).Partition(k, n); other != picked {
+			return 0, api.ErrBatchPartitions{
+				Topic:      name,
+				Partitions: [2]uint32{picked, other},
+			}
+		}
+	}
+	return picked, nil
+}
+
+// create opens a log for a new topic, or its partitions if it's
+// partitioned. The replicas are the servers new partitions start with.
+func (t *topics) create(
+	name string,
+	config *api.TopicConfig,
+	replicas []*api.Server,
+) (*topicLog, error) {
+	if !validTopic(name) {
+		return nil, api.ErrInvalidTopic{Topic: name}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.logs[name]; ok {
+		return nil, api.ErrTopicExists{Topic: name}
+	}
+	if config == nil {
+		config = &api.TopicConfig{}
+	}
+	tl := &topicLog{config: config}
+	var err error
+	if config.Partitions == 0 {
+		tl.log, err = NewLog(filepath.Join(t.dir, name), t.logConfig(config))
+	} else if t.partitions == nil {
+		err = fmt.Errorf("log: partitioned topics aren't supported")
+	} else {
+		tl.partitioners = newPartitioners(config)
+		tl.partitions, err = t.partitions.open(
+			name,
+			config,
+			t.logConfig(config),
+			replicas,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.logs[name] = tl
+	return tl, nil
+}
+
+// remove deletes a named topic and its log.
+func (t *topics) remove(name string) error {
+	if !validTopic(name) {
+		return api.ErrInvalidTopic{Topic: name}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tl, ok := t.logs[name]
+	if !ok {
+		return api.ErrUnknownTopic{Topic: name}
+	}
+	delete(t.logs, name)
+	if tl.partitions == nil {
+		return tl.log.Remove()
+	}
+	if err := tl.closePartitions(); err != nil {
+		return err
+	}
+	return t.partitions.remove(name)
+}
+
+func (tl *topicLog) close() error {
+	if tl.partitions == nil {
+		return tl.log.Close()
+	}
+	return tl.closePartitions()
+}
+
+func (tl *topicLog) closePartitions() error {
+	for _, p := range tl.partitions {
+		if err := p.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset deletes every named topic, along with whatever else is in the
+// topics' directory, for a snapshot to be restored. Partitions are only
+// closed: their raft groups have state of their own, which the topics
+// restored pick up again; prune deletes the rest.
+func (t *topics) reset() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, tl := range t.logs {
+		if name == "" {
+			continue
+		}
+		if err := tl.close(); err != nil {
+			return err
+		}
+		delete(t.logs, name)
+	}
+	return os.RemoveAll(t.dir)
+}
+
+// prune deletes the partitions of topics that aren't in the registry.
+func (t *topics) prune() error {
+	if t.partitions == nil {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.partitions.prune(func(name string) bool {
+		tl, ok := t.logs[name]
+		return ok && tl.partitions != nil
+	})
+}
+
+// list returns the named topics in name order, with their partitions'
+// replicas as this server knows them.
+func (t *topics) list() ([]*api.Topic, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var list []*api.Topic
+	for name, tl := range t.logs {
+		if name == "" {
+			continue
+		}
+		topic := &api.Topic{
+			Name:   name,
+			Config: proto.Clone(tl.config).(*api.TopicConfig),
+		}
+		for _, p := range tl.partitions {
+			replicas, err := p.replicas()
+			if err != nil {
+				return nil, err
+			}
+			topic.Partitions = append(topic.Partitions, &api.Partition{
+				Id:       p.id,
+				Replicas: replicas,
+			})
+		}
+		list = append(list, topic)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// retention returns each unpartitioned topic's retention policy, by
+// topic. Partitions enforce their topic's through their own raft groups.
+func (t *topics) retention() map[string]Retention {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	policies := make(map[string]Retention, len(t.logs))
+	for name, tl := range t.logs {
+		if tl.partitions != nil {
+			continue
+		}
+		policies[name] = t.retentionFor(tl.config)
+	}
+	return policies
+}
+
+// eachPartition calls fn on every partition of the partitioned topics.
+func (t *topics) eachPartition(fn func(topic string, p *partition) error) error {
+	return t.each(func(name string, tl *topicLog) error {
+		for _, p := range tl.partitions {
+			if err := fn(name, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (t *topics) retentionFor(c *api.TopicConfig) Retention {
+	r := t.config.Retention
+	if c.RetentionMaxBytes != 0 {
+		r.MaxBytes = c.RetentionMaxBytes
+	}
+	if c.RetentionMaxAge != 0 {
+		r.MaxAge = time.Duration(c.RetentionMaxAge)
+	}
+	if c.RetentionMaxRecords != 0 {
+		r.MaxRecords = c.RetentionMaxRecords
+	}
+	return r
+}
+
+// logConfig returns the config of a named topic's log. Like the default
+// topic's, its retention is enforced through raft rather than by the log.
+// Named topics aren't tiered, their segments would share the archive's
+// names with the default topic's.
+func (t *topics) logConfig(c *api.TopicConfig) Config {
+	config := t.config
+	config.Retention = Retention{}
+	config.Tiering = Tiering{}
+	config.Segment.InitialOffset = 0
+	if c.MaxStoreBytes != 0 {
+		config.Segment.MaxStoreBytes = c.MaxStoreBytes
+	}
+	if c.MaxIndexBytes != 0 {
+		config.Segment.MaxIndexBytes = c.MaxIndexBytes
+	}
+	return config
+}
+
+// each calls fn on every topic, the default topic first and then the
+// named ones in name order.
+func (t *topics) each(fn func(name string, tl *topicLog) error) error {
+	t.mu.RLock()
+	names := make([]string, 0, len(t.logs))
+	logs := make(map[string]*topicLog, len(t.logs))
+	for name, tl := range t.logs {
+		names = append(names, name)
+		logs[name] = tl
+	}
+	t.mu.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn(name, logs[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes the named topics' logs and partitions.
+func (t *topics) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, tl := range t.logs {
+		if name == "" {
+			continue
+		}
+		if err := tl.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Topic is one of a DistributedLog's topics, or one partition of a
+// partitioned topic. Its records are appended through its raft group and
+// read from the server's copy of its log. Reads fail once the topic is
+// deleted.
+type Topic struct {
+	name      string
+	partition uint32
+	// key is the topic's name in its raft group's registry, where a
+	// partition is the default topic
+	key         string
+	partitioned bool
+	dl          *DistributedLog
+	raft        *raft.Raft
+	producers   *producers
+	log         *Log
+}
+
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// Partition returns the topic's partition, 0 for an unpartitioned topic.
+func (t *Topic) Partition() uint32 {
+	return t.partition
+}
+
+func (t *Topic) Append(record *api.Record) (uint64, error) {
+	return t.AppendIdempotent(0, 0, record)
+}
+
+// AppendIdempotent appends the record as the producer's request with the
+// given sequence number. A retry of one of the producer's recent requests
+// isn't appended again, it returns the offset the request was appended
+// at. A producer ID of zero appends the record unchecked. A partition
+// keeps its producers' sequence numbers apart from the other partitions'.
+func (t *Topic) AppendIdempotent(
+	producerID, sequence uint64,
+	record *api.Record,
+) (uint64, error) {
+	if err := t.checkTxn(producerID); err != nil {
+		return 0, err
+	}
+	// stamp the record before it goes through raft so that every replica
+	// indexes it under the same time
+	record.AppendTime = time.Now().UnixNano()
+	res, err := apply(
+		t.raft,
+		AppendRequestType,
+		&api.ProduceRequest{
+			Record:     record,
+			ProducerId: producerID,
+			Sequence:   sequence,
+			Topic:      t.key,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+// AppendBatch replicates the records as a single raft entry and returns
+// their offsets.
+func (t *Topic) AppendBatch(records []*api.Record) ([]uint64, error) {
+	return t.AppendBatchIdempotent(0, 0, records)
+}
+
+// AppendBatchIdempotent is AppendBatch for an idempotent producer, with the
+// batch taking a single sequence number as in AppendIdempotent.
+func (t *Topic) AppendBatchIdempotent(
+	producerID, sequence uint64,
+	records []*api.Record,
+) ([]uint64, error) {
+	if err := t.checkTxn(producerID); err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		record.AppendTime = now
+	}
+	res, err := apply(
+		t.raft,
+		AppendBatchRequestType,
+		&api.ProduceBatchRequest{
+			Records:    records,
+			ProducerId: producerID,
+			Sequence:   sequence,
+			Topic:      t.key,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.ProduceBatchResponse).Offsets, nil
+}
+
+// checkTxn fails a partition's append from a producer with an open
+// transaction. Transactions are kept by the topic registry's raft group,
+// so they can't take in the partitions' records.
+func (t *Topic) checkTxn(producerID uint64) error {
+	if !t.partitioned || producerID == 0 || !t.dl.producers.inTxn(producerID) {
+		return nil
+	}
+	return api.ErrTxnPartitioned{ProducerID: producerID, Topic: t.name}
+}
+
+func (t *Topic) NewIterator(offset uint64) *Iterator {
+	return t.log.NewIterator(offset)
+}
+
+// NewCommittedIterator returns an iterator reading only committed records
+// from offset on.
+func (t *Topic) NewCommittedIterator(offset uint64) *CommittedIterator {
+	return &CommittedIterator{
+		it:        t.log.NewIterator(offset),
+		topic:     t.key,
+		producers: t.producers,
+	}
+}
+
+func (t *Topic) Read(offset uint64) (*api.Record, error) {
+	return t.log.Read(offset)
+}
+
+// ReadCommitted reads the record at offset for a read_committed consumer:
+// the records of open transactions are out of its range, and those of
+// aborted ones and control records aren't returned.
+func (t *Topic) ReadCommitted(offset uint64) (*api.Record, error) {
+	if offset >= t.producers.stableOffset(t.key) {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	record, err := t.log.Read(offset)
+	if err != nil {
+		return nil, err
+	}
+	if !t.producers.committed(t.key, record) {
+		return nil, api.ErrOffsetNotCommitted{Offset: offset}
+	}
+	return record, nil
+}
+
+func (t *Topic) OffsetForTime(tm time.Time) (uint64, error) {
+	return t.log.OffsetForTime(tm)
+}
+
+// readBarrierTimeout bounds how long a linearizable read waits for its
+// barrier to be queued.
+const readBarrierTimeout = 10 * time.Second
+
+// ReadBarrier readies the topic's reads for the consistency. Local reads
+// are served from this server's log as far as it has applied it. Leader
+// reads are served only by the leader of the topic's raft group, which
+// has applied everything acknowledged to producers unless it was deposed
+// without knowing yet. Linearizable reads also have the leader commit a
+// barrier through the group first, confirming it still leads and having
+// it apply everything committed before the read.
+func (t *Topic) ReadBarrier(c api.Consistency) error {
+	switch c {
+	case api.Consistency_CONSISTENCY_LOCAL:
+		return nil
+	case api.Consistency_CONSISTENCY_LEADER,
+		api.Consistency_CONSISTENCY_LINEARIZABLE:
+	default:
+		return fmt.Errorf("log: unknown consistency %d", c)
+	}
+	if t.raft.State() != raft.Leader {
+		return api.ErrNotLeader{Leader: string(t.raft.Leader())}
+	}
+	if c == api.Consistency_CONSISTENCY_LEADER {
+		return nil
+	}
+	err := t.raft.Barrier(readBarrierTimeout).Error()
+	if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+		return api.ErrNotLeader{Leader: string(t.raft.Leader())}
+	}
+	return err
+}
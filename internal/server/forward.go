@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	api "github.com/halladj/dis-log/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Forwarder connects this server to the others, so the requests only a
+// raft group's leader can serve are forwarded to it. The leader
+// authorizes a forwarded request by this server's subject.
+type Forwarder interface {
+	Client(addr string) (api.LogClient, error)
+}
+
+// LeaderClients is a Forwarder that dials each server with the options
+// once and keeps the connection until it's closed.
+type LeaderClients struct {
+	DialOptions []grpc.DialOption
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func (c *LeaderClients) Client(addr string) (api.LogClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cc, ok := c.conns[addr]
+	if !ok {
+		var err error
+		if cc, err = grpc.NewClient(addr, c.DialOptions...); err != nil {
+			return nil, err
+		}
+		if c.conns == nil {
+			c.conns = make(map[string]*grpc.ClientConn)
+		}
+		c.conns[addr] = cc
+	}
+	return api.NewLogClient(cc), nil
+}
+
+func (c *LeaderClients) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for addr, cc := range c.conns {
+		if cerr := cc.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(c.conns, addr)
+	}
+	return err
+}
+
+// forwardedKey marks forwarded requests in their metadata. They aren't
+// forwarded again, so a request reaching a server that was deposed on
+// the way fails back to its client rather than chasing the leader.
+const forwardedKey = "dis-log-forwarded"
+
+// leader returns a client of the leader the error names and the context
+// to forward the request to it with, if the error is an ErrNotLeader and
+// the request can be forwarded.
+func (s *grpcServer) leader(
+	ctx context.Context,
+	err error,
+) (api.LogClient, context.Context, bool) {
+	notLeader, ok := err.(api.ErrNotLeader)
+	if !ok || notLeader.Leader == "" || s.Forwarder == nil {
+		return nil, nil, false
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok &&
+		len(md.Get(forwardedKey)) > 0 {
+		return nil, nil, false
+	}
+	client, err := s.Forwarder.Client(notLeader.Leader)
+	if err != nil {
+		return nil, nil, false
+	}
+	return client, metadata.AppendToOutgoingContext(ctx, forwardedKey, "1"), true
+}
+
+// forwardConsumeStream serves the consumer's stream from the leader's.
+func forwardConsumeStream(
+	ctx context.Context,
+	client api.LogClient,
+	req *api.ConsumeRequest,
+	stream api.Log_ConsumeStreamServer,
+) error {
+	leader, err := client.ConsumeStream(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := leader.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 type Log struct {
@@ -19,6 +20,7 @@ func (c *Log) Append(record Record) (uint64, error) {
 	defer c.mu.Unlock()
 
 	record.Offset = uint64(len(c.records))
+	record.AppendTime = time.Now().UnixNano()
 	c.records = append(c.records, record)
 
 	return record.Offset, nil
@@ -37,8 +39,14 @@ func (c *Log) Read(offset uint64) (Record, error) {
 
 // Adding Protobuf Types.
 type Record struct {
-	Value  []byte `json:"value"`
-	Offset uint64 `json:"offset"`
+	Value   []byte            `json:"value"`
+	Offset  uint64            `json:"offset"`
+	Key     []byte            `json:"key,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// unix nanoseconds at which the producer created the record and the
+	// server appended it
+	CreateTime int64 `json:"create_time,omitempty"`
+	AppendTime int64 `json:"append_time,omitempty"`
 }
 
 var ErrOffsetNotFount = fmt.Errorf("offset not found")
@@ -2,10 +2,13 @@ package server
 
 import (
 	"context"
+	"io"
+	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	api "github.com/halladj/dis-log/api/v1"
+	"github.com/halladj/dis-log/internal/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
@@ -21,11 +24,39 @@ type Config struct {
 	CommitLog   CommitLog
 	Authorizer  Authorizer
 	GetServerer GetServerer
+	// IdempotentLog serves idempotent producers, produce requests with a
+	// producer ID fail without it
+	IdempotentLog IdempotentLog
+	// TransactionalLog serves transactions and read_committed consumers,
+	// which fail without it
+	TransactionalLog TransactionalLog
+	// Topics serves the named topics, the logs above serve the default
+	// topic. Requests for named topics fail without it.
+	Topics Topics
+	// GroupOffsets keeps consumer groups' committed offsets, which can't
+	// be committed or consumed from without it
+	GroupOffsets GroupOffsets
+	// GroupCoordinator keeps consumer groups' membership, which can't be
+	// joined without it
+	GroupCoordinator GroupCoordinator
+	// SchemaRegistry keeps topics' schemas and validates the records
+	// produced to topics that have one. Without it schemas can't be
+	// registered and records aren't validated.
+	SchemaRegistry SchemaRegistry
+	// ConsistentReader readies the default topic's reads for consumers
+	// that ask for leader or linearizable consistency, which fail without
+	// it
+	ConsistentReader ConsistentReader
+	// Forwarder forwards the requests only a partition's leader can
+	// serve, produces and leader or linearizable consumes, to the leader
+	// when this server isn't it. Without it they fail with the leader's
+	// address for the client to send them to.
+	Forwarder Forwarder
 }
 
 func (s *grpcServer) GetServers(
 	ctx context.Context,
-	req **api.GetServersRequest,
+	req *api.GetServersRequest,
 ) (*api.GetServersResponse, error) {
 
 	servers, err := s.GetServerer.GetServers()
@@ -42,10 +73,661 @@ type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
 
+// IdempotentLog deduplicates retried produce requests by their producer's
+// ID and sequence number.
+type IdempotentLog interface {
+	InitProducer() (uint64, error)
+	IdempotentAppender
+}
+
+// IdempotentAppender appends idempotent producers' requests to a topic.
+type IdempotentAppender interface {
+	AppendIdempotent(producerID, sequence uint64, record *api.Record) (uint64, error)
+	AppendBatchIdempotent(producerID, sequence uint64, records []*api.Record) ([]uint64, error)
+}
+
+func (s *grpcServer) InitProducer(
+	ctx context.Context,
+	req *api.InitProducerRequest,
+) (*api.InitProducerResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.IdempotentLog == nil {
+		return nil, errNoIdempotence
+	}
+
+	id, err := s.IdempotentLog.InitProducer()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.InitProducerResponse{
+		ProducerId: id,
+	}, nil
+}
+
+var errNoIdempotence = status.Error(
+	codes.Unimplemented,
+	"idempotent producers aren't supported by this server",
+)
+
+// TransactionalLog writes producers' transactions and reads the committed
+// records for read_committed consumers.
+type TransactionalLog interface {
+	BeginTxn(producerID uint64) error
+	CommitTxn(producerID uint64) (map[string]uint64, error)
+	AbortTxn(producerID uint64) (map[string]uint64, error)
+	CommittedReader
+}
+
+// CommittedReader reads a topic's committed records.
+type CommittedReader interface {
+	ReadCommitted(uint64) (*api.Record, error)
+	NewCommittedIterator(uint64) *log.CommittedIterator
+}
+
+var errNoTransactions = status.Error(
+	codes.Unimplemented,
+	"transactions aren't supported by this server",
+)
+
+func (s *grpcServer) BeginTxn(
+	ctx context.Context,
+	req *api.BeginTxnRequest,
+) (*api.BeginTxnResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TransactionalLog == nil {
+		return nil, errNoTransactions
+	}
+
+	if err := s.TransactionalLog.BeginTxn(req.ProducerId); err != nil {
+		return nil, err
+	}
+
+	return &api.BeginTxnResponse{}, nil
+}
+
+func (s *grpcServer) CommitTxn(
+	ctx context.Context,
+	req *api.CommitTxnRequest,
+) (*api.CommitTxnResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TransactionalLog == nil {
+		return nil, errNoTransactions
+	}
+
+	offsets, err := s.TransactionalLog.CommitTxn(req.ProducerId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.CommitTxnResponse{
+		Offsets: offsets,
+	}, nil
+}
+
+func (s *grpcServer) AbortTxn(
+	ctx context.Context,
+	req *api.AbortTxnRequest,
+) (*api.AbortTxnResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TransactionalLog == nil {
+		return nil, errNoTransactions
+	}
+
+	offsets, err := s.TransactionalLog.AbortTxn(req.ProducerId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.AbortTxnResponse{
+		Offsets: offsets,
+	}, nil
+}
+
+// Topics creates, deletes and looks up the named topics and their
+// partitions. An unpartitioned topic has the one partition, 0.
+type Topics interface {
+	CreateTopic(name string, config *api.TopicConfig) error
+	DeleteTopic(name string) error
+	ListTopics() ([]*api.Topic, error)
+	Partition(name string, partition uint32) (*log.Topic, error)
+	PartitionFor(
+		name string,
+		partitioner api.Partitioner,
+		partition uint32,
+		keys ...[]byte,
+	) (uint32, error)
+}
+
+var errNoTopics = status.Error(
+	codes.Unimplemented,
+	"topics aren't supported by this server",
+)
+
+func (s *grpcServer) CreateTopic(
+	ctx context.Context,
+	req *api.CreateTopicRequest,
+) (*api.CreateTopicResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		createTopicAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+
+	if err := s.Topics.CreateTopic(req.Name, req.Config); err != nil {
+		return nil, err
+	}
+
+	return &api.CreateTopicResponse{}, nil
+}
+
+func (s *grpcServer) DeleteTopic(
+	ctx context.Context,
+	req *api.DeleteTopicRequest,
+) (*api.DeleteTopicResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		deleteTopicAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+
+	if err := s.Topics.DeleteTopic(req.Name); err != nil {
+		return nil, err
+	}
+
+	return &api.DeleteTopicResponse{}, nil
+}
+
+func (s *grpcServer) ListTopics(
+	ctx context.Context,
+	req *api.ListTopicsRequest,
+) (*api.ListTopicsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+
+	topics, err := s.Topics.ListTopics()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ListTopicsResponse{
+		Topics: topics,
+	}, nil
+}
+
+// GroupOffsets commits and fetches consumer groups' offsets in topics'
+// partitions.
+type GroupOffsets interface {
+	CommitOffset(group, topic string, partition uint32, offset uint64) error
+	FetchOffset(group, topic string, partition uint32) (uint64, error)
+}
+
+var errNoGroups = status.Error(
+	codes.Unimplemented,
+	"consumer groups aren't supported by this server",
+)
+
+func (s *grpcServer) CommitOffset(
+	ctx context.Context,
+	req *api.CommitOffsetRequest,
+) (*api.CommitOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if req.MemberId != "" || req.Generation != 0 {
+		return s.commitMemberOffset(req)
+	}
+	if s.GroupOffsets == nil {
+		return nil, errNoGroups
+	}
+
+	if err := s.GroupOffsets.CommitOffset(
+		req.Group,
+		req.Topic,
+		req.Partition,
+		req.Offset,
+	); err != nil {
+		return nil, err
+	}
+
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// commitMemberOffset commits the offset as a member of the group, fenced
+// off by the group's generation.
+func (s *grpcServer) commitMemberOffset(
+	req *api.CommitOffsetRequest,
+) (*api.CommitOffsetResponse, error) {
+	if s.GroupCoordinator == nil {
+		return nil, errNoGroups
+	}
+
+	if err := s.GroupCoordinator.CommitMemberOffset(
+		req.Group,
+		req.MemberId,
+		req.Generation,
+		req.Topic,
+		req.Partition,
+		req.Offset,
+	); err != nil {
+		return nil, err
+	}
+
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchOffset(
+	ctx context.Context,
+	req *api.FetchOffsetRequest,
+) (*api.FetchOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.GroupOffsets == nil {
+		return nil, errNoGroups
+	}
+
+	offset, err := s.GroupOffsets.FetchOffset(
+		req.Group,
+		req.Topic,
+		req.Partition,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.FetchOffsetResponse{
+		Offset: offset,
+	}, nil
+}
+
+// GroupCoordinator keeps consumer groups' membership, dividing the
+// partitions of the topics the members consume among them.
+type GroupCoordinator interface {
+	JoinGroup(
+		group, memberID string,
+		topics []string,
+		sessionTimeout time.Duration,
+		strategy string,
+	) (*api.JoinGroupResponse, error)
+	Heartbeat(group, memberID string, generation uint64) error
+	LeaveGroup(group, memberID string) error
+	CommitMemberOffset(
+		group, memberID string,
+		generation uint64,
+		topic string,
+		partition uint32,
+		offset uint64,
+	) error
+}
+
+func (s *grpcServer) JoinGroup(
+	ctx context.Context,
+	req *api.JoinGroupRequest,
+) (*api.JoinGroupResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.GroupCoordinator == nil {
+		return nil, errNoGroups
+	}
+
+	return s.GroupCoordinator.JoinGroup(
+		req.Group,
+		req.MemberId,
+		req.Topics,
+		time.Duration(req.SessionTimeout),
+		req.Strategy,
+	)
+}
+
+func (s *grpcServer) Heartbeat(
+	ctx context.Context,
+	req *api.HeartbeatRequest,
+) (*api.HeartbeatResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.GroupCoordinator == nil {
+		return nil, errNoGroups
+	}
+
+	if err := s.GroupCoordinator.Heartbeat(
+		req.Group,
+		req.MemberId,
+		req.Generation,
+	); err != nil {
+		return nil, err
+	}
+
+	return &api.HeartbeatResponse{}, nil
+}
+
+func (s *grpcServer) LeaveGroup(
+	ctx context.Context,
+	req *api.LeaveGroupRequest,
+) (*api.LeaveGroupResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.GroupCoordinator == nil {
+		return nil, errNoGroups
+	}
+
+	if err := s.GroupCoordinator.LeaveGroup(
+		req.Group,
+		req.MemberId,
+	); err != nil {
+		return nil, err
+	}
+
+	return &api.LeaveGroupResponse{}, nil
+}
+
+// SchemaRegistry keeps the versions of topics' schemas.
+type SchemaRegistry interface {
+	RegisterSchema(
+		topic string,
+		kind api.SchemaType,
+		definition []byte,
+		messageName string,
+		compatibility api.Compatibility,
+	) (*api.Schema, error)
+	Schema(id uint64) (*api.Schema, error)
+	SchemaVersion(topic string, version uint32) (*api.Schema, error)
+	// ValidateRecord fails with an InvalidArgument error for a record
+	// that doesn't match the topic's schema, and sets the header naming
+	// the schema on one that does.
+	ValidateRecord(topic string, record *api.Record) error
+}
+
+var errNoSchemas = status.Error(
+	codes.Unimplemented,
+	"schemas aren't supported by this server",
+)
+
+func (s *grpcServer) RegisterSchema(
+	ctx context.Context,
+	req *api.RegisterSchemaRequest,
+) (*api.RegisterSchemaResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.SchemaRegistry == nil {
+		return nil, errNoSchemas
+	}
+
+	schema, err := s.SchemaRegistry.RegisterSchema(
+		req.Topic,
+		req.Type,
+		req.Definition,
+		req.MessageName,
+		req.Compatibility,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.RegisterSchemaResponse{Schema: schema}, nil
+}
+
+func (s *grpcServer) GetSchema(
+	ctx context.Context,
+	req *api.GetSchemaRequest,
+) (*api.GetSchemaResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.SchemaRegistry == nil {
+		return nil, errNoSchemas
+	}
+
+	var schema *api.Schema
+	var err error
+	if req.Id != 0 {
+		schema, err = s.SchemaRegistry.Schema(req.Id)
+	} else {
+		schema, err = s.SchemaRegistry.SchemaVersion(req.Topic, req.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.GetSchemaResponse{Schema: schema}, nil
+}
+
+// ConsistentReader readies a topic's reads for a consistency.
+type ConsistentReader interface {
+	ReadBarrier(api.Consistency) error
+}
+
+var errNoConsistency = status.Error(
+	codes.Unimplemented,
+	"consistent reads aren't supported by this server",
+)
+
+// readBarrier readies the reads of the topic's partition for the
+// consumer's consistency.
+func (s *grpcServer) readBarrier(req *api.ConsumeRequest) error {
+	if req.Consistency == api.Consistency_CONSISTENCY_LOCAL {
+		return nil
+	}
+	if req.Topic == "" {
+		if s.ConsistentReader == nil {
+			return errNoConsistency
+		}
+		if req.Partition != 0 {
+			return api.ErrUnknownPartition{Partition: req.Partition}
+		}
+		return s.ConsistentReader.ReadBarrier(req.Consistency)
+	}
+	t, err := s.topic(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	return t.ReadBarrier(req.Consistency)
+}
+
+// validate checks the records produced to the topic against its schema.
+func (s *grpcServer) validate(topic string, records ...*api.Record) error {
+	if s.SchemaRegistry == nil {
+		return nil
+	}
+	for _, record := range records {
+		if err := s.SchemaRegistry.ValidateRecord(topic, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startOffset returns the offset a consumer starts reading from, its
+// group's committed offset if it names a group that has one.
+func (s *grpcServer) startOffset(req *api.ConsumeRequest) (uint64, error) {
+	if req.Group == "" {
+		return req.Offset, nil
+	}
+	if s.GroupOffsets == nil {
+		return 0, errNoGroups
+	}
+	offset, err := s.GroupOffsets.FetchOffset(
+		req.Group,
+		req.Topic,
+		req.Partition,
+	)
+	switch err.(type) {
+	case nil:
+		return offset, nil
+	case api.ErrNoCommittedOffset:
+		return req.Offset, nil
+	default:
+		return 0, err
+	}
+}
+
+// topic returns a named topic's partition.
+func (s *grpcServer) topic(name string, partition uint32) (*log.Topic, error) {
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+	return s.Topics.Partition(name, partition)
+}
+
+// partitionFor returns the partition of the topic records with the keys
+// are produced to. The default topic has just partition 0.
+func (s *grpcServer) partitionFor(
+	topic string,
+	partitioner api.Partitioner,
+	partition uint32,
+	keys ...[]byte,
+) (uint32, error) {
+	if topic != "" {
+		if s.Topics == nil {
+			return 0, errNoTopics
+		}
+		return s.Topics.PartitionFor(topic, partitioner, partition, keys...)
+	}
+	if partitioner == api.Partitioner_PARTITIONER_EXPLICIT && partition != 0 {
+		return 0, api.ErrUnknownPartition{Partition: partition}
+	}
+	return 0, nil
+}
+
+// commitLog returns the log serving the topic's partition.
+func (s *grpcServer) commitLog(topic string, partition uint32) (CommitLog, error) {
+	if topic == "" {
+		if partition != 0 {
+			return nil, api.ErrUnknownPartition{Partition: partition}
+		}
+		return s.CommitLog, nil
+	}
+	t, err := s.topic(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// appender returns the log serving the idempotent producers of the
+// topic's partition.
+func (s *grpcServer) appender(
+	topic string,
+	partition uint32,
+) (IdempotentAppender, error) {
+	if topic == "" {
+		if s.IdempotentLog == nil {
+			return nil, errNoIdempotence
+		}
+		if partition != 0 {
+			return nil, api.ErrUnknownPartition{Partition: partition}
+		}
+		return s.IdempotentLog, nil
+	}
+	t, err := s.topic(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// committedReader returns the log serving the read_committed consumers of
+// the topic's partition.
+func (s *grpcServer) committedReader(
+	topic string,
+	partition uint32,
+) (CommittedReader, error) {
+	if topic == "" {
+		if s.TransactionalLog == nil {
+			return nil, errNoTransactions
+		}
+		if partition != 0 {
+			return nil, api.ErrUnknownPartition{Partition: partition}
+		}
+		return s.TransactionalLog, nil
+	}
+	t, err := s.topic(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
 const (
-	objectWildCard = "*"
-	produceAction  = "produce"
-	consumeAction  = "consume"
+	objectWildCard    = "*"
+	produceAction     = "produce"
+	consumeAction     = "consume"
+	createTopicAction = "create"
+	deleteTopicAction = "delete"
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -57,7 +739,10 @@ type grpcServer struct {
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) ([]uint64, error)
 	Read(uint64) (*api.Record, error)
+	NewIterator(uint64) *log.Iterator
+	OffsetForTime(time.Time) (uint64, error)
 }
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
@@ -79,20 +764,146 @@ func (s *grpcServer) Produce(
 	); err != nil {
 		return nil, err
 	}
+	if err := s.validate(req.Topic, req.Record); err != nil {
+		return nil, err
+	}
 
-	offset, err := s.CommitLog.Append(req.Record)
+	partition, err := s.partitionFor(
+		req.Topic,
+		req.Partitioner,
+		req.Partition,
+		req.Record.GetKey(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.produce(req, partition)
+	if client, ctx, ok := s.leader(ctx, err); ok {
+		// the leader appends to the partition picked here
+		req.Partitioner = api.Partitioner_PARTITIONER_EXPLICIT
+		req.Partition = partition
+		return client.Produce(ctx, req)
+	}
+	return res, err
+}
+
+// produce appends the request's record to the topic's partition, which
+// only the partition's leader can.
+func (s *grpcServer) produce(
+	req *api.ProduceRequest,
+	partition uint32,
+) (*api.ProduceResponse, error) {
+	var offset uint64
+	if req.ProducerId == 0 {
+		clog, err := s.commitLog(req.Topic, partition)
+		if err != nil {
+			return nil, err
+		}
+		if offset, err = clog.Append(req.Record); err != nil {
+			return nil, err
+		}
+		return &api.ProduceResponse{
+			Offset:    offset,
+			Partition: partition,
+		}, nil
+	}
+	appender, err := s.appender(req.Topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err = appender.AppendIdempotent(
+		req.ProducerId,
+		req.Sequence,
+		req.Record,
+	)
 	if err != nil {
 		return nil, err
 	}
 
 	return &api.ProduceResponse{
-		Offset: offset,
+		Offset:    offset,
+		Partition: partition,
 	}, nil
 }
 
-func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	record, err := s.CommitLog.Read(req.Offset)
+func (s *grpcServer) ProduceBatch(
+	ctx context.Context,
+	req *api.ProduceBatchRequest,
+) (*api.ProduceBatchResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	if err := s.validate(req.Topic, req.Records...); err != nil {
+		return nil, err
+	}
+
+	// the batch goes to a single partition, its keys have to agree on it
+	keys := make([][]byte, 0, len(req.Records))
+	for _, record := range req.Records {
+		keys = append(keys, record.GetKey())
+	}
+	partition, err := s.partitionFor(
+		req.Topic,
+		req.Partitioner,
+		req.Partition,
+		keys...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.produceBatch(req, partition)
+	if client, ctx, ok := s.leader(ctx, err); ok {
+		req.Partitioner = api.Partitioner_PARTITIONER_EXPLICIT
+		req.Partition = partition
+		return client.ProduceBatch(ctx, req)
+	}
+	return res, err
+}
+
+// produceBatch appends the request's records to the topic's partition as
+// produce does.
+func (s *grpcServer) produceBatch(
+	req *api.ProduceBatchRequest,
+	partition uint32,
+) (*api.ProduceBatchResponse, error) {
+	var offsets []uint64
+	if req.ProducerId == 0 {
+		clog, err := s.commitLog(req.Topic, partition)
+		if err != nil {
+			return nil, err
+		}
+		if offsets, err = clog.AppendBatch(req.Records); err != nil {
+			return nil, err
+		}
+		return &api.ProduceBatchResponse{
+			Offsets:   offsets,
+			Partition: partition,
+		}, nil
+	}
+	appender, err := s.appender(req.Topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err = appender.AppendBatchIdempotent(
+		req.ProducerId,
+		req.Sequence,
+		req.Records,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ProduceBatchResponse{
+		Offsets:   offsets,
+		Partition: partition,
+	}, nil
+}
 
+func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
 		objectWildCard,
@@ -100,6 +911,31 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 	); err != nil {
 		return nil, err
 	}
+	if err := s.readBarrier(req); err != nil {
+		if client, ctx, ok := s.leader(ctx, err); ok {
+			return client.Consume(ctx, req)
+		}
+		return nil, err
+	}
+
+	var record *api.Record
+	if req.ReadCommitted {
+		reader, err := s.committedReader(req.Topic, req.Partition)
+		if err != nil {
+			return nil, err
+		}
+		if record, err = reader.ReadCommitted(req.Offset); err != nil {
+			return nil, err
+		}
+		return &api.ConsumeResponse{
+			Record: record,
+		}, nil
+	}
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	record, err = clog.Read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
@@ -109,6 +945,34 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 	}, nil
 }
 
+func (s *grpcServer) OffsetForTime(
+	ctx context.Context,
+	req *api.OffsetForTimeRequest,
+) (*api.OffsetForTimeResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildCard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := clog.OffsetForTime(
+		time.Unix(0, req.Timestamp),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.OffsetForTimeResponse{
+		Offset: offset,
+	}, nil
+}
+
 func (s *grpcServer) ProduceStream(
 	stream api.Log_ProduceStreamServer,
 ) error {
@@ -134,26 +998,62 @@ func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
+	if err := s.Authorizer.Authorize(
+		subject(stream.Context()),
+		objectWildCard,
+		consumeAction,
+	); err != nil {
+		return err
+	}
 
+	offset, err := s.startOffset(req)
+	if err != nil {
+		return err
+	}
+	if err = s.readBarrier(req); err != nil {
+		if client, ctx, ok := s.leader(stream.Context(), err); ok {
+			return forwardConsumeStream(ctx, client, req, stream)
+		}
+		return err
+	}
+	// the iterators skip compacted offsets on their own
+	var it interface {
+		Next() (*api.Record, error)
+	}
+	if req.ReadCommitted {
+		reader, err := s.committedReader(req.Topic, req.Partition)
+		if err != nil {
+			return err
+		}
+		it = reader.NewCommittedIterator(offset)
+	} else {
+		clog, err := s.commitLog(req.Topic, req.Partition)
+		if err != nil {
+			return err
+		}
+		it = clog.NewIterator(offset)
+	}
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
 
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			record, err := it.Next()
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
 				continue
 			default:
+				if err == io.EOF {
+					continue
+				}
 				return err
 			}
 
-			if err = stream.Send(res); err != nil {
+			if err = stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
 				return err
 			}
-			req.Offset++
 		}
 	}
 }
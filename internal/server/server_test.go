@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
@@ -31,6 +32,9 @@ func TestServer(t *testing.T) {
 		"produce/consume a message to/from the log succeeeds": testProduceConsume,
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
 		"consume past log boundary fails":                     testConsumePastBoundary,
+		"offset for time":                                     testOffsetForTime,
+		"produce batch":                                       testProduceBatch,
+		"unsupported features fail":                           testUnsupported,
 		"unauthorized fails":                                  testUnauthorized,
 	} {
 		t.Run(scenario, func(t *testing.T) {
@@ -131,7 +135,13 @@ func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
 	ctx := context.Background()
 
 	want := &api.Record{
-		Value: []byte("hello world"),
+		Value:      []byte("hello world"),
+		Key:        []byte("greeting"),
+		CreateTime: time.Now().Add(-time.Second).UnixNano(),
+		Headers: map[string]string{
+			"trace-id":     "4bf92f3577b34da6",
+			"content-type": "text/plain",
+		},
 	}
 
 	produce, err := client.Produce(
@@ -148,6 +158,21 @@ func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
 	require.NoError(t, err)
 	require.Equal(t, want.Value, consume.Record.Value)
 	require.Equal(t, want.Offset, consume.Record.Offset)
+	require.Equal(t, want.Key, consume.Record.Key)
+	require.Equal(t, want.CreateTime, consume.Record.CreateTime)
+	require.Equal(t, want.Headers, consume.Record.Headers)
+	require.True(t, consume.Record.AppendTime >= want.CreateTime)
+
+	// the default topic has the one partition
+	require.Equal(t, uint32(0), produce.Partition)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:      want,
+		Partitioner: api.Partitioner_PARTITIONER_EXPLICIT,
+		Partition:   1,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Partition: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
 }
 
 func testConsumePastBoundary(
@@ -224,14 +249,115 @@ func testProduceConsumeStream(
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			require.NotZero(t, res.Record.AppendTime)
 		}
 	}
 }
 
+func testProduceBatch(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+	}
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: records,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, produce.Offsets)
+
+	for i, off := range produce.Offsets {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset: off,
+		})
+		require.NoError(t, err)
+		require.Equal(t, records[i].Value, consume.Record.Value)
+		require.Equal(t, off, consume.Record.Offset)
+	}
+}
+
+func testUnsupported(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	_, err := client.InitProducer(ctx, &api.InitProducerRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:     &api.Record{Value: []byte("hello world")},
+		ProducerId: 1,
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.BeginTxn(ctx, &api.BeginTxnRequest{ProducerId: 1})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{ReadCommitted: true})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "orders"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "workers"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "workers"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.RegisterSchema(ctx, &api.RegisterSchemaRequest{
+		Definition: []byte(`{"type": "object"}`),
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Consistency: api.Consistency_CONSISTENCY_LINEARIZABLE,
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Group: "workers"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func testOffsetForTime(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	var times []int64
+	for i := 0; i < 3; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("hello world"),
+			},
+		})
+		require.NoError(t, err)
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset: produce.Offset,
+		})
+		require.NoError(t, err)
+		times = append(times, consume.Record.AppendTime)
+	}
+
+	res, err := client.OffsetForTime(ctx, &api.OffsetForTimeRequest{
+		Timestamp: times[1],
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+
+	res, err = client.OffsetForTime(ctx, &api.OffsetForTimeRequest{
+		Timestamp: times[2] + 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Offset)
+}
+
 func testUnauthorized(
 	t *testing.T,
 	_,
@@ -263,4 +389,24 @@ func testUnauthorized(
 	if gotCode != wantCode {
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
+	create, err := client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Name: "orders",
+	})
+	if create != nil {
+		t.Fatalf("create topic response should be nil")
+	}
+	gotCode, wantCode = status.Code(err), codes.PermissionDenied
+	if gotCode != wantCode {
+		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
+	}
+	del, err := client.DeleteTopic(ctx, &api.DeleteTopicRequest{
+		Name: "orders",
+	})
+	if del != nil {
+		t.Fatalf("delete topic response should be nil")
+	}
+	gotCode, wantCode = status.Code(err), codes.PermissionDenied
+	if gotCode != wantCode {
+		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
+	}
 }